@@ -1,15 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	mf "github.com/axent-pl/axproxy/manifest"
-	"github.com/axent-pl/axproxy/module"
 	_ "github.com/axent-pl/axproxy/modules"
-	"github.com/axent-pl/axproxy/proxy"
+	"github.com/axent-pl/axproxy/server"
 )
 
 func init() {
@@ -42,33 +46,134 @@ func init() {
 	slog.SetDefault(slog.New(handler))
 }
 
+const defaultConfigPath = "assets/config/config.yaml"
+
+type pathsFlag []string
+
+func (p *pathsFlag) String() string { return strings.Join(*p, ",") }
+
+func (p *pathsFlag) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func (p pathsFlag) orDefault() []string {
+	if len(p) == 0 {
+		return []string{defaultConfigPath}
+	}
+	return p
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: axproxy <command> [flags]
+
+Commands:
+  serve        start all proxies (default)
+  validate     decode and validate every manifest
+  print-chain  print the resolved module chain of a proxy
+
+Run "axproxy <command> -h" for command flags.
+`)
+}
+
 func main() {
-	data, err := os.ReadFile("assets/config/config.yaml")
-	if err != nil {
-		slog.Error("proxy reading configuration failed ", "error", err)
-		os.Exit(1)
+	args := os.Args[1:]
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
 	}
-	proxies, err := mf.DecodeAll[proxy.AuthProxy](bytes.NewReader(data))
-	if err != nil {
+
+	if cmd != "serve" {
+		// keep command output readable, only problems are logged
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	}
+
+	switch cmd {
+	case "serve":
+		os.Exit(serve(args))
+	case "validate":
+		os.Exit(validate(args))
+	case "print-chain":
+		os.Exit(printChain(args))
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func serve(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "manifest file or directory (repeatable)")
+	watchInterval := fs.Duration("watch-interval", 2*time.Second, "configuration change polling interval, 0 disables")
+	devCert := fs.Bool("dev-cert", false, "serve tls listeners without certificate with the bundled development certificate")
+	_ = fs.Parse(args)
+
+	srv := server.New(configPaths.orDefault(), server.Options{DevCertificate: *devCert})
+	if err := srv.Reload(); err != nil {
 		slog.Error("proxy initialization failed", "error", err)
-		os.Exit(1)
+		return 1
 	}
-	mods, err := mf.DecodeAll[module.Module](bytes.NewReader(data))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	srv.Watch(ctx, *watchInterval)
+
+	slog.Info("Shutdown requested")
+	stop()
+	srv.Shutdown(context.Background())
+	return 0
+}
+
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "manifest file or directory (repeatable)")
+	devCert := fs.Bool("dev-cert", false, "accept tls listeners without certificate")
+	_ = fs.Parse(args)
+
+	docs, err := mf.ReadPaths(configPaths.orDefault())
 	if err != nil {
-		slog.Error("proxy modules initialization failed", "error", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	errs := server.Validate(docs, server.Options{DevCertificate: *devCert})
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d error(s) in %d document(s)\n", len(errs), len(docs))
+		return 1
+	}
+	fmt.Printf("%d document(s) valid\n", len(docs))
+	return 0
+}
+
+func printChain(args []string) int {
+	fs := flag.NewFlagSet("print-chain", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "manifest file or directory (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: axproxy print-chain [--config <file|dir>]... <proxy>")
+		fs.PrintDefaults()
 	}
-	for _, mod := range mods {
-		module.Register(mod)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
 	}
 
-	for _, p := range proxies {
-		go func() {
-			slog.Info("Proxy started", "proxy_name", p.Metadata.Name)
-			if err := p.ListenAndServe(); err != nil {
-				slog.Error("Proxy failed", "error", err)
-			}
-		}()
+	docs, err := mf.ReadPaths(configPaths.orDefault())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if err := server.PrintChain(os.Stdout, docs, fs.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
 	}
-	select {}
+	return 0
 }
@@ -1,6 +1,8 @@
 package manifest
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"reflect"
@@ -8,6 +10,30 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Document is a single YAML document split out of a manifest stream.
+type Document struct {
+	Envelope
+	Raw    []byte
+	Source string
+	Index  int
+	Line   int
+}
+
+// Position describes where the document was read from.
+func (d Document) Position() string {
+	src := d.Source
+	if src == "" {
+		src = "<input>"
+	}
+	return fmt.Sprintf("%s:%d (document %d)", src, d.Line, d.Index+1)
+}
+
+// Digest returns a stable fingerprint of the document content.
+func (d Document) Digest() string {
+	sum := sha256.Sum256(d.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
 func DecodeOne[K any](r io.Reader) (K, error) {
 	var nilObj K
 	objs, err := DecodeAll[K](r)
@@ -21,9 +47,33 @@ func DecodeOne[K any](r io.Reader) (K, error) {
 }
 
 func DecodeAll[K any](r io.Reader) ([]K, error) {
-	dec := yaml.NewDecoder(r)
+	docs, err := SplitAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeDocuments[K](docs)
+}
+
+func DecodeDocuments[K any](docs []Document) ([]K, error) {
 	var out []K
-	kType := reflect.TypeOf((*K)(nil)).Elem()
+	for _, doc := range docs {
+		obj, ok, err := DecodeDocument[K](doc)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		out = append(out, obj)
+	}
+	return out, nil
+}
+
+// SplitAll reads a multi-document YAML stream and returns every non-empty document
+// together with its envelope.
+func SplitAll(r io.Reader) ([]Document, error) {
+	dec := yaml.NewDecoder(r)
+	var out []Document
 
 	for {
 		var node yaml.Node
@@ -48,37 +98,42 @@ func DecodeAll[K any](r io.Reader) ([]K, error) {
 			return nil, fmt.Errorf("unmarshal envelope: %w", err)
 		}
 		if env.Kind == "" {
-			return nil, fmt.Errorf("missing kind")
+			return nil, fmt.Errorf("line %d: missing kind", node.Line)
 		}
 		if env.APIVersion == "" {
-			return nil, fmt.Errorf("missing apiVersion for kind %q", env.Kind)
+			return nil, fmt.Errorf("line %d: missing apiVersion for kind %q", node.Line, env.Kind)
 		}
+		out = append(out, Document{Envelope: env, Raw: raw, Index: len(out), Line: node.Line})
+	}
 
-		handlerRegistryMu.RLock()
-		t, ok := kindToTypeMap[env.Kind]
-		handlerRegistryMu.RUnlock()
-		if t != kType {
-			continue
-		}
-		if !ok {
-			return nil, fmt.Errorf("no handler registered for kind %q (apiVersion=%q)", env.Kind, env.APIVersion)
-		}
-		ha, ok := handlerRegistryByKind[env.Kind]
-		if !ok {
-			return nil, fmt.Errorf("no handler registered for kind %q (apiVersion=%q)", env.Kind, env.APIVersion)
-		}
-		h, ok := ha.(KindHandler[K])
-		if !ok {
-			return nil, fmt.Errorf("handler for kind %q (apiVersion=%q) does not implement %v", env.Kind, env.APIVersion, reflect.TypeOf((*KindHandler[K])(nil)).Elem())
-		}
+	return out, nil
+}
 
-		obj, err := h.Unmarshal(env.APIVersion, raw)
-		if err != nil {
-			return nil, fmt.Errorf("kind %q apiVersion %q name %q: %w",
-				env.Kind, env.APIVersion, env.Metadata.Name, err)
-		}
-		out = append(out, obj)
+// DecodeDocument decodes a single document into K. The boolean result is false
+// when the document kind is not handled by a K handler.
+func DecodeDocument[K any](doc Document) (K, bool, error) {
+	var nilObj K
+	kType := reflect.TypeOf((*K)(nil)).Elem()
+
+	handlerRegistryMu.RLock()
+	t, ok := kindToTypeMap[doc.Kind]
+	ha, haOk := handlerRegistryByKind[doc.Kind]
+	handlerRegistryMu.RUnlock()
+	if t != kType {
+		return nilObj, false, nil
+	}
+	if !ok || !haOk {
+		return nilObj, false, fmt.Errorf("no handler registered for kind %q (apiVersion=%q)", doc.Kind, doc.APIVersion)
+	}
+	h, ok := ha.(KindHandler[K])
+	if !ok {
+		return nilObj, false, fmt.Errorf("handler for kind %q (apiVersion=%q) does not implement %v", doc.Kind, doc.APIVersion, reflect.TypeOf((*KindHandler[K])(nil)).Elem())
 	}
 
-	return out, nil
+	obj, err := h.Unmarshal(doc.APIVersion, doc.Raw)
+	if err != nil {
+		return nilObj, false, fmt.Errorf("kind %q apiVersion %q name %q: %w",
+			doc.Kind, doc.APIVersion, doc.Metadata.Name, err)
+	}
+	return obj, true, nil
 }
@@ -0,0 +1,67 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ExpandPaths resolves files and directories into the list of manifest files.
+// Directories are scanned non-recursively for *.yaml and *.yml files in lexical order.
+func ExpandPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var dirFiles []string
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			ext := strings.ToLower(filepath.Ext(e.Name()))
+			if ext == ".yaml" || ext == ".yml" {
+				dirFiles = append(dirFiles, filepath.Join(path, e.Name()))
+			}
+		}
+		slices.Sort(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// ReadPaths reads and splits every manifest found in the given files and directories.
+func ReadPaths(paths []string) ([]Document, error) {
+	files, err := ExpandPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	var out []Document
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := SplitAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for i := range docs {
+			docs[i].Source = file
+		}
+		out = append(out, docs...)
+	}
+	return out, nil
+}
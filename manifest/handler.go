@@ -34,3 +34,10 @@ func RegisterHandler[K any](handler KindHandler[K]) error {
 
 	return nil
 }
+
+func HasHandler(kind string) bool {
+	handlerRegistryMu.RLock()
+	defer handlerRegistryMu.RUnlock()
+	_, ok := handlerRegistryByKind[kind]
+	return ok
+}
@@ -0,0 +1,310 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the latency histogram bucket upper bounds in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry used by the package level constructors and served by
+// Handler.
+var Default = NewRegistry()
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metric families and renders them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]collector{}}
+}
+
+func (reg *Registry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, exists := reg.collectors[c.name()]; exists {
+		slog.Error("duplicate metric registration", "metric", c.name())
+		return
+	}
+	reg.collectors[c.name()] = c
+}
+
+// Write renders every registered metric family sorted by name.
+func (reg *Registry) Write(w io.Writer) {
+	reg.mu.RLock()
+	names := make([]string, 0, len(reg.collectors))
+	for name := range reg.collectors {
+		names = append(names, name)
+	}
+	cs := make([]collector, 0, len(names))
+	slices.Sort(names)
+	for _, name := range names {
+		cs = append(cs, reg.collectors[name])
+	}
+	reg.mu.RUnlock()
+
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+// Handler serves the registry for scraping.
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		reg.Write(w)
+	})
+}
+
+// Handler serves the Default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// desc describes a metric family and keeps its series keyed by label values.
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string { return d.fqName }
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.fqName, escapeHelp(d.help), d.fqName, d.typ)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		slog.Error("metric label cardinality mismatch", "metric", d.fqName, "expected", len(d.labels), "got", len(values))
+		fixed := make([]string, len(d.labels))
+		copy(fixed, values)
+		values = fixed
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a family of monotonically increasing counters.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (reg *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{fqName: name, help: help, typ: "counter", labels: labels}, values: map[string]float64{}}
+	reg.register(c)
+	return c
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// Inc increments the counter identified by the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increases the counter identified by the label values. Negative deltas are
+// ignored.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += delta
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.fqName, c.labelPairs(key), formatFloat(c.values[key]))
+	}
+}
+
+// GaugeVec is a family of values that can go up and down.
+type GaugeVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (reg *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{desc: desc{fqName: name, help: help, typ: "gauge", labels: labels}, values: map[string]float64{}}
+	reg.register(g)
+	return g
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+func (g *GaugeVec) Set(v float64, values ...string) {
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = v
+}
+
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] += delta
+}
+
+// Delete removes the series identified by the label values.
+func (g *GaugeVec) Delete(values ...string) {
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.values, key)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.writeHeader(w)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.fqName, g.labelPairs(key), formatFloat(g.values[key]))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a family of histograms with cumulative buckets.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+func (reg *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	h := &HistogramVec{desc: desc{fqName: name, help: help, typ: "histogram", labels: labels}, buckets: buckets, values: map[string]*histogramValue{}}
+	reg.register(h)
+	return h
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, h.labelPairs(key, "le", formatFloat(upper)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, h.labelPairs(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.fqName, h.labelPairs(key), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.fqName, h.labelPairs(key), hv.count)
+	}
+}
+
+// StatusClass returns the status class label ("2xx", "5xx", ...) of an HTTP
+// status code.
+func StatusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
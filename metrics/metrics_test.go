@@ -0,0 +1,103 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/axent-pl/axproxy/metrics"
+)
+
+func scrape(t *testing.T, reg *metrics.Registry) string {
+	t.Helper()
+	srv := httptest.NewServer(reg.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("scrape error: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	return string(body)
+}
+
+func assertContains(t *testing.T, body string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expected line %q in scrape output:\n%s", line, body)
+		}
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	reg := metrics.NewRegistry()
+	c := reg.NewCounterVec("test_requests_total", "Requests.", "proxy", "status_class")
+	c.Inc("default", "2xx")
+	c.Inc("default", "2xx")
+	c.Add(3, "second", "5xx")
+	c.Add(-1, "second", "5xx")
+
+	assertContains(t, scrape(t, reg),
+		"# HELP test_requests_total Requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{proxy="default",status_class="2xx"} 2`,
+		`test_requests_total{proxy="second",status_class="5xx"} 3`,
+	)
+}
+
+func TestGaugeVec(t *testing.T) {
+	reg := metrics.NewRegistry()
+	g := reg.NewGaugeVec("test_store_size", "Store size.", "module")
+	g.Set(5, "a")
+	g.Add(-2, "a")
+	g.Set(1, "b")
+	g.Delete("b")
+
+	body := scrape(t, reg)
+	assertContains(t, body, `test_store_size{module="a"} 3`)
+	if strings.Contains(body, `module="b"`) {
+		t.Fatalf("deleted series still exported:\n%s", body)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	reg := metrics.NewRegistry()
+	h := reg.NewHistogramVec("test_duration_seconds", "Duration.", []float64{0.1, 1}, "lookup")
+	h.Observe(0.0625, "l1")
+	h.Observe(0.5, "l1")
+	h.Observe(2, "l1")
+
+	assertContains(t, scrape(t, reg),
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{lookup="l1",le="0.1"} 1`,
+		`test_duration_seconds_bucket{lookup="l1",le="1"} 2`,
+		`test_duration_seconds_bucket{lookup="l1",le="+Inf"} 3`,
+		`test_duration_seconds_sum{lookup="l1"} 2.5625`,
+		`test_duration_seconds_count{lookup="l1"} 3`,
+	)
+}
+
+func TestLabelEscaping(t *testing.T) {
+	reg := metrics.NewRegistry()
+	c := reg.NewCounterVec("test_escape_total", "Escaping.", "value")
+	c.Inc("a\"b\\c\nd")
+
+	assertContains(t, scrape(t, reg), `test_escape_total{value="a\"b\\c\nd"} 1`)
+}
+
+func TestStatusClass(t *testing.T) {
+	cases := map[int]string{200: "2xx", 302: "3xx", 404: "4xx", 502: "5xx", 0: "unknown"}
+	for code, want := range cases {
+		if got := metrics.StatusClass(code); got != want {
+			t.Fatalf("StatusClass(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
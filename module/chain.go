@@ -0,0 +1,16 @@
+package module
+
+// ChainInfo describes a chain for ChainValidator: its modules in chain order
+// and whether a listener of the proxy verifies client certificates.
+type ChainInfo struct {
+	Modules            []Module
+	ClientCertificates bool
+}
+
+// ChainValidator is implemented by modules that depend on other modules of
+// their chain or on the listeners of the proxy. ValidateChain is called by the
+// proxy validation for every chain the module appears in and returns one error
+// per problem found.
+type ChainValidator interface {
+	ValidateChain(chain ChainInfo) []error
+}
@@ -0,0 +1,38 @@
+package module
+
+import (
+	"net/http"
+
+	s "github.com/axent-pl/axproxy/state"
+)
+
+const (
+	HookMiddleware      = "Middleware"
+	HookProxyMiddleware = "ProxyMiddleware"
+	HookDirector        = "Director"
+	HookModifyResponse  = "ModifyResponse"
+	HookSpecialRoutes   = "SpecialRoutes"
+)
+
+// Hooks reports which chain hooks the module participates in. A module takes part
+// in a hook when its middleware returns a non-nil wrapper, which is the same rule
+// the proxy applies when building the chain.
+func Hooks(m Module) []string {
+	var hooks []string
+	if m.Middleware(func(http.ResponseWriter, *http.Request) {}) != nil {
+		hooks = append(hooks, HookMiddleware)
+	}
+	if m.ProxyMiddleware(func(http.ResponseWriter, *http.Request, *s.State) {}) != nil {
+		hooks = append(hooks, HookProxyMiddleware)
+	}
+	if m.ProxyDirectorMiddleware(func(*http.Request, *s.State) {}) != nil {
+		hooks = append(hooks, HookDirector)
+	}
+	if m.ProxyModifyResponseMiddleware(func(*http.Response, *s.State) error { return nil }) != nil {
+		hooks = append(hooks, HookModifyResponse)
+	}
+	if len(m.SpecialRoutes()) > 0 {
+		hooks = append(hooks, HookSpecialRoutes)
+	}
+	return hooks
+}
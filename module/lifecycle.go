@@ -0,0 +1,201 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Starter is implemented by modules that need to acquire external resources
+// (network connections, key sets) before serving. Start is invoked by the runtime
+// after every manifest has been decoded, never during decoding.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper is implemented by modules holding resources (connections, stores,
+// background goroutines) that must be released when the module goes out of service.
+// Modules are stopped in reverse chain order.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// HealthChecker is implemented by modules that can report whether their
+// dependencies are currently usable.
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+type Status string
+
+const (
+	StatusStarting Status = "starting"
+	StatusRunning  Status = "running"
+	StatusDegraded Status = "degraded"
+	StatusStopped  Status = "stopped"
+)
+
+type Health struct {
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	Status   Status    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"start_attempts,omitempty"`
+}
+
+func (h Health) OK() bool {
+	return h.Status == StatusRunning
+}
+
+const (
+	startAttemptTimeout = 15 * time.Second
+	startBackoffInitial = 1 * time.Second
+	startBackoffMax     = 1 * time.Minute
+)
+
+type lifecycleEntry struct {
+	mu       sync.Mutex
+	status   Status
+	err      error
+	since    time.Time
+	attempts int
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func (e *lifecycleEntry) set(status Status, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.status != status {
+		e.since = time.Now().UTC()
+	}
+	e.status = status
+	e.err = err
+}
+
+// Lifecycle starts modules, retries failed starts with exponential backoff and
+// tracks their status. A module whose start fails is marked degraded instead of
+// aborting the configuration.
+type Lifecycle struct {
+	mu      sync.Mutex
+	entries map[Module]*lifecycleEntry
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{entries: map[Module]*lifecycleEntry{}}
+}
+
+// Start makes one synchronous start attempt and, if it fails, keeps retrying in
+// the background until the module starts or is stopped. Starting an already
+// tracked module is a no-op.
+func (l *Lifecycle) Start(m Module) {
+	l.mu.Lock()
+	if _, ok := l.entries[m]; ok {
+		l.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &lifecycleEntry{status: StatusStarting, since: time.Now().UTC(), cancel: cancel, done: make(chan struct{})}
+	l.entries[m] = entry
+	l.mu.Unlock()
+
+	starter, ok := m.(Starter)
+	if !ok {
+		entry.set(StatusRunning, nil)
+		close(entry.done)
+		return
+	}
+
+	if l.attempt(ctx, m, starter, entry) {
+		close(entry.done)
+		return
+	}
+	go func() {
+		defer close(entry.done)
+		backoff := startBackoffInitial
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if l.attempt(ctx, m, starter, entry) {
+				return
+			}
+			backoff = min(backoff*2, startBackoffMax)
+		}
+	}()
+}
+
+func (l *Lifecycle) attempt(ctx context.Context, m Module, starter Starter, entry *lifecycleEntry) bool {
+	entry.mu.Lock()
+	entry.attempts++
+	attempts := entry.attempts
+	entry.mu.Unlock()
+
+	attemptCtx, cancel := context.WithTimeout(ctx, startAttemptTimeout)
+	defer cancel()
+	err := starter.Start(attemptCtx)
+	if err == nil {
+		entry.set(StatusRunning, nil)
+		slog.Info("Module started", "module_kind", m.Kind(), "module_name", m.Name(), "attempts", attempts)
+		return true
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return true
+	}
+	entry.set(StatusDegraded, err)
+	slog.Error("Module start failed, running degraded", "module_kind", m.Kind(), "module_name", m.Name(), "attempts", attempts, "error", err)
+	return false
+}
+
+// Stop cancels pending start retries and stops the module if it implements Stopper.
+func (l *Lifecycle) Stop(ctx context.Context, m Module) error {
+	l.mu.Lock()
+	entry, ok := l.entries[m]
+	delete(l.entries, m)
+	l.mu.Unlock()
+	if ok {
+		entry.cancel()
+		<-entry.done
+		entry.set(StatusStopped, nil)
+	}
+	if stopper, ok := m.(Stopper); ok {
+		return stopper.Stop(ctx)
+	}
+	return nil
+}
+
+// Health reports the lifecycle status of the module. Running modules that
+// implement HealthChecker are probed and reported degraded when the probe fails.
+func (l *Lifecycle) Health(ctx context.Context, m Module) Health {
+	h := Health{Kind: m.Kind(), Name: m.Name(), Status: StatusRunning}
+
+	l.mu.Lock()
+	entry, ok := l.entries[m]
+	l.mu.Unlock()
+	if ok {
+		entry.mu.Lock()
+		h.Status = entry.status
+		h.Since = entry.since
+		h.Attempts = entry.attempts
+		if entry.err != nil {
+			h.Error = entry.err.Error()
+		}
+		entry.mu.Unlock()
+	}
+	if h.Status != StatusRunning {
+		return h
+	}
+
+	if checker, ok := m.(HealthChecker); ok {
+		if err := checker.Health(ctx); err != nil {
+			h.Status = StatusDegraded
+			h.Error = err.Error()
+		}
+	}
+	return h
+}
@@ -0,0 +1,111 @@
+package module_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/module"
+)
+
+// flakyModule fails its first failures starts and reports health errors while
+// unhealthy is set.
+type flakyModule struct {
+	module.NoopModule
+	mu        sync.Mutex
+	failures  int
+	starts    int
+	stops     int
+	unhealthy error
+}
+
+func (m *flakyModule) Kind() string { return "Flaky" }
+func (m *flakyModule) Name() string { return "flaky" }
+
+func (m *flakyModule) Start(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.starts++
+	if m.starts <= m.failures {
+		return errors.New("backend unavailable")
+	}
+	return nil
+}
+
+func (m *flakyModule) Stop(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stops++
+	return nil
+}
+
+func (m *flakyModule) Health(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unhealthy
+}
+
+func (m *flakyModule) counts() (starts, stops int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.starts, m.stops
+}
+
+func TestLifecycleRetriesFailedStart(t *testing.T) {
+	lc := module.NewLifecycle()
+	m := &flakyModule{failures: 1}
+	lc.Start(m)
+	t.Cleanup(func() { _ = lc.Stop(context.Background(), m) })
+
+	h := lc.Health(context.Background(), m)
+	if h.Status != module.StatusDegraded || h.Attempts != 1 || h.Error != "backend unavailable" {
+		t.Fatalf("expected degraded module after failed start, got %+v", h)
+	}
+	lc.Start(m)
+	if starts, _ := m.counts(); starts != 1 {
+		t.Fatalf("expected start of a tracked module to be a no-op, got %d starts", starts)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for lc.Health(context.Background(), m).Status != module.StatusRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected start to be retried, got %+v", lc.Health(context.Background(), m))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if h := lc.Health(context.Background(), m); h.Attempts != 2 || h.Error != "" {
+		t.Fatalf("expected running module after second attempt, got %+v", h)
+	}
+}
+
+func TestLifecycleStopCancelsRetries(t *testing.T) {
+	lc := module.NewLifecycle()
+	m := &flakyModule{failures: 100}
+	lc.Start(m)
+	if err := lc.Stop(context.Background(), m); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if starts, stops := m.counts(); starts != 1 || stops != 1 {
+		t.Fatalf("expected no start retry after stop, got %d starts and %d stops", starts, stops)
+	}
+}
+
+func TestLifecycleHealthProbesRunningModules(t *testing.T) {
+	lc := module.NewLifecycle()
+	m := &flakyModule{unhealthy: errors.New("keys not loaded")}
+	lc.Start(m)
+	t.Cleanup(func() { _ = lc.Stop(context.Background(), m) })
+
+	if h := lc.Health(context.Background(), m); h.Status != module.StatusDegraded || h.Error != "keys not loaded" {
+		t.Fatalf("expected failing health probe to degrade the module, got %+v", h)
+	}
+	m.mu.Lock()
+	m.unhealthy = nil
+	m.mu.Unlock()
+	if h := lc.Health(context.Background(), m); !h.OK() {
+		t.Fatalf("expected healthy module to be running, got %+v", h)
+	}
+}
@@ -3,6 +3,7 @@ package module
 import (
 	"fmt"
 	"log/slog"
+	"maps"
 	"sync"
 )
 
@@ -15,25 +16,36 @@ func (k KindName) Equal(other KindName) bool {
 	return k.Kind == other.Kind && k.Name == other.Name
 }
 
-var (
-	registryMU sync.RWMutex
-	registry   = map[KindName]Module{}
-)
+// Registry holds the modules of a single configuration generation.
+type Registry struct {
+	mu      sync.RWMutex
+	modules map[KindName]Module
+}
+
+func NewRegistry() *Registry {
+	return &Registry{modules: map[KindName]Module{}}
+}
 
-func Register(module Module) {
-	registryMU.Lock()
-	defer registryMU.Unlock()
+func (reg *Registry) Register(module Module) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
 	kn := KindName{Kind: module.Kind(), Name: module.Name()}
-	registry[kn] = module
+	reg.modules[kn] = module
 	slog.Info("Module registered", "module_kind", module.Kind(), "module_name", module.Name())
 }
 
-func Get(kind string, name string) (Module, error) {
-	registryMU.RLock()
-	defer registryMU.RUnlock()
+func (reg *Registry) Get(kind string, name string) (Module, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
 	kn := KindName{Kind: kind, Name: name}
-	if module, ok := registry[kn]; ok {
+	if module, ok := reg.modules[kn]; ok {
 		return module, nil
 	}
 	return nil, fmt.Errorf("module not found, kind: %s, name: %s", kind, name)
 }
+
+func (reg *Registry) Modules() map[KindName]Module {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return maps.Clone(reg.modules)
+}
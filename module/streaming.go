@@ -0,0 +1,53 @@
+package module
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// BodyBufferer is implemented by modules whose ModifyResponse hook reads the
+// whole response body. The proxy skips the hook of a module that buffers for
+// streaming responses and protocol upgrades, which would otherwise be held in
+// memory or never complete.
+type BodyBufferer interface {
+	BuffersResponseBody() bool
+}
+
+// BuffersResponseBody reports whether the module declared that it buffers
+// response bodies.
+func BuffersResponseBody(m Module) bool {
+	b, ok := m.(BodyBufferer)
+	return ok && b.BuffersResponseBody()
+}
+
+// IsUpgrade reports whether the request asks to switch protocols, e.g. a
+// WebSocket handshake.
+func IsUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsStreaming reports whether the response must be relayed as it arrives: a
+// protocol switch, Server-Sent Events, a gRPC response, whose status follows
+// the messages in trailers, or a body of unknown length. A body only unknown
+// because the transport decompressed it is not streaming.
+func IsStreaming(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ct == "text/event-stream" || strings.HasPrefix(ct, "application/grpc") {
+		return true
+	}
+	return resp.ContentLength < 0 && !resp.Uncompressed
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/axent-pl/axproxy/manifest"
 	"github.com/axent-pl/axproxy/module"
 	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/tracing"
 	"github.com/axent-pl/axproxy/utils"
 )
 
@@ -207,6 +208,9 @@ func (m *AuditModule) buildAttrs(reqFields AuditRequestFields, respFields AuditR
 	attrs := []any{
 		"request_id", requestID,
 	}
+	if sc := tracing.SpanContextFromContext(r.Context()); sc.IsValid() {
+		attrs = append(attrs, "trace_id", sc.TraceID.String())
+	}
 
 	if reqFields.Method {
 		attrs = append(attrs, "method", r.Method)
@@ -234,10 +238,15 @@ func (m *AuditModule) buildAttrs(reqFields AuditRequestFields, respFields AuditR
 		attrs = append(attrs, "host", r.Host)
 	}
 	if reqFields.Origin {
-		attrs = append(attrs, "source_origin", utils.RequestScheme(r)+"://"+r.Host)
+		attrs = append(attrs, "source_origin", utils.RequestScheme(r)+"://"+utils.RequestHost(r))
 	}
 	if reqFields.RemoteAddr {
 		attrs = append(attrs, "remote_addr", r.RemoteAddr)
+		if v, ok := st.Get(state.ClientKey); ok {
+			if c, ok := v.(state.Client); ok {
+				attrs = append(attrs, "client_ip", c.IP)
+			}
+		}
 	}
 
 	if respFields.Status {
@@ -260,10 +269,26 @@ func (m *AuditModule) buildAttrs(reqFields AuditRequestFields, respFields AuditR
 	}
 	if respFields.TargetOrigin {
 		if st != nil {
+			origin := ""
 			if v, ok := st.Get(auditTargetOriginKey); ok {
-				if origin, ok := v.(string); ok && origin != "" {
-					attrs = append(attrs, "target_origin", origin)
-				}
+				origin, _ = v.(string)
+			}
+			var target state.UpstreamTarget
+			if v, ok := st.Get(state.UpstreamTargetKey); ok {
+				target, _ = v.(state.UpstreamTarget)
+			}
+			// The picked target changes when the request is retried.
+			if target.Origin != "" {
+				origin = target.Origin
+			}
+			if origin != "" {
+				attrs = append(attrs, "target_origin", origin)
+			}
+			if target.Name != "" {
+				attrs = append(attrs, "target_name", target.Name)
+			}
+			if len(target.Metadata) > 0 {
+				attrs = append(attrs, "target_metadata", target.Metadata)
 			}
 		}
 	}
@@ -347,13 +372,20 @@ func (w *auditResponseWriter) Flush() {
 	}
 }
 
+// Hijack records the protocol switch, whose 101 response is written to the
+// hijacked connection instead of through WriteHeader.
 func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.status = http.StatusSwitchingProtocols
 		return h.Hijack()
 	}
 	return nil, nil, http.ErrNotSupported
 }
 
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (w *auditResponseWriter) Push(target string, opts *http.PushOptions) error {
 	if p, ok := w.ResponseWriter.(http.Pusher); ok {
 		return p.Push(target, opts)
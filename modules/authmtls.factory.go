@@ -0,0 +1,40 @@
+package modules
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"gopkg.in/yaml.v3"
+)
+
+type AuthMTLSModuleV1 struct {
+	manifest.TypeMeta `yaml:",inline"`
+	Metadata          manifest.ObjectMeta `yaml:"metadata"`
+	Spec              AuthMTLSModule      `yaml:"spec"`
+}
+
+type AuthMTLSHandler struct{}
+
+func (AuthMTLSHandler) Kind() string { return KIND_AUTHMTLS }
+
+func (AuthMTLSHandler) Unmarshal(apiVersion string, rawYAML []byte) (module.Module, error) {
+	switch apiVersion {
+	case "v1":
+		var obj AuthMTLSModuleV1
+		if err := yaml.Unmarshal(rawYAML, &obj); err != nil {
+			return &AuthMTLSModule{}, err
+		}
+		obj.Spec.Metadata = obj.Metadata
+		return &obj.Spec, nil
+	default:
+		return &AuthMTLSModule{}, fmt.Errorf("unsupported apiVersion %q", apiVersion)
+	}
+}
+
+func init() {
+	if err := manifest.RegisterHandler(&AuthMTLSHandler{}); err != nil {
+		slog.Error("init AuthMTLSHandler", "error", err)
+	}
+}
@@ -0,0 +1,381 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/utils/mapper"
+)
+
+const KIND_AUTHMTLS string = "AuthMTLS"
+
+const (
+	mtlsCRLReloadInterval  = time.Minute
+	mtlsDefaultIdentityVal = "${certificate.subject.dn}"
+)
+
+var (
+	errCertificateRevoked = errors.New("client certificate revoked")
+	errCRLSignature       = errors.New("crl is not signed by the certificate issuer")
+	errCRLUnavailable     = errors.New("crl not loaded")
+)
+
+// AuthMTLSModule authenticates requests with the client certificate verified by
+// a tls listener with client_auth. The certificate fields are available to the
+// mappings as certificate.*, e.g. certificate.subject.common_name,
+// certificate.dns_names[0] or certificate.fingerprint_sha256, and can be mapped
+// to session.*, request.* or state.*.
+//
+// IdentityHeader is always removed from the incoming request and, for
+// authenticated requests, set to IdentityValue with control and non-ASCII
+// characters escaped.
+type AuthMTLSModule struct {
+	module.NoopModule
+	Metadata manifest.ObjectMeta `yaml:"metadata"`
+	When     *mapper.Condition   `yaml:"when"`
+
+	Mappings       map[string]string `yaml:"mappings"`
+	CRLFile        string            `yaml:"crl_file"`
+	IdentityHeader string            `yaml:"identity_header"`
+	IdentityValue  string            `yaml:"identity_value"`
+
+	crlMu   sync.RWMutex       `yaml:"-"`
+	crl     *loadedCRL         `yaml:"-"`
+	stopCRL context.CancelFunc `yaml:"-"`
+}
+
+type loadedCRL struct {
+	list     *x509.RevocationList
+	revoked  map[string]bool
+	modTime  time.Time
+	verified atomic.Bool
+}
+
+func (m *AuthMTLSModule) Kind() string {
+	return KIND_AUTHMTLS
+}
+
+func (m *AuthMTLSModule) Name() string {
+	return m.Metadata.Name
+}
+
+func (m *AuthMTLSModule) Start(_ context.Context) error {
+	if m.CRLFile == "" {
+		return nil
+	}
+	crl, err := loadCRL(m.CRLFile)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.crlMu.Lock()
+	if m.stopCRL != nil {
+		m.stopCRL()
+	}
+	m.crl = crl
+	m.stopCRL = cancel
+	m.crlMu.Unlock()
+	go m.watchCRL(ctx)
+	return nil
+}
+
+func (m *AuthMTLSModule) Health(_ context.Context) error {
+	crl := m.loadedCRL()
+	if crl == nil {
+		return nil
+	}
+	if next := crl.list.NextUpdate; !next.IsZero() && time.Now().After(next) {
+		return fmt.Errorf("crl %s expired at %s", m.CRLFile, next.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (m *AuthMTLSModule) Stop(_ context.Context) error {
+	m.crlMu.Lock()
+	defer m.crlMu.Unlock()
+	if m.stopCRL != nil {
+		m.stopCRL()
+		m.stopCRL = nil
+	}
+	m.crl = nil
+	return nil
+}
+
+// ValidateChain reports configurations under which the module cannot work: no
+// listener verifies client certificates, or session.* mappings without a
+// Session module ahead of the module, which would silently be dropped.
+func (m *AuthMTLSModule) ValidateChain(chain module.ChainInfo) []error {
+	var errs []error
+	if !chain.ClientCertificates {
+		errs = append(errs, fmt.Errorf("%s/%s: no listener of the proxy has client_auth", m.Kind(), m.Name()))
+	}
+	idx := max(slices.Index(chain.Modules, module.Module(m)), 0)
+	hasSession := slices.ContainsFunc(chain.Modules[:idx], func(mod module.Module) bool { return mod.Kind() == KIND_SESSION })
+	for _, target := range slices.Sorted(maps.Keys(m.Mappings)) {
+		if strings.HasPrefix(target, "session.") && !hasSession {
+			errs = append(errs, fmt.Errorf("%s/%s: mapping %s requires a Session module earlier in the chain", m.Kind(), m.Name(), target))
+		}
+	}
+	return errs
+}
+
+func (m *AuthMTLSModule) Skip(next module.ProxyHandlerFunc, w http.ResponseWriter, r *http.Request, st *state.State) bool {
+	if m.When != nil {
+		src := mapper.BuildSourceMap(st.Session, r, nil)
+		exec, err := mapper.EvalCondition(*m.When, src)
+		if err != nil {
+			http.Error(w, "could not eval step condition", http.StatusBadGateway)
+			return true
+		}
+		if !exec {
+			slog.Info("AuthMTLSModule skipped", "request_id", st.RequestID)
+			next(w, r, st)
+			return true
+		}
+	}
+	return false
+}
+
+func (m *AuthMTLSModule) ProxyMiddleware(next module.ProxyHandlerFunc) module.ProxyHandlerFunc {
+	return module.ProxyHandlerFunc(func(w http.ResponseWriter, r *http.Request, st *state.State) {
+		if r == nil || st == nil {
+			next(w, r, st)
+			return
+		}
+		if m.IdentityHeader != "" {
+			r.Header.Del(m.IdentityHeader)
+		}
+		if m.Skip(next, w, r, st) {
+			return
+		}
+
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			mtlsAuthenticationsTotal.Inc(m.Metadata.Name, "missing_certificate")
+			slog.Info("AuthMTLSModule rejected request without verified client certificate", "request_id", st.RequestID)
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		chain := r.TLS.VerifiedChains[0]
+		if err := m.checkRevocation(chain); err != nil {
+			reason := "revoked"
+			if !errors.Is(err, errCertificateRevoked) {
+				reason = "crl_invalid"
+			}
+			mtlsAuthenticationsTotal.Inc(m.Metadata.Name, reason)
+			slog.Warn("AuthMTLSModule rejected client certificate", "request_id", st.RequestID, "subject", chain[0].Subject.String(), "serial", chain[0].SerialNumber.String(), "error", err)
+			http.Error(w, "client certificate rejected", http.StatusForbidden)
+			return
+		}
+
+		fields := certificateFields(chain[0])
+		st.Set(state.ClientCertificateKey, fields)
+		if err := m.applyMappings(r, st, fields); err != nil {
+			mtlsAuthenticationsTotal.Inc(m.Metadata.Name, "mapping_failed")
+			slog.Error("AuthMTLSModule could not map client certificate", "request_id", st.RequestID, "error", err)
+			http.Error(w, "could not map client certificate", http.StatusBadGateway)
+			return
+		}
+
+		mtlsAuthenticationsTotal.Inc(m.Metadata.Name, "authenticated")
+		slog.Info("AuthMTLSModule authenticated", "request_id", st.RequestID, "subject", chain[0].Subject.String())
+		next(w, r, st)
+	})
+}
+
+func (m *AuthMTLSModule) applyMappings(r *http.Request, st *state.State, fields map[string]any) error {
+	src := mapper.BuildSourceMap(st.Session, r, nil)
+	src["certificate"] = fields
+
+	dst := map[string]any{}
+	if err := mapper.Apply(dst, src, m.Mappings); err != nil {
+		return err
+	}
+	if err := mapper.ApplyToTargets(dst, st.Session, r, nil); err != nil {
+		return err
+	}
+	if stDst, ok := dst["state"].(map[string]any); ok {
+		for k, v := range stDst {
+			st.Set(k, v)
+		}
+	}
+
+	if m.IdentityHeader == "" {
+		return nil
+	}
+	expr := m.IdentityValue
+	if expr == "" {
+		expr = mtlsDefaultIdentityVal
+	}
+	identity := map[string]any{}
+	if err := mapper.Apply(identity, src, map[string]string{"value": expr}); err != nil {
+		return err
+	}
+	if v, ok := identity["value"]; ok && v != nil {
+		r.Header.Set(m.IdentityHeader, sanitizeHeaderValue(fmt.Sprint(v)))
+	}
+	return nil
+}
+
+// checkRevocation rejects the leaf certificate when the CRL of its issuer lists
+// it. Certificates of other issuers are not covered by the CRL. A configured CRL
+// that is not loaded rejects every certificate.
+func (m *AuthMTLSModule) checkRevocation(chain []*x509.Certificate) error {
+	if m.CRLFile == "" {
+		return nil
+	}
+	crl := m.loadedCRL()
+	if crl == nil {
+		return errCRLUnavailable
+	}
+	leaf := chain[0]
+	if !bytes.Equal(crl.list.RawIssuer, leaf.RawIssuer) {
+		return nil
+	}
+	if !crl.verified.Load() {
+		issuer := chain[0]
+		if len(chain) > 1 {
+			issuer = chain[1]
+		}
+		if err := crl.list.CheckSignatureFrom(issuer); err != nil {
+			return fmt.Errorf("%w: %v", errCRLSignature, err)
+		}
+		crl.verified.Store(true)
+	}
+	if crl.revoked[leaf.SerialNumber.String()] {
+		return errCertificateRevoked
+	}
+	return nil
+}
+
+func (m *AuthMTLSModule) loadedCRL() *loadedCRL {
+	m.crlMu.RLock()
+	defer m.crlMu.RUnlock()
+	return m.crl
+}
+
+// watchCRL reloads the CRL when the file changes. A CRL that fails to load is
+// logged and the previous one stays in effect.
+func (m *AuthMTLSModule) watchCRL(ctx context.Context) {
+	ticker := time.NewTicker(mtlsCRLReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := m.loadedCRL()
+			fi, err := os.Stat(m.CRLFile)
+			if err != nil {
+				slog.Error("AuthMTLSModule could not stat crl", "module_name", m.Metadata.Name, "error", err)
+				continue
+			}
+			if current != nil && fi.ModTime().Equal(current.modTime) {
+				continue
+			}
+			crl, err := loadCRL(m.CRLFile)
+			if err != nil {
+				slog.Error("AuthMTLSModule crl reload failed, keeping the loaded crl", "module_name", m.Metadata.Name, "error", err)
+				continue
+			}
+			m.crlMu.Lock()
+			m.crl = crl
+			m.crlMu.Unlock()
+			slog.Info("AuthMTLSModule crl reloaded", "module_name", m.Metadata.Name, "revoked", len(crl.revoked))
+		}
+	}
+}
+
+// loadCRL reads a DER or PEM encoded certificate revocation list.
+func loadCRL(path string) (*loadedCRL, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("read crl: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read crl: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse crl %s: %w", path, err)
+	}
+	revoked := make(map[string]bool, len(list.RevokedCertificateEntries))
+	for _, e := range list.RevokedCertificateEntries {
+		revoked[e.SerialNumber.String()] = true
+	}
+	return &loadedCRL{list: list, revoked: revoked, modTime: fi.ModTime()}, nil
+}
+
+func certificateFields(cert *x509.Certificate) map[string]any {
+	sum := sha256.Sum256(cert.Raw)
+	uris := make([]string, 0, len(cert.URIs))
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	return map[string]any{
+		"subject":            nameFields(cert.Subject),
+		"issuer":             nameFields(cert.Issuer),
+		"serial":             cert.SerialNumber.String(),
+		"fingerprint_sha256": hex.EncodeToString(sum[:]),
+		"dns_names":          cert.DNSNames,
+		"email_addresses":    cert.EmailAddresses,
+		"uris":               uris,
+		"ip_addresses":       ips,
+		"not_before":         cert.NotBefore.UTC().Format(time.RFC3339),
+		"not_after":          cert.NotAfter.UTC().Format(time.RFC3339),
+	}
+}
+
+func nameFields(n pkix.Name) map[string]any {
+	return map[string]any{
+		"dn":                  n.String(),
+		"common_name":         n.CommonName,
+		"serial_number":       n.SerialNumber,
+		"organization":        n.Organization,
+		"organizational_unit": n.OrganizationalUnit,
+		"country":             n.Country,
+		"locality":            n.Locality,
+		"province":            n.Province,
+	}
+}
+
+// sanitizeHeaderValue percent-encodes control characters, non-ASCII bytes and
+// the percent sign so the value can be forwarded verbatim in a header.
+func sanitizeHeaderValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < 0x20 || c >= 0x7f || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,234 @@
+package modules_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/modules"
+	"github.com/axent-pl/axproxy/state"
+)
+
+// testCA issues client certificates and revocation lists.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, subject pkix.Name) []*x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		DNSNames:     []string{"client.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return []*x509.Certificate{cert, ca.cert}
+}
+
+// writeCRL writes a PEM revocation list of ca revoking serials and returns its path.
+func (ca *testCA) writeCRL(t *testing.T, serials ...int64) string {
+	t.Helper()
+	tmpl := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now().Add(-time.Minute), NextUpdate: time.Now().Add(time.Hour)}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("create crl: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write crl: %v", err)
+	}
+	return path
+}
+
+// serveMTLS passes a request with the verified chain, if any, through the
+// module and returns the response with the request and state seen upstream.
+func serveMTLS(m *modules.AuthMTLSModule, chain []*x509.Certificate, st *state.State, header http.Header) (*httptest.ResponseRecorder, *http.Request) {
+	r := httptest.NewRequest(http.MethodGet, "https://app.example.test/", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if chain != nil {
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{chain}}
+	}
+	var upstream *http.Request
+	rec := httptest.NewRecorder()
+	m.ProxyMiddleware(func(w http.ResponseWriter, r *http.Request, st *state.State) {
+		upstream = r
+	})(rec, r, st)
+	return rec, upstream
+}
+
+func TestAuthMTLSRequiresVerifiedCertificate(t *testing.T) {
+	m := &modules.AuthMTLSModule{Metadata: manifest.ObjectMeta{Name: "mtls"}}
+	for name, r := range map[string]*tls.ConnectionState{"plain": nil, "unverified": {}} {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.test/", nil)
+		req.TLS = r
+		rec := httptest.NewRecorder()
+		m.ProxyMiddleware(func(w http.ResponseWriter, r *http.Request, st *state.State) {
+			t.Fatalf("%s: expected request to be rejected", name)
+		})(rec, req, state.NewState())
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %d", name, rec.Code)
+		}
+	}
+}
+
+func TestAuthMTLSRevocation(t *testing.T) {
+	ca := newTestCA(t, "Client CA")
+	other := newTestCA(t, "Other CA")
+	m := &modules.AuthMTLSModule{Metadata: manifest.ObjectMeta{Name: "mtls"}, CRLFile: ca.writeCRL(t, 2)}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Stop(context.Background()) })
+
+	cases := []struct {
+		name  string
+		chain []*x509.Certificate
+		want  int
+	}{
+		{"valid", ca.issue(t, 1, pkix.Name{CommonName: "alice"}), http.StatusOK},
+		{"revoked", ca.issue(t, 2, pkix.Name{CommonName: "bob"}), http.StatusForbidden},
+		{"other issuer", other.issue(t, 2, pkix.Name{CommonName: "carol"}), http.StatusOK},
+	}
+	for _, tc := range cases {
+		if rec, _ := serveMTLS(m, tc.chain, state.NewState(), nil); rec.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+	}
+
+	// a CRL named after the issuer but signed by another key is rejected
+	forged := &testCA{cert: ca.cert, key: other.key}
+	m = &modules.AuthMTLSModule{Metadata: manifest.ObjectMeta{Name: "mtls"}, CRLFile: forged.writeCRL(t)}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Stop(context.Background()) })
+	if rec, _ := serveMTLS(m, ca.issue(t, 3, pkix.Name{CommonName: "dave"}), state.NewState(), nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected CRL with a foreign signature to reject the certificate, got %d", rec.Code)
+	}
+}
+
+func TestAuthMTLSMappingsAndIdentityHeader(t *testing.T) {
+	ca := newTestCA(t, "Client CA")
+	m := &modules.AuthMTLSModule{
+		Metadata: manifest.ObjectMeta{Name: "mtls"},
+		Mappings: map[string]string{
+			"state.client_cn":     "${certificate.subject.common_name}",
+			"session.client_dns":  "${certificate.dns_names[0]}",
+			"session.client_org":  "${certificate.subject.organization[0]}",
+			"state.client_issuer": "${certificate.issuer.common_name}",
+		},
+		IdentityHeader: "X-Client-Identity",
+		IdentityValue:  "${certificate.subject.common_name}",
+	}
+	chain := ca.issue(t, 1, pkix.Name{CommonName: "Zoë 100%", Organization: []string{"Example"}})
+	st := state.NewState()
+	st.Session = state.NewSession("sess", 0)
+
+	rec, upstream := serveMTLS(m, chain, st, http.Header{"X-Client-Identity": {"forged"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	if got := upstream.Header.Values("X-Client-Identity"); len(got) != 1 || got[0] != "Zo%C3%AB 100%25" {
+		t.Fatalf("expected sanitized identity header, got %q", got)
+	}
+	if cn, _ := st.Get("client_cn"); cn != "Zoë 100%" {
+		t.Fatalf("expected common name in state, got %v", cn)
+	}
+	if issuer, _ := st.Get("client_issuer"); issuer != "Client CA" {
+		t.Fatalf("expected issuer in state, got %v", issuer)
+	}
+	if dns, _ := st.Session.GetValue("client_dns"); dns != "client.example.test" {
+		t.Fatalf("expected DNS name in session, got %v", dns)
+	}
+	if org, _ := st.Session.GetValue("client_org"); org != "Example" {
+		t.Fatalf("expected organization in session, got %v", org)
+	}
+	if _, ok := st.Get(state.ClientCertificateKey); !ok {
+		t.Fatalf("expected certificate fields in state")
+	}
+
+	// the identity header of rejected requests is stripped before they fail
+	r := httptest.NewRequest(http.MethodGet, "https://app.example.test/", nil)
+	r.Header.Set("X-Client-Identity", "forged")
+	m.ProxyMiddleware(func(http.ResponseWriter, *http.Request, *state.State) {})(httptest.NewRecorder(), r, state.NewState())
+	if got := r.Header.Get("X-Client-Identity"); got != "" {
+		t.Fatalf("expected forged identity header to be stripped, got %q", got)
+	}
+}
+
+func TestAuthMTLSValidateChain(t *testing.T) {
+	m := &modules.AuthMTLSModule{
+		Metadata: manifest.ObjectMeta{Name: "mtls"},
+		Mappings: map[string]string{"session.client": "${certificate.subject.dn}", "state.client": "${certificate.subject.dn}"},
+	}
+	session := &modules.SessionModule{Metadata: manifest.ObjectMeta{Name: "session"}}
+
+	errs := m.ValidateChain(module.ChainInfo{Modules: []module.Module{m, session}})
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "client_auth") || !strings.Contains(errs[1].Error(), "session.client") {
+		t.Fatalf("expected missing client_auth and session mapping to be reported, got %v", errs)
+	}
+	if errs := m.ValidateChain(module.ChainInfo{Modules: []module.Module{session, m}, ClientCertificates: true}); len(errs) != 0 {
+		t.Fatalf("expected valid chain, got %v", errs)
+	}
+}
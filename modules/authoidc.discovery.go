@@ -0,0 +1,180 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	xjwt "github.com/axent-pl/credentials/jwt"
+)
+
+const (
+	oidcDiscoveryPath            = "/.well-known/openid-configuration"
+	oidcDiscoveryRefreshInterval = time.Hour
+	oidcDiscoveryRetryInterval   = 30 * time.Second
+	oidcDiscoveryTimeout         = 10 * time.Second
+)
+
+var errProviderUnavailable = errors.New("oidc provider endpoints not available")
+
+// oidcProvider holds the endpoints the module talks to, either configured or
+// read from the discovery document.
+type oidcProvider struct {
+	AuthorizeURL  string
+	TokenURL      string
+	JWKSURL       string
+	UserinfoURL   string
+	EndSessionURL string
+}
+
+// oidcProviderMetadata is the part of the OpenID Provider Metadata used by the
+// module.
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+func (m *AuthOIDCModule) configuredProvider() oidcProvider {
+	return oidcProvider{
+		AuthorizeURL:  m.AuthorizeURL,
+		TokenURL:      m.TokenURL,
+		JWKSURL:       m.JWKSURL,
+		UserinfoURL:   m.UserinfoURL,
+		EndSessionURL: m.EndSessionURL,
+	}
+}
+
+func (m *AuthOIDCModule) currentProvider() *oidcProvider {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.provider
+}
+
+func (m *AuthOIDCModule) jwks() *xjwt.JWKSJWTScheme {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.jwksScheme
+}
+
+// setProvider makes p the current endpoints. The JWKS is only fetched anew
+// when its URL changed.
+func (m *AuthOIDCModule) setProvider(p oidcProvider) error {
+	jwksURL, err := url.Parse(p.JWKSURL)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS URL: %v", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jwksScheme == nil || m.provider == nil || m.provider.JWKSURL != p.JWKSURL {
+		scheme := &xjwt.JWKSJWTScheme{JWKSURL: *jwksURL}
+		scheme.Start(context.Background())
+		if m.jwksScheme != nil {
+			m.jwksScheme.Close()
+		}
+		m.jwksScheme = scheme
+	}
+	m.provider = &p
+	return nil
+}
+
+// discover fetches the discovery document of the issuer and fills the
+// endpoints that are not configured explicitly, e.g. an authorize_url reachable
+// by browsers when the issuer is an internal address.
+func (m *AuthOIDCModule) discover(ctx context.Context) error {
+	md, err := m.fetchProviderMetadata(ctx)
+	if err != nil {
+		oidcDiscoveryFailuresTotal.Inc(m.Metadata.Name)
+		return err
+	}
+	p := m.configuredProvider()
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&p.AuthorizeURL, md.AuthorizationEndpoint},
+		{&p.TokenURL, md.TokenEndpoint},
+		{&p.JWKSURL, md.JWKSURI},
+		{&p.UserinfoURL, md.UserinfoEndpoint},
+		{&p.EndSessionURL, md.EndSessionEndpoint},
+	} {
+		if *f.dst == "" {
+			*f.dst = f.src
+		}
+	}
+	if current := m.currentProvider(); current != nil && *current == p {
+		return nil
+	}
+	if err := m.setProvider(p); err != nil {
+		oidcDiscoveryFailuresTotal.Inc(m.Metadata.Name)
+		return err
+	}
+	slog.Info("AuthOIDCModule discovery document loaded", "module_name", m.Metadata.Name, "issuer", m.Issuer, "jwks_url", p.JWKSURL)
+	return nil
+}
+
+func (m *AuthOIDCModule) fetchProviderMetadata(ctx context.Context) (*oidcProviderMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(m.Issuer, "/")+oidcDiscoveryPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := m.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("could not close OIDC discovery response body", "error", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: status %s", resp.Status)
+	}
+	var md oidcProviderMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&md); err != nil {
+		return nil, fmt.Errorf("discovery: decode: %w", err)
+	}
+	if md.Issuer != m.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", md.Issuer, m.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery: authorization_endpoint, token_endpoint and jwks_uri are required")
+	}
+	return &md, nil
+}
+
+// refreshDiscovery reloads the discovery document every DiscoveryRefreshInterval
+// (1h when zero), sooner while none could be loaded. A document that fails to load is logged and the
+// previous endpoints stay in effect.
+func (m *AuthOIDCModule) refreshDiscovery(ctx context.Context) {
+	interval := m.DiscoveryRefreshInterval
+	if interval <= 0 {
+		interval = oidcDiscoveryRefreshInterval
+	}
+	for {
+		wait := interval
+		if m.currentProvider() == nil {
+			wait = oidcDiscoveryRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if err := m.discover(ctx); err != nil {
+			slog.Error("AuthOIDCModule discovery refresh failed, keeping the loaded endpoints", "module_name", m.Metadata.Name, "issuer", m.Issuer, "error", err)
+		}
+	}
+}
@@ -29,7 +29,7 @@ func (AuthOIDCHandler) Unmarshal(apiVersion string, rawYAML []byte) (module.Modu
 			return &AuthOIDCModule{}, err
 		}
 		obj.Spec.Metadata = obj.Metadata
-		if err := obj.Spec.Start(); err != nil {
+		if err := obj.Spec.validate(); err != nil {
 			return &AuthOIDCModule{}, err
 		}
 		return &obj.Spec, nil
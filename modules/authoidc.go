@@ -2,17 +2,20 @@ package modules
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/axent-pl/axproxy/manifest"
 	"github.com/axent-pl/axproxy/module"
 	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/tracing"
 	"github.com/axent-pl/axproxy/utils"
 	"github.com/axent-pl/axproxy/utils/mapper"
 	xjwt "github.com/axent-pl/credentials/jwt"
@@ -20,6 +23,9 @@ import (
 
 const KIND_AUTHOIDC string = "AuthOIDC"
 
+// AuthOIDCModule authenticates requests with the OpenID Connect authorization
+// code flow against Issuer, or explicitly configured endpoints, and keeps the
+// tokens in the session. It serves the login, callback and logout routes.
 type AuthOIDCModule struct {
 	module.NoopModule
 	Metadata manifest.ObjectMeta `yaml:"metadata"`
@@ -28,19 +34,36 @@ type AuthOIDCModule struct {
 	SessionSubjectIDKey string `yaml:"session_subject_id_key"`
 	SessionClaimsKey    string `yaml:"session_claims_key"`
 
-	Scope        string `yaml:"scope"`
-	ClientId     string `yaml:"client_id"`
-	ClientSecret string `yaml:"client_secret"`
-	TokenURL     string `yaml:"token_url"`
-	AuthorizeURL string `yaml:"authorize_url"`
-	JWKSURL      string `yaml:"jwks_url"`
+	Issuer                   string        `yaml:"issuer"`
+	DiscoveryRefreshInterval time.Duration `yaml:"discovery_refresh_interval"`
+	LoginTimeout             time.Duration `yaml:"login_timeout"`
+	RefreshBefore            time.Duration `yaml:"refresh_before"`
+	MaxSessionAge            time.Duration `yaml:"max_session_age"`
+
+	Scope         string `yaml:"scope"`
+	ClientId      string `yaml:"client_id"`
+	ClientSecret  string `yaml:"client_secret"`
+	PublicClient  bool   `yaml:"public_client"`
+	DisablePKCE   bool   `yaml:"disable_pkce"`
+	TokenURL      string `yaml:"token_url"`
+	AuthorizeURL  string `yaml:"authorize_url"`
+	JWKSURL       string `yaml:"jwks_url"`
+	UserinfoURL   string `yaml:"userinfo_url"`
+	EndSessionURL string `yaml:"end_session_url"`
+
+	PostLogoutRedirectURL string `yaml:"post_logout_redirect_url"`
 
 	ProxyAddress string `yaml:"proxy_addr"`
 	ProxyUser    string `yaml:"proxy_user"`
 	ProxyPass    string `yaml:"proxy_pass"`
 
-	jwksScheme  xjwt.JWKSJWTScheme `yaml:"-"`
-	jwtVerifier xjwt.JWTVerifier   `yaml:"-"`
+	mu            sync.RWMutex        `yaml:"-"`
+	provider      *oidcProvider       `yaml:"-"`
+	jwksScheme    *xjwt.JWKSJWTScheme `yaml:"-"`
+	stopDiscovery context.CancelFunc  `yaml:"-"`
+	attemptsMu    sync.Mutex          `yaml:"-"`
+	jwtVerifier   xjwt.JWTVerifier    `yaml:"-"`
+	sessions      *oidcSessionIndex   `yaml:"-"`
 }
 
 func (m *AuthOIDCModule) Kind() string {
@@ -51,26 +74,87 @@ func (m *AuthOIDCModule) Name() string {
 	return m.Metadata.Name
 }
 
-func (m *AuthOIDCModule) Start() error {
-	jwksURL, err := url.Parse(m.JWKSURL)
-	if err != nil {
-		slog.Error("invalid JWKS URL", "error", err)
-		return fmt.Errorf("invalid JWKS URL: %v", err)
+// validate checks the client and provider settings when the manifest is
+// decoded.
+func (m *AuthOIDCModule) validate() error {
+	if m.PublicClient && m.DisablePKCE {
+		return fmt.Errorf("public_client requires pkce")
+	}
+	if !m.PublicClient && m.ClientSecret == "" {
+		return fmt.Errorf("client_secret is required unless public_client is set")
 	}
-	m.jwksScheme = xjwt.JWKSJWTScheme{
-		JWKSURL: *jwksURL,
+	if m.Issuer == "" && (m.AuthorizeURL == "" || m.TokenURL == "" || m.JWKSURL == "") {
+		return fmt.Errorf("authorize_url, token_url and jwks_url are required without issuer")
 	}
-	m.jwksScheme.Start(context.Background())
+	return nil
+}
+
+func (m *AuthOIDCModule) Start(_ context.Context) error {
 	m.jwtVerifier = xjwt.JWTVerifier{}
+	m.mu.Lock()
+	if m.sessions == nil {
+		m.sessions = acquireOIDCSessionIndex(m.Metadata.Name)
+	}
+	m.mu.Unlock()
+	if m.Issuer == "" {
+		return m.setProvider(m.configuredProvider())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	if m.stopDiscovery != nil {
+		m.stopDiscovery()
+	}
+	m.stopDiscovery = cancel
+	m.mu.Unlock()
+	if err := m.discover(ctx); err != nil {
+		slog.Error("AuthOIDCModule discovery failed, retrying", "module_name", m.Metadata.Name, "issuer", m.Issuer, "error", err)
+	}
+	go m.refreshDiscovery(ctx)
+	return nil
+}
+
+func (m *AuthOIDCModule) Health(_ context.Context) error {
+	p := m.currentProvider()
+	if p == nil {
+		return fmt.Errorf("discovery document not available from %s", m.Issuer)
+	}
+	if len(m.jwks().GetKeys()) == 0 {
+		return fmt.Errorf("JWKS not available from %s", p.JWKSURL)
+	}
+	return nil
+}
+
+func (m *AuthOIDCModule) Stop(_ context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopDiscovery != nil {
+		m.stopDiscovery()
+		m.stopDiscovery = nil
+	}
+	if m.jwksScheme != nil {
+		m.jwksScheme.Close()
+		m.jwksScheme = nil
+	}
+	m.provider = nil
+	if m.sessions != nil {
+		releaseOIDCSessionIndex(m.Metadata.Name)
+		m.sessions = nil
+	}
 	return nil
 }
 
 func (m *AuthOIDCModule) SpecialRoutes() map[string]http.HandlerFunc {
 
-	return map[string]http.HandlerFunc{
-		"/oidc-callback": m.getCallbackHandler(),
-		"/oidc-login":    m.getLoginHandler(),
+	routes := map[string]http.HandlerFunc{
+		"/oidc-callback":           m.getCallbackHandler(),
+		"/oidc-login":              m.getLoginHandler(),
+		"/oidc-logout":             m.getLogoutHandler(),
+		"/oidc-backchannel-logout": m.getBackChannelLogoutHandler(),
+	}
+	if m.Issuer != "" {
+		routes["/oidc-frontchannel-logout"] = m.getFrontChannelLogoutHandler()
 	}
+	return routes
 }
 
 func (m *AuthOIDCModule) Skip(next module.ProxyHandlerFunc, w http.ResponseWriter, r *http.Request, st *state.State) bool {
@@ -101,18 +185,30 @@ func (m *AuthOIDCModule) ProxyMiddleware(next module.ProxyHandlerFunc) module.Pr
 		}
 		sess := st.Session
 		subjectID, err := m.readSubjectID(sess)
+		if err == nil {
+			if err = m.ensureFreshTokens(r.Context(), sess, subjectID); err != nil {
+				slog.Info("AuthOIDCModule session needs authentication again", "request_id", st.RequestID, "error", err)
+				m.clearPrincipal(sess)
+			}
+		}
+		if err != nil && (module.IsUpgrade(r) || utils.IsGRPC(r)) {
+			slog.Info("AuthOIDCModule rejected unauthenticated request", "request_id", st.RequestID, "upgrade", module.IsUpgrade(r), "grpc", utils.IsGRPC(r))
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
 		if err != nil {
 			scheme := utils.RequestScheme(r)
-			currentURL := scheme + "://" + r.Host + r.URL.RequestURI()
+			currentURL := scheme + "://" + utils.RequestHost(r) + r.URL.RequestURI()
 			loginURL := &url.URL{
 				Scheme: utils.RequestScheme(r),
-				Host:   r.Host,
+				Host:   utils.RequestHost(r),
 				Path:   "/_/oidc-login",
 			}
 			q := loginURL.Query()
 			q.Set("entrypoint_url", currentURL)
 			loginURL.RawQuery = q.Encode()
 			http.Redirect(w, r, loginURL.String(), http.StatusFound)
+			oidcRedirectsTotal.Inc(m.Metadata.Name)
 			slog.Info("AuthOIDCModule redirecting to oidc-login", "request_id", st.RequestID)
 			return
 		}
@@ -121,12 +217,22 @@ func (m *AuthOIDCModule) ProxyMiddleware(next module.ProxyHandlerFunc) module.Pr
 	})
 }
 
-func (m *AuthOIDCModule) readSubjectID(session *state.Session) (subjectID string, err error) {
-	key := m.SessionSubjectIDKey
-	if key == "" {
-		key = "oidc_subject_id"
+func (m *AuthOIDCModule) subjectIDKey() string {
+	if m.SessionSubjectIDKey != "" {
+		return m.SessionSubjectIDKey
 	}
+	return "oidc_subject_id"
+}
+
+func (m *AuthOIDCModule) claimsKey() string {
+	if m.SessionClaimsKey != "" {
+		return m.SessionClaimsKey
+	}
+	return "oidc_claims"
+}
 
+func (m *AuthOIDCModule) readSubjectID(session *state.Session) (subjectID string, err error) {
+	key := m.subjectIDKey()
 	sub, err := session.GetValue(key)
 	if err != nil {
 		return "", fmt.Errorf("could not read subject_id from session (key:%s): %v", key, err)
@@ -140,16 +246,8 @@ func (m *AuthOIDCModule) readSubjectID(session *state.Session) (subjectID string
 }
 
 func (m *AuthOIDCModule) storePrincipal(session *state.Session, subjectID string, claims map[string]any) {
-	if m.SessionSubjectIDKey != "" {
-		session.SetValue(m.SessionSubjectIDKey, subjectID)
-	} else {
-		session.SetValue("oidc_subject_id", subjectID)
-	}
-	if m.SessionClaimsKey != "" {
-		session.SetValue(m.SessionClaimsKey, claims)
-	} else {
-		session.SetValue("oidc_claims", claims)
-	}
+	session.SetValue(m.subjectIDKey(), subjectID)
+	session.SetValue(m.claimsKey(), claims)
 }
 
 func (m *AuthOIDCModule) httpClient() *http.Client {
@@ -174,13 +272,50 @@ func (m *AuthOIDCModule) httpClient() *http.Client {
 	}
 }
 
+// requestToken posts the token request in a client span and propagates the
+// trace context to the authorization server.
+func (m *AuthOIDCModule) requestToken(ctx context.Context, form url.Values) (*http.Response, error) {
+	ctx, span := tracing.Start(ctx, "oidc.token_exchange", tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("axproxy.module.name", m.Metadata.Name)
+	p := m.currentProvider()
+	if p == nil {
+		err := errProviderUnavailable
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("url.full", p.TokenURL)
+	span.SetAttribute("oauth.grant_type", form.Get("grant_type"))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tracing.InjectContext(ctx, req.Header)
+	resp, err := m.httpClient().Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		span.RecordError(fmt.Errorf("status %s", resp.Status))
+	}
+	return resp, nil
+}
+
 // special handlers
 
+// getLoginHandler starts a login with an RFC 7636 S256 code challenge.
+// PublicClient sends no client_secret and requires PKCE; DisablePKCE is only
+// meant for providers that reject the challenge parameters.
 func (m *AuthOIDCModule) getLoginHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		callbackURL := &url.URL{
 			Scheme: utils.RequestScheme(r),
-			Host:   r.Host,
+			Host:   utils.RequestHost(r),
 			Path:   "/_/oidc-callback",
 		}
 
@@ -202,12 +337,24 @@ func (m *AuthOIDCModule) getLoginHandler() http.HandlerFunc {
 			return
 		}
 
+		attempt := oidcLoginAttempt{Nonce: oidcNonce, Entrypoint: entrypoint, ExpiresAt: time.Now().Add(m.loginTimeout())}
+		if !m.DisablePKCE {
+			if attempt.CodeVerifier, err = utils.RandomURLSafe(32); err != nil {
+				http.Error(w, "could not connect to authorization server", http.StatusInternalServerError)
+				return
+			}
+		}
+
 		st := state.GetState(r.Context())
 		sess := st.Session
-		sess.SetValue("state", oidcState)
-		sess.SetValue("nonce", oidcNonce)
 
-		authURL, err := url.Parse(m.AuthorizeURL)
+		p := m.currentProvider()
+		if p == nil {
+			slog.Error("AuthOIDCModule login failed", "request_id", st.RequestID, "error", errProviderUnavailable)
+			http.Error(w, "authorization server unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		authURL, err := url.Parse(p.AuthorizeURL)
 		if err != nil {
 			http.Error(w, "could not connect to authorization server", http.StatusInternalServerError)
 			return
@@ -219,101 +366,101 @@ func (m *AuthOIDCModule) getLoginHandler() http.HandlerFunc {
 		q.Set("scope", m.Scope)
 		q.Set("state", oidcState)
 		q.Set("nonce", oidcNonce)
+		if attempt.CodeVerifier != "" {
+			q.Set("code_challenge", pkceChallenge(attempt.CodeVerifier))
+			q.Set("code_challenge_method", "S256")
+		}
 		authURL.RawQuery = q.Encode()
+		m.saveLoginAttempt(sess, oidcState, attempt)
 		http.Redirect(w, r, authURL.String(), http.StatusFound)
-		slog.Info("AuthOIDCModule redirecting to authorization server", "request_id", st.RequestID, "authorize_url", m.AuthorizeURL)
+		slog.Info("AuthOIDCModule redirecting to authorization server", "request_id", st.RequestID, "authorize_url", p.AuthorizeURL)
 	})
 }
 
+// getCallbackHandler requires the state of a pending login and authenticates the
+// subject of the ID token once its signature, iss, aud, azp, exp, iat and nonce
+// are verified.
 func (m *AuthOIDCModule) getCallbackHandler() http.HandlerFunc {
-	type tokenResponeStruct struct {
-		TokenType          string `json:"token_type"`
-		ExpiresInSeconds   int    `json:"expires_in"`
-		AccessTokenEncoded string `json:"access_token"`
-	}
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authorization_code := r.URL.Query().Get("code")
+		st := state.GetState(r.Context())
+		sess := st.Session
+		query := r.URL.Query()
+
+		attempt, ok := m.takeLoginAttempt(sess, query.Get("state"))
+		if !ok {
+			slog.Error("unknown or expired OIDC state", "request_id", st.RequestID)
+			oidcCallbackFailuresTotal.Inc(m.Metadata.Name, "state_mismatch")
+			http.Error(w, "invalid state", http.StatusUnauthorized)
+			return
+		}
+		if providerError := query.Get("error"); providerError != "" {
+			slog.Error("authorization server returned an error", "request_id", st.RequestID, "error", providerError, "error_description", query.Get("error_description"))
+			oidcCallbackFailuresTotal.Inc(m.Metadata.Name, "provider_error")
+			http.Error(w, "authorization failed", http.StatusUnauthorized)
+			return
+		}
+		authorization_code := query.Get("code")
 		if authorization_code == "" {
-			slog.Error("missing authorization code")
+			slog.Error("missing authorization code", "request_id", st.RequestID)
+			oidcCallbackFailuresTotal.Inc(m.Metadata.Name, "missing_code")
 			http.Error(w, "missing authorization code", http.StatusUnauthorized)
 			return
 		}
-		st := state.GetState(r.Context())
-		sess := st.Session
 
 		callbackURL := &url.URL{
 			Scheme: utils.RequestScheme(r),
-			Host:   r.Host,
+			Host:   utils.RequestHost(r),
 			Path:   "/_/oidc-callback",
 		}
-		entrypoint := r.URL.Query().Get("entrypoint_url")
-		if entrypoint != "" {
+		if attempt.Entrypoint != "" {
 			q := callbackURL.Query()
-			q.Set("entrypoint_url", entrypoint)
+			q.Set("entrypoint_url", attempt.Entrypoint)
 			callbackURL.RawQuery = q.Encode()
 		}
 
 		form := url.Values{}
 		form.Add("grant_type", "authorization_code")
 		form.Add("code", authorization_code)
-		if oidc_state, err := sess.GetValue("oidc_state"); err == nil {
-			form.Add("state", oidc_state.(string))
-		}
 		form.Add("redirect_uri", callbackURL.String())
 		form.Add("client_id", m.ClientId)
-		form.Add("client_secret", m.ClientSecret)
-		tokenHTTPResponse, err := m.httpClient().Post(m.TokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
-		if err != nil {
-			slog.Error(fmt.Sprintf("could not request token: %v", err))
-			http.Error(w, "could not request token", http.StatusUnauthorized)
-			return
+		if !m.PublicClient {
+			form.Add("client_secret", m.ClientSecret)
 		}
-		defer func() {
-			err := tokenHTTPResponse.Body.Close()
-			if err != nil {
-				slog.Error("could not close OIDC token response body", "error", err)
-			}
-		}()
-		if tokenHTTPResponse.StatusCode != http.StatusOK {
-			slog.Error(fmt.Sprintf("could not request token: status %s", tokenHTTPResponse.Status))
-			http.Error(w, "could not request token", http.StatusUnauthorized)
-			return
+		if attempt.CodeVerifier != "" {
+			form.Add("code_verifier", attempt.CodeVerifier)
 		}
-		tokenHTTPResponseBody, err := io.ReadAll(tokenHTTPResponse.Body)
+		tokenResponse, err := m.exchangeToken(r.Context(), form)
 		if err != nil {
-			slog.Error(fmt.Sprintf("could not read request token response: %v", err))
-			http.Error(w, "could not request token", http.StatusUnauthorized)
-			return
-		}
-		tokenResponse := tokenResponeStruct{}
-		if err = json.Unmarshal(tokenHTTPResponseBody, &tokenResponse); err != nil {
-			slog.Error(fmt.Sprintf("could not unmarshal request token response: %v", err))
+			slog.Error("could not request token", "request_id", st.RequestID, "error", err)
+			oidcCallbackFailuresTotal.Inc(m.Metadata.Name, failureReason(err, "token_request"))
 			http.Error(w, "could not request token", http.StatusUnauthorized)
 			return
 		}
 
-		principal, err := m.jwtVerifier.Verify(r.Context(), xjwt.JWTCredentials{Token: tokenResponse.AccessTokenEncoded}, &m.jwksScheme)
+		principal, err := m.verifyIDToken(r.Context(), tokenResponse.IDToken, attempt.Nonce)
 		if err != nil {
-			slog.Error("token verification failed", "error", err)
+			reason := failureReason(err, "token_verification")
+			slog.Error("ID token verification failed", "request_id", st.RequestID, "reason", reason, "error", err)
+			oidcCallbackFailuresTotal.Inc(m.Metadata.Name, reason)
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if oidc_nonce, err := sess.GetValue("oidc_nonce"); err == nil {
-			if nonce, ok := principal.Attributes["nonce"].(string); !ok || nonce != oidc_nonce {
-				slog.Error(fmt.Sprintf("nonce does not match: wat %s, got %s", oidc_nonce, nonce))
-				http.Error(w, "could not request token", http.StatusUnauthorized)
-				return
-			}
-		}
-
 		m.storePrincipal(sess, string(principal.Subject), principal.Attributes)
+		sess.SetValue(oidcTokensKey, newOIDCTokens(tokenResponse, principal.Attributes, time.Now()))
+		m.trackSession(sess, principal.Attributes)
+		oidcLoginsTotal.Inc(m.Metadata.Name)
 
-		if entrypoint != "" {
-			http.Redirect(w, r, entrypoint, http.StatusFound)
+		if attempt.Entrypoint != "" {
+			http.Redirect(w, r, attempt.Entrypoint, http.StatusFound)
 		} else {
 			http.Redirect(w, r, "/", http.StatusFound)
 		}
 	})
 }
+
+// pkceChallenge returns the S256 code challenge of an RFC 7636 code verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,200 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/credentials/common"
+	xjwt "github.com/axent-pl/credentials/jwt"
+)
+
+const (
+	oidcLoginAttemptsKey    = "oidc_login_attempts"
+	oidcDefaultLoginTimeout = 10 * time.Minute
+	oidcMaxLoginAttempts    = 10
+	oidcIDTokenClockSkew    = time.Minute
+)
+
+// oidcLoginAttempt holds the one-time values of a login started by the login
+// route, keyed in the session by its state so concurrent logins of a session,
+// e.g. from several tabs, complete independently.
+type oidcLoginAttempt struct {
+	Nonce        string
+	CodeVerifier string
+	Entrypoint   string
+	ExpiresAt    time.Time
+}
+
+// oidcError is a failed token request or a rejected token; Reason labels the
+// failure metrics.
+type oidcError struct {
+	Reason string
+	Err    error
+}
+
+func (e *oidcError) Error() string { return e.Err.Error() }
+func (e *oidcError) Unwrap() error { return e.Err }
+
+// failureReason returns the metric label of err.
+func failureReason(err error, fallback string) string {
+	var oErr *oidcError
+	if errors.As(err, &oErr) {
+		return oErr.Reason
+	}
+	return fallback
+}
+
+// loginTimeout is how long a login keeps its state, nonce and code verifier in
+// the session, so a code is only redeemed by the session that requested it.
+func (m *AuthOIDCModule) loginTimeout() time.Duration {
+	if m.LoginTimeout > 0 {
+		return m.LoginTimeout
+	}
+	return oidcDefaultLoginTimeout
+}
+
+// saveLoginAttempt stores the attempt under its state. Expired attempts are
+// dropped and the oldest ones are evicted beyond oidcMaxLoginAttempts.
+func (m *AuthOIDCModule) saveLoginAttempt(sess *state.Session, oidcState string, attempt oidcLoginAttempt) {
+	m.attemptsMu.Lock()
+	defer m.attemptsMu.Unlock()
+	attempts := liveLoginAttempts(sess, time.Now())
+	attempts[oidcState] = attempt
+	if len(attempts) > oidcMaxLoginAttempts {
+		states := make([]string, 0, len(attempts))
+		for s := range attempts {
+			states = append(states, s)
+		}
+		sort.Slice(states, func(i, j int) bool { return attempts[states[i]].ExpiresAt.Before(attempts[states[j]].ExpiresAt) })
+		for _, s := range states[:len(states)-oidcMaxLoginAttempts] {
+			delete(attempts, s)
+		}
+	}
+	sess.SetValue(oidcLoginAttemptsKey, attempts)
+}
+
+// takeLoginAttempt removes the attempt of oidcState from the session and
+// returns it unless it is unknown or expired.
+func (m *AuthOIDCModule) takeLoginAttempt(sess *state.Session, oidcState string) (oidcLoginAttempt, bool) {
+	m.attemptsMu.Lock()
+	defer m.attemptsMu.Unlock()
+	attempts := liveLoginAttempts(sess, time.Now())
+	attempt, ok := attempts[oidcState]
+	delete(attempts, oidcState)
+	if len(attempts) == 0 {
+		sess.DeleteValue(oidcLoginAttemptsKey)
+	} else {
+		sess.SetValue(oidcLoginAttemptsKey, attempts)
+	}
+	return attempt, ok && oidcState != ""
+}
+
+// liveLoginAttempts returns a copy of the unexpired attempts of the session.
+func liveLoginAttempts(sess *state.Session, now time.Time) map[string]oidcLoginAttempt {
+	out := map[string]oidcLoginAttempt{}
+	v, _ := sess.GetValue(oidcLoginAttemptsKey)
+	stored, _ := v.(map[string]oidcLoginAttempt)
+	for s, a := range stored {
+		if now.Before(a.ExpiresAt) {
+			out[s] = a
+		}
+	}
+	return out
+}
+
+// verifyIDToken checks the signature of the ID token against the provider keys
+// and its claims as required by OpenID Connect Core 3.1.3.7: iss, aud, azp,
+// exp, iat and the nonce of the login attempt. ID tokens of a refresh are
+// verified with an empty nonce, which skips the nonce check.
+func (m *AuthOIDCModule) verifyIDToken(ctx context.Context, raw string, nonce string) (common.Principal, error) {
+	if raw == "" {
+		return common.Principal{}, &oidcError{"missing_id_token", errors.New("token response has no id_token")}
+	}
+	principal, err := m.verifyProviderToken(ctx, raw)
+	if err != nil {
+		return common.Principal{}, err
+	}
+	claims := principal.Attributes
+
+	aud := audience(claims["aud"])
+	azp, hasAZP := claims["azp"].(string)
+	if (len(aud) > 1 || hasAZP) && azp != m.ClientId {
+		return common.Principal{}, &oidcError{"audience_mismatch", fmt.Errorf("azp %q does not match %q", azp, m.ClientId)}
+	}
+
+	now := time.Now()
+	exp, ok := numericDate(claims["exp"])
+	if !ok || !now.Before(exp.Add(oidcIDTokenClockSkew)) {
+		return common.Principal{}, &oidcError{"token_expired", errors.New("id_token is expired or has no exp")}
+	}
+	iat, ok := numericDate(claims["iat"])
+	if !ok || iat.After(now.Add(oidcIDTokenClockSkew)) {
+		return common.Principal{}, &oidcError{"invalid_iat", errors.New("id_token has no iat or is issued in the future")}
+	}
+
+	if got, _ := claims["nonce"].(string); nonce != "" && got != nonce {
+		return common.Principal{}, &oidcError{"nonce_mismatch", errors.New("nonce does not match the login attempt")}
+	}
+	return principal, nil
+}
+
+// verifyProviderToken checks the signature of a token against the provider
+// keys, its iss when Issuer is set and that its aud contains the client.
+func (m *AuthOIDCModule) verifyProviderToken(ctx context.Context, raw string) (common.Principal, error) {
+	jwks := m.jwks()
+	if jwks == nil {
+		return common.Principal{}, &oidcError{"token_verification", errProviderUnavailable}
+	}
+	principal, err := m.jwtVerifier.Verify(ctx, xjwt.JWTCredentials{Token: raw}, jwks)
+	if err != nil {
+		return common.Principal{}, &oidcError{"token_verification", err}
+	}
+	if err := m.checkProviderClaims(principal.Attributes); err != nil {
+		return common.Principal{}, err
+	}
+	return principal, nil
+}
+
+// checkProviderClaims checks the iss of a provider token when Issuer is set and
+// that its aud contains the client.
+func (m *AuthOIDCModule) checkProviderClaims(claims map[string]any) error {
+	if m.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != m.Issuer {
+			return &oidcError{"issuer_mismatch", fmt.Errorf("iss %q does not match %q", iss, m.Issuer)}
+		}
+	}
+	if aud := audience(claims["aud"]); !slices.Contains(aud, m.ClientId) {
+		return &oidcError{"audience_mismatch", fmt.Errorf("aud %v does not contain %q", aud, m.ClientId)}
+	}
+	return nil
+}
+
+// audience returns the aud claim, a string or an array of strings.
+func audience(v any) []string {
+	switch aud := v.(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		out := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func numericDate(v any) (time.Time, bool) {
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
@@ -0,0 +1,369 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/utils"
+	"github.com/axent-pl/credentials/common/sig"
+	jwtx "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcBackChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// oidcLogoutTokenMaxAge bounds the lifetime of logout tokens without exp.
+	oidcLogoutTokenMaxAge = 5 * time.Minute
+)
+
+// oidcSessionIndex holds the sessions authenticated by the module with the sub
+// and sid claims of their ID token, so logouts sent by the provider reach
+// sessions whose cookie they do not carry, and the jti of the logout tokens
+// received until they expire, so a token ends sessions only once.
+type oidcSessionIndex struct {
+	mu           sync.Mutex
+	sessions     map[*state.Session]oidcSessionKeys
+	logoutTokens map[string]time.Time
+	refs         int
+}
+
+// oidcSessionIndexes holds the session index of each module name. A reload
+// starts the replacement before stopping the old instance and keeps the
+// sessions, so the instances of a name share the index, which is dropped when
+// the last of them stops.
+var oidcSessionIndexes = struct {
+	sync.Mutex
+	names map[string]*oidcSessionIndex
+}{names: map[string]*oidcSessionIndex{}}
+
+func acquireOIDCSessionIndex(name string) *oidcSessionIndex {
+	oidcSessionIndexes.Lock()
+	defer oidcSessionIndexes.Unlock()
+	idx := oidcSessionIndexes.names[name]
+	if idx == nil {
+		idx = &oidcSessionIndex{}
+		oidcSessionIndexes.names[name] = idx
+	}
+	idx.refs++
+	return idx
+}
+
+func releaseOIDCSessionIndex(name string) {
+	oidcSessionIndexes.Lock()
+	defer oidcSessionIndexes.Unlock()
+	if idx := oidcSessionIndexes.names[name]; idx != nil {
+		if idx.refs--; idx.refs <= 0 {
+			delete(oidcSessionIndexes.names, name)
+		}
+	}
+}
+
+type oidcSessionKeys struct {
+	Sub string
+	SID string
+}
+
+// add tracks sess and drops the sessions that expired or were invalidated.
+func (idx *oidcSessionIndex) add(sess *state.Session, keys oidcSessionKeys) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.sessions == nil {
+		idx.sessions = map[*state.Session]oidcSessionKeys{}
+	}
+	for s := range idx.sessions {
+		if s.Invalidated() || s.IsExpired() {
+			delete(idx.sessions, s)
+		}
+	}
+	idx.sessions[sess] = keys
+}
+
+func (idx *oidcSessionIndex) remove(sess *state.Session) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.sessions, sess)
+}
+
+// seenLogoutToken records the jti of a logout token valid until expiresAt and
+// reports whether it was already recorded.
+func (idx *oidcSessionIndex) seenLogoutToken(jti string, expiresAt time.Time) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	now := time.Now()
+	if until, ok := idx.logoutTokens[jti]; ok && now.Before(until) {
+		return true
+	}
+	if idx.logoutTokens == nil {
+		idx.logoutTokens = map[string]time.Time{}
+	}
+	for id, until := range idx.logoutTokens {
+		if !now.Before(until) {
+			delete(idx.logoutTokens, id)
+		}
+	}
+	idx.logoutTokens[jti] = expiresAt
+	return false
+}
+
+// find returns the sessions of sid, or of sub when sid is empty. With both set
+// the session must match both.
+func (idx *oidcSessionIndex) find(sub, sid string) []*state.Session {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var out []*state.Session
+	for s, keys := range idx.sessions {
+		if sid != "" && keys.SID != sid {
+			continue
+		}
+		if sub != "" && keys.Sub != sub {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// sessionIndex returns the index acquired by Start, or an empty one when the
+// module is not started.
+func (m *AuthOIDCModule) sessionIndex() *oidcSessionIndex {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.sessions == nil {
+		return &oidcSessionIndex{}
+	}
+	return m.sessions
+}
+
+func (m *AuthOIDCModule) trackSession(sess *state.Session, claims map[string]any) {
+	sub, _ := claims["sub"].(string)
+	sid, _ := claims["sid"].(string)
+	m.sessionIndex().add(sess, oidcSessionKeys{Sub: sub, SID: sid})
+}
+
+// endSession removes the session from the index and invalidates it, which
+// makes the SessionModule delete it.
+func (m *AuthOIDCModule) endSession(sess *state.Session) {
+	m.sessionIndex().remove(sess)
+	sess.Invalidate()
+}
+
+// verifyLogoutToken checks a logout token as required by OpenID Connect
+// Back-Channel Logout 2.6: signature, iss, aud, iat, exp, or an age below
+// oidcLogoutTokenMaxAge without exp, the back-channel logout event, a sid or
+// sub, no nonce and a jti not seen before.
+func (m *AuthOIDCModule) verifyLogoutToken(raw string) (sub, sid string, err error) {
+	if raw == "" {
+		return "", "", &oidcError{"missing_logout_token", errors.New("request has no logout_token")}
+	}
+	claims, err := m.parseProviderToken(raw)
+	if err != nil {
+		return "", "", err
+	}
+	if err := m.checkProviderClaims(claims); err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	iat, ok := numericDate(claims["iat"])
+	if !ok || iat.After(now.Add(oidcIDTokenClockSkew)) {
+		return "", "", &oidcError{"invalid_iat", errors.New("logout_token has no iat or is issued in the future")}
+	}
+	expiresAt, ok := numericDate(claims["exp"])
+	if !ok {
+		expiresAt = iat.Add(oidcLogoutTokenMaxAge)
+	}
+	expiresAt = expiresAt.Add(oidcIDTokenClockSkew)
+	if !now.Before(expiresAt) {
+		return "", "", &oidcError{"token_expired", errors.New("logout_token is expired")}
+	}
+	events, _ := claims["events"].(map[string]any)
+	if _, ok := events[oidcBackChannelLogoutEvent].(map[string]any); !ok {
+		return "", "", &oidcError{"invalid_logout_token", errors.New("logout_token has no back-channel logout event")}
+	}
+	if _, ok := claims["nonce"]; ok {
+		return "", "", &oidcError{"invalid_logout_token", errors.New("logout_token must not carry a nonce")}
+	}
+	sub, _ = claims["sub"].(string)
+	sid, _ = claims["sid"].(string)
+	if sub == "" && sid == "" {
+		return "", "", &oidcError{"invalid_logout_token", errors.New("logout_token has neither sid nor sub")}
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", "", &oidcError{"invalid_logout_token", errors.New("logout_token has no jti")}
+	}
+	if m.sessionIndex().seenLogoutToken(jti, expiresAt) {
+		return "", "", &oidcError{"replayed", fmt.Errorf("logout_token %s was already received", jti)}
+	}
+	return sub, sid, nil
+}
+
+// parseProviderToken checks the signature of a token against the provider
+// keys, and its exp and nbf when present. Unlike the JWT verifier it does not
+// require a sub claim, which logout tokens may omit.
+func (m *AuthOIDCModule) parseProviderToken(raw string) (map[string]any, error) {
+	jwks := m.jwks()
+	if jwks == nil {
+		return nil, &oidcError{"token_verification", errProviderUnavailable}
+	}
+	claims := jwtx.MapClaims{}
+	parser := jwtx.NewParser(jwtx.WithLeeway(oidcIDTokenClockSkew))
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwtx.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" && jwks.GetMustMatchKid() {
+			return nil, errors.New("token has no kid")
+		}
+		key, ok := sig.FindSignatureVerificationKey(jwks.GetKeys(), kid)
+		if !ok {
+			return nil, fmt.Errorf("no provider key for kid %q", kid)
+		}
+		alg, err := sig.FromOAuth(t.Method.Alg())
+		if err != nil || (key.Alg != sig.SigAlgUnknown && key.Alg != alg) {
+			return nil, fmt.Errorf("alg %s does not match the provider key", t.Method.Alg())
+		}
+		return key.Key, nil
+	})
+	if errors.Is(err, jwtx.ErrTokenExpired) {
+		return nil, &oidcError{"token_expired", err}
+	}
+	if err != nil {
+		return nil, &oidcError{"token_verification", err}
+	}
+	return claims, nil
+}
+
+// special handlers
+
+// getLogoutHandler ends the local session and redirects to the end session
+// endpoint of the provider with the ID token as hint, or to
+// PostLogoutRedirectURL when the provider has none.
+func (m *AuthOIDCModule) getLogoutHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := state.GetState(r.Context())
+		sess := st.Session
+
+		var idToken string
+		if tokens := sessionTokens(sess); tokens != nil {
+			tokens.mu.Lock()
+			idToken = tokens.IDToken
+			tokens.mu.Unlock()
+		}
+		m.endSession(sess)
+		oidcLogoutsTotal.Inc(m.Metadata.Name, "rp", "success")
+		slog.Info("AuthOIDCModule session logged out", "request_id", st.RequestID)
+
+		postLogoutURL := m.PostLogoutRedirectURL
+		if postLogoutURL == "" {
+			postLogoutURL = "/"
+		}
+		p := m.currentProvider()
+		if p == nil || p.EndSessionURL == "" {
+			http.Redirect(w, r, postLogoutURL, http.StatusFound)
+			return
+		}
+		endSessionURL, err := url.Parse(p.EndSessionURL)
+		if err != nil {
+			slog.Error("invalid OIDC end session URL", "request_id", st.RequestID, "error", err)
+			http.Redirect(w, r, postLogoutURL, http.StatusFound)
+			return
+		}
+		q := endSessionURL.Query()
+		q.Set("client_id", m.ClientId)
+		if idToken != "" {
+			q.Set("id_token_hint", idToken)
+		}
+		if m.PostLogoutRedirectURL != "" {
+			q.Set("post_logout_redirect_uri", absoluteURL(r, m.PostLogoutRedirectURL))
+		}
+		endSessionURL.RawQuery = q.Encode()
+		http.Redirect(w, r, endSessionURL.String(), http.StatusFound)
+	})
+}
+
+// getFrontChannelLogoutHandler serves OpenID Connect Front-Channel Logout. The
+// provider loads it in the browser, so it ends the session of the request and
+// the sessions of the sid parameter, whose iss must match Issuer. It is only
+// served with Issuer set, as the parameters are not signed.
+func (m *AuthOIDCModule) getFrontChannelLogoutHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := state.GetState(r.Context())
+		query := r.URL.Query()
+		iss, sid := query.Get("iss"), query.Get("sid")
+
+		if sid != "" && iss != m.Issuer {
+			slog.Error("front-channel logout issuer mismatch", "request_id", st.RequestID, "iss", iss)
+			oidcLogoutsTotal.Inc(m.Metadata.Name, "front_channel", "issuer_mismatch")
+			http.Error(w, "invalid issuer", http.StatusBadRequest)
+			return
+		}
+		var sessions []*state.Session
+		if st.Session != nil {
+			sessions = append(sessions, st.Session)
+		}
+		if sid != "" {
+			sessions = append(sessions, m.sessionIndex().find("", sid)...)
+		}
+		for _, sess := range sessions {
+			m.endSession(sess)
+		}
+		oidcLogoutsTotal.Inc(m.Metadata.Name, "front_channel", "success")
+		slog.Info("AuthOIDCModule front-channel logout", "request_id", st.RequestID, "sid", sid, "sessions", len(sessions))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// getBackChannelLogoutHandler serves OpenID Connect Back-Channel Logout. The
+// provider posts a logout token and every session of its sid, or of its sub
+// without sid, is ended.
+func (m *AuthOIDCModule) getBackChannelLogoutHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := state.GetState(r.Context())
+		// the provider calls without cookie; drop the session created for it
+		if st.Session != nil {
+			if _, err := m.readSubjectID(st.Session); err != nil {
+				st.Session.Invalidate()
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			oidcLogoutsTotal.Inc(m.Metadata.Name, "back_channel", "invalid_request")
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		sub, sid, err := m.verifyLogoutToken(r.PostForm.Get("logout_token"))
+		if err != nil {
+			reason := failureReason(err, "invalid_logout_token")
+			slog.Error("logout token verification failed", "request_id", st.RequestID, "reason", reason, "error", err)
+			oidcLogoutsTotal.Inc(m.Metadata.Name, "back_channel", reason)
+			http.Error(w, "invalid logout token", http.StatusBadRequest)
+			return
+		}
+		sessions := m.sessionIndex().find(sub, sid)
+		for _, sess := range sessions {
+			m.endSession(sess)
+		}
+		oidcLogoutsTotal.Inc(m.Metadata.Name, "back_channel", "success")
+		slog.Info("AuthOIDCModule back-channel logout", "request_id", st.RequestID, "sub", sub, "sid", sid, "sessions", len(sessions))
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// absoluteURL resolves a path against the scheme and host of the request.
+func absoluteURL(r *http.Request, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil || u.IsAbs() {
+		return ref
+	}
+	base := &url.URL{Scheme: utils.RequestScheme(r), Host: utils.RequestHost(r), Path: "/"}
+	return base.ResolveReference(u).String()
+}
@@ -0,0 +1,189 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/axent-pl/axproxy/state"
+)
+
+const (
+	oidcTokensKey        = "oidc_tokens"
+	oidcDefaultRefreshBy = 30 * time.Second
+)
+
+var (
+	errSessionMaxAge   = errors.New("session exceeded max_session_age")
+	errTokenExpired    = errors.New("access token expired and no refresh token is available")
+	errRefreshExpired  = errors.New("refresh token expired")
+	errSubjectMismatch = errors.New("refreshed id_token has another subject")
+)
+
+// oidcTokenResponse is the token endpoint response of RFC 6749 5.1.
+// refresh_expires_in is not standard but sent by common providers.
+type oidcTokenResponse struct {
+	TokenType        string `json:"token_type"`
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+	IDToken          string `json:"id_token"`
+}
+
+// oidcTokens are the tokens of an authenticated session. mu serializes the
+// refreshes of concurrent requests of the session, which find the tokens
+// already refreshed once they acquire it.
+type oidcTokens struct {
+	mu sync.Mutex
+
+	AccessToken      string
+	RefreshToken     string
+	IDToken          string
+	ExpiresAt        time.Time
+	RefreshExpiresAt time.Time
+	AuthTime         time.Time
+}
+
+func newOIDCTokens(resp *oidcTokenResponse, claims map[string]any, now time.Time) *oidcTokens {
+	t := &oidcTokens{IDToken: resp.IDToken, AuthTime: now}
+	if authTime, ok := numericDate(claims["auth_time"]); ok {
+		t.AuthTime = authTime
+	}
+	t.update(resp, now)
+	return t
+}
+
+// update takes the tokens of a token response; a refresh token is kept unless
+// the provider rotated it.
+func (t *oidcTokens) update(resp *oidcTokenResponse, now time.Time) {
+	t.AccessToken = resp.AccessToken
+	t.ExpiresAt = time.Time{}
+	if resp.ExpiresIn > 0 {
+		t.ExpiresAt = now.Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	if resp.RefreshToken != "" {
+		t.RefreshToken = resp.RefreshToken
+		t.RefreshExpiresAt = time.Time{}
+	}
+	if resp.RefreshExpiresIn > 0 {
+		t.RefreshExpiresAt = now.Add(time.Duration(resp.RefreshExpiresIn) * time.Second)
+	}
+	if resp.IDToken != "" {
+		t.IDToken = resp.IDToken
+	}
+}
+
+func sessionTokens(sess *state.Session) *oidcTokens {
+	v, _ := sess.GetValue(oidcTokensKey)
+	t, _ := v.(*oidcTokens)
+	return t
+}
+
+func (m *AuthOIDCModule) refreshBefore() time.Duration {
+	if m.RefreshBefore > 0 {
+		return m.RefreshBefore
+	}
+	return oidcDefaultRefreshBy
+}
+
+// exchangeToken posts a token request and decodes the response.
+func (m *AuthOIDCModule) exchangeToken(ctx context.Context, form url.Values) (*oidcTokenResponse, error) {
+	resp, err := m.requestToken(ctx, form)
+	if err != nil {
+		return nil, &oidcError{"token_request", err}
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("could not close OIDC token response body", "error", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &oidcError{"token_status", fmt.Errorf("status %s", resp.Status)}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &oidcError{"token_response", fmt.Errorf("read token response: %w", err)}
+	}
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, &oidcError{"token_response", fmt.Errorf("unmarshal token response: %w", err)}
+	}
+	if tokens.AccessToken == "" {
+		return nil, &oidcError{"token_response", errors.New("token response has no access_token")}
+	}
+	return &tokens, nil
+}
+
+// ensureFreshTokens refreshes the tokens of an authenticated session that
+// expire within RefreshBefore (30s when zero). It fails when the session has to
+// authenticate again: MaxSessionAge passed since the auth_time reported by the
+// provider, the access token expired without refresh token or the refresh was
+// rejected.
+func (m *AuthOIDCModule) ensureFreshTokens(ctx context.Context, sess *state.Session, subjectID string) error {
+	tokens := sessionTokens(sess)
+	if tokens == nil {
+		return nil
+	}
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	now := time.Now()
+	if m.MaxSessionAge > 0 && now.After(tokens.AuthTime.Add(m.MaxSessionAge)) {
+		return errSessionMaxAge
+	}
+	if tokens.ExpiresAt.IsZero() || now.Before(tokens.ExpiresAt.Add(-m.refreshBefore())) {
+		return nil
+	}
+	if tokens.RefreshToken == "" {
+		if now.Before(tokens.ExpiresAt) {
+			return nil
+		}
+		return errTokenExpired
+	}
+	if !tokens.RefreshExpiresAt.IsZero() && now.After(tokens.RefreshExpiresAt) {
+		return errRefreshExpired
+	}
+
+	form := url.Values{}
+	form.Add("grant_type", "refresh_token")
+	form.Add("refresh_token", tokens.RefreshToken)
+	form.Add("client_id", m.ClientId)
+	if !m.PublicClient {
+		form.Add("client_secret", m.ClientSecret)
+	}
+	resp, err := m.exchangeToken(ctx, form)
+	if err != nil {
+		oidcRefreshesTotal.Inc(m.Metadata.Name, failureReason(err, "token_request"))
+		return fmt.Errorf("refresh: %w", err)
+	}
+	if resp.IDToken != "" {
+		principal, err := m.verifyIDToken(ctx, resp.IDToken, "")
+		if err == nil && string(principal.Subject) != subjectID {
+			err = errSubjectMismatch
+		}
+		if err != nil {
+			oidcRefreshesTotal.Inc(m.Metadata.Name, failureReason(err, "token_verification"))
+			return fmt.Errorf("refresh: %w", err)
+		}
+		m.storePrincipal(sess, subjectID, principal.Attributes)
+	}
+	tokens.update(resp, now)
+	oidcRefreshesTotal.Inc(m.Metadata.Name, "success")
+	return nil
+}
+
+// clearPrincipal removes the identity and tokens of the session.
+func (m *AuthOIDCModule) clearPrincipal(sess *state.Session) {
+	m.sessionIndex().remove(sess)
+	sess.DeleteValue(m.subjectIDKey())
+	sess.DeleteValue(m.claimsKey())
+	sess.DeleteValue(oidcTokensKey)
+}
@@ -0,0 +1,524 @@
+package modules_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/modules"
+	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/credentials/common/sig"
+	xjwt "github.com/axent-pl/credentials/jwt"
+)
+
+// testIdP is a stand-in OpenID provider serving discovery, JWKS and token
+// endpoints. ID tokens are issued for subject alice to client app with nonce,
+// then passed to patch, along with access tokens valid for expiresIn seconds
+// (60 when zero) and refresh tokens accepted until revoked. The token endpoint
+// requires the verifier of challenge when set and records the last request.
+type testIdP struct {
+	*httptest.Server
+	key       *sig.SignatureKey
+	issuer    string
+	nonce     string
+	challenge string
+	expiresIn int
+	revoked   bool
+	patch     func(claims map[string]any)
+	lastForm  url.Values
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	idp := &testIdP{key: &sig.SignatureKey{Kid: "test", Key: pk, Alg: sig.SigAlgES256}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                 idp.issuer,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+			"end_session_endpoint":   idp.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, err := idp.key.GetJWK()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]any{"keys": []any{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		idp.lastForm = r.PostForm
+		grantType := r.PostForm.Get("grant_type")
+		if grantType == "refresh_token" && (idp.revoked || r.PostForm.Get("refresh_token") != "refresh") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		if grantType == "authorization_code" && idp.challenge != "" {
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now()
+		claims := map[string]any{
+			"sub":   "alice",
+			"iss":   idp.URL,
+			"aud":   "app",
+			"nonce": idp.nonce,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Minute).Unix(),
+		}
+		if idp.patch != nil {
+			idp.patch(claims)
+		}
+		idToken, err := xjwt.JWTIssuer{}.Sign(claims, xjwt.JWTIssueParams{Key: idp.key})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		expiresIn := idp.expiresIn
+		if expiresIn == 0 {
+			expiresIn = 60
+		}
+		writeJSON(w, map[string]any{
+			"token_type":    "Bearer",
+			"expires_in":    expiresIn,
+			"access_token":  grantType + "-access",
+			"refresh_token": "refresh",
+			"id_token":      string(idToken),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	idp.issuer = idp.URL
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func startOIDC(t *testing.T, m *modules.AuthOIDCModule) {
+	t.Helper()
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Stop(context.Background()) })
+}
+
+// serveSpecial calls a special route of the module in sess.
+func serveSpecial(m *modules.AuthOIDCModule, route, target string, sess *state.Session) *httptest.ResponseRecorder {
+	st := state.NewState()
+	st.Session = sess
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req = req.WithContext(state.WithState(req.Context(), st))
+	rec := httptest.NewRecorder()
+	m.SpecialRoutes()[route](rec, req)
+	return rec
+}
+
+// serveProxied runs a proxied request in sess through the module and returns
+// the response status, 200 when the request reached the upstream.
+func serveProxied(m *modules.AuthOIDCModule, sess *state.Session) int {
+	st := state.NewState()
+	st.Session = sess
+	req := httptest.NewRequest(http.MethodGet, "https://app.test/", nil)
+	req = req.WithContext(state.WithState(req.Context(), st))
+	rec := httptest.NewRecorder()
+	m.ProxyMiddleware(func(w http.ResponseWriter, r *http.Request, st *state.State) {
+		w.WriteHeader(http.StatusOK)
+	})(rec, req, st)
+	return rec.Code
+}
+
+// loggedIn completes a login of sess.
+func loggedIn(t *testing.T, m *modules.AuthOIDCModule, idp *testIdP, sess *state.Session) {
+	t.Helper()
+	if rec := serveSpecial(m, "/oidc-callback", callback(login(t, m, idp, sess)), sess); rec.Code != http.StatusFound {
+		t.Fatalf("expected login to complete, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// login runs the login route in sess and makes the provider answer with the
+// nonce and require the code challenge of the redirect.
+func login(t *testing.T, m *modules.AuthOIDCModule, idp *testIdP, sess *state.Session) *url.URL {
+	t.Helper()
+	rec := serveSpecial(m, "/oidc-login", "https://app.test/_/oidc-login", sess)
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil {
+		t.Fatalf("expected redirect to the authorization server, got %d %v", rec.Code, err)
+	}
+	idp.nonce = loc.Query().Get("nonce")
+	idp.challenge = loc.Query().Get("code_challenge")
+	return loc
+}
+
+// callback returns the callback the authorization server redirects to after
+// the login of loc.
+func callback(loc *url.URL) string {
+	return "https://app.test/_/oidc-callback?code=abc&state=" + url.QueryEscape(loc.Query().Get("state"))
+}
+
+func TestAuthOIDCDiscovery(t *testing.T) {
+	idp := newTestIdP(t)
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret", Scope: "openid"}
+	startOIDC(t, m)
+
+	if err := m.Health(context.Background()); err != nil {
+		t.Fatalf("unexpected health error: %v", err)
+	}
+	sess := state.NewSession("s", 60)
+	loc := login(t, m, idp, sess)
+	if !strings.HasPrefix(loc.String(), idp.URL+"/authorize?") {
+		t.Fatalf("expected redirect to the discovered authorize endpoint, got %q", loc)
+	}
+
+	rec := serveSpecial(m, "/oidc-callback", callback(loc), sess)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected login to complete, got %d %s", rec.Code, rec.Body)
+	}
+	if sub, _ := sess.GetValue("oidc_subject_id"); sub != "alice" {
+		t.Fatalf("expected subject alice in session, got %v", sub)
+	}
+}
+
+func TestAuthOIDCPKCE(t *testing.T) {
+	idp := newTestIdP(t)
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", PublicClient: true}
+	startOIDC(t, m)
+
+	sess := state.NewSession("s", 60)
+	loc := login(t, m, idp, sess)
+	if loc.Query().Get("code_challenge_method") != "S256" || idp.challenge == "" {
+		t.Fatalf("expected S256 code challenge, got %q", loc.RawQuery)
+	}
+
+	if rec := serveSpecial(m, "/oidc-callback", callback(loc), state.NewSession("other", 60)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be rejected in another session, got %d", rec.Code)
+	}
+	if rec := serveSpecial(m, "/oidc-callback", callback(loc), sess); rec.Code != http.StatusFound {
+		t.Fatalf("expected login to complete, got %d %s", rec.Code, rec.Body)
+	}
+	if idp.lastForm.Has("client_secret") {
+		t.Fatalf("public client sent a client_secret")
+	}
+	if rec := serveSpecial(m, "/oidc-callback", callback(loc), sess); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected login attempt to be used once, got %d", rec.Code)
+	}
+}
+
+func TestAuthOIDCCallbackValidation(t *testing.T) {
+	cases := map[string]struct {
+		patch func(claims map[string]any)
+		query func(loc *url.URL) string
+	}{
+		"missing state":   {query: func(*url.URL) string { return "https://app.test/_/oidc-callback?code=abc" }},
+		"unknown state":   {query: func(*url.URL) string { return "https://app.test/_/oidc-callback?code=abc&state=forged" }},
+		"foreign issuer":  {patch: func(c map[string]any) { c["iss"] = "https://other.test" }},
+		"foreign aud":     {patch: func(c map[string]any) { c["aud"] = "other" }},
+		"aud without azp": {patch: func(c map[string]any) { c["aud"] = []string{"app", "other"} }},
+		"foreign azp":     {patch: func(c map[string]any) { c["azp"] = "other" }},
+		"nonce":           {patch: func(c map[string]any) { c["nonce"] = "replayed" }},
+		"expired":         {patch: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		"no iat":          {patch: func(c map[string]any) { delete(c, "iat") }},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			idp.patch = tc.patch
+			m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret"}
+			startOIDC(t, m)
+
+			sess := state.NewSession("s", 60)
+			loc := login(t, m, idp, sess)
+			target := callback(loc)
+			if tc.query != nil {
+				target = tc.query(loc)
+			}
+			if rec := serveSpecial(m, "/oidc-callback", target, sess); rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected callback to be rejected, got %d", rec.Code)
+			}
+			if _, err := sess.GetValue("oidc_subject_id"); err == nil {
+				t.Fatalf("rejected callback authenticated the session")
+			}
+		})
+	}
+}
+
+func TestAuthOIDCConcurrentLogins(t *testing.T) {
+	idp := newTestIdP(t)
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret", Scope: "openid"}
+	startOIDC(t, m)
+
+	sess := state.NewSession("s", 60)
+	first := login(t, m, idp, sess)
+	second := login(t, m, idp, sess)
+	for _, loc := range []*url.URL{second, first} {
+		idp.nonce = loc.Query().Get("nonce")
+		idp.challenge = loc.Query().Get("code_challenge")
+		if rec := serveSpecial(m, "/oidc-callback", callback(loc), sess); rec.Code != http.StatusFound {
+			t.Fatalf("expected both logins to complete, got %d %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestAuthOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.issuer = "https://other.test"
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret"}
+	startOIDC(t, m)
+
+	if err := m.Health(context.Background()); err == nil {
+		t.Fatalf("expected discovery document of another issuer to be rejected")
+	}
+	if rec := serveSpecial(m, "/oidc-login", "https://app.test/_/oidc-login", state.NewSession("s", 60)); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected login to be unavailable without endpoints, got %d", rec.Code)
+	}
+}
+
+func TestAuthOIDCRefresh(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.expiresIn = 10
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret"}
+	startOIDC(t, m)
+
+	sess := state.NewSession("s", 60)
+	loggedIn(t, m, idp, sess)
+	if code := serveProxied(m, sess); code != http.StatusOK || idp.lastForm.Get("grant_type") != "refresh_token" {
+		t.Fatalf("expected token expiring soon to be refreshed, got %d %v", code, idp.lastForm)
+	}
+
+	idp.revoked = true
+	if code := serveProxied(m, sess); code != http.StatusFound {
+		t.Fatalf("expected rejected refresh to require a new login, got %d", code)
+	}
+	if _, err := sess.GetValue("oidc_subject_id"); err == nil {
+		t.Fatalf("expected identity to be removed after rejected refresh")
+	}
+}
+
+func TestAuthOIDCMaxSessionAge(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.patch = func(c map[string]any) { c["auth_time"] = time.Now().Add(-2 * time.Hour).Unix() }
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret", MaxSessionAge: time.Hour}
+	startOIDC(t, m)
+
+	sess := state.NewSession("s", 60)
+	loggedIn(t, m, idp, sess)
+	if code := serveProxied(m, sess); code != http.StatusFound {
+		t.Fatalf("expected session older than max_session_age to require a new login, got %d", code)
+	}
+}
+
+func TestAuthOIDCLogout(t *testing.T) {
+	idp := newTestIdP(t)
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret", PostLogoutRedirectURL: "/bye"}
+	startOIDC(t, m)
+
+	sess := state.NewSession("s", 60)
+	loggedIn(t, m, idp, sess)
+	rec := serveSpecial(m, "/oidc-logout", "https://app.test/_/oidc-logout", sess)
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil || !strings.HasPrefix(loc.String(), idp.URL+"/logout?") {
+		t.Fatalf("expected redirect to end_session_endpoint, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	q := loc.Query()
+	if q.Get("id_token_hint") == "" || q.Get("client_id") != "app" || q.Get("post_logout_redirect_uri") != "https://app.test/bye" {
+		t.Fatalf("unexpected end session parameters: %v", q)
+	}
+	if !sess.Invalidated() {
+		t.Fatalf("expected session to be invalidated")
+	}
+}
+
+// postBackChannelLogout posts a logout token with claims signed by the IdP to
+// the back-channel logout route.
+func postBackChannelLogout(t *testing.T, m *modules.AuthOIDCModule, idp *testIdP, claims map[string]any) int {
+	t.Helper()
+	token, err := xjwt.JWTIssuer{}.Sign(claims, xjwt.JWTIssueParams{Key: idp.key})
+	if err != nil {
+		t.Fatalf("sign logout token: %v", err)
+	}
+	st := state.NewState()
+	st.Session = state.NewSession("idp", 60)
+	body := url.Values{"logout_token": {string(token)}}.Encode()
+	req := httptest.NewRequest(http.MethodPost, "https://app.test/_/oidc-backchannel-logout", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(state.WithState(req.Context(), st))
+	rec := httptest.NewRecorder()
+	m.SpecialRoutes()["/oidc-backchannel-logout"](rec, req)
+	if !st.Session.Invalidated() {
+		t.Fatalf("expected session of the provider request to be dropped")
+	}
+	return rec.Code
+}
+
+func TestAuthOIDCBackChannelLogout(t *testing.T) {
+	idp := newTestIdP(t)
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret"}
+	startOIDC(t, m)
+
+	sessions := map[string]*state.Session{}
+	for _, sid := range []string{"sid-1", "sid-2", "sid-3"} {
+		idp.patch = func(c map[string]any) { c["sid"] = sid }
+		sessions[sid] = state.NewSession(sid, 60)
+		loggedIn(t, m, idp, sessions[sid])
+	}
+
+	var issued int
+	logoutToken := func(patch func(map[string]any)) map[string]any {
+		issued++
+		c := map[string]any{
+			"sub":    "alice",
+			"iss":    idp.URL,
+			"aud":    "app",
+			"iat":    time.Now().Unix(),
+			"jti":    fmt.Sprintf("logout-%d", issued),
+			"sid":    "sid-1",
+			"events": map[string]any{"http://schemas.openid.net/event/backchannel-logout": map[string]any{}},
+		}
+		if patch != nil {
+			patch(c)
+		}
+		return c
+	}
+	for name, patch := range map[string]func(map[string]any){
+		"wrong audience":   func(c map[string]any) { c["aud"] = "other" },
+		"wrong issuer":     func(c map[string]any) { c["iss"] = "https://evil.test" },
+		"missing event":    func(c map[string]any) { delete(c, "events") },
+		"with nonce":       func(c map[string]any) { c["nonce"] = "n" },
+		"without sub, sid": func(c map[string]any) { delete(c, "sub"); delete(c, "sid") },
+		"without jti":      func(c map[string]any) { delete(c, "jti") },
+		"expired":          func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"stale":            func(c map[string]any) { c["iat"] = time.Now().Add(-time.Hour).Unix() },
+		"issued in future": func(c map[string]any) { c["iat"] = time.Now().Add(time.Hour).Unix() },
+	} {
+		if code := postBackChannelLogout(t, m, idp, logoutToken(patch)); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected logout token to be rejected, got %d", name, code)
+		}
+	}
+	if sessions["sid-1"].Invalidated() {
+		t.Fatalf("expected rejected logout tokens to end no session")
+	}
+
+	token := logoutToken(nil)
+	if code := postBackChannelLogout(t, m, idp, token); code != http.StatusOK {
+		t.Fatalf("expected logout token to be accepted, got %d", code)
+	}
+	if !sessions["sid-1"].Invalidated() || sessions["sid-2"].Invalidated() {
+		t.Fatalf("expected only the session of sid-1 to end")
+	}
+	if code := postBackChannelLogout(t, m, idp, token); code != http.StatusBadRequest {
+		t.Fatalf("expected replayed logout token to be rejected, got %d", code)
+	}
+
+	sidOnly := func(c map[string]any) { delete(c, "sub"); c["sid"] = "sid-2" }
+	if code := postBackChannelLogout(t, m, idp, logoutToken(sidOnly)); code != http.StatusOK {
+		t.Fatalf("expected logout token with sid only to be accepted, got %d", code)
+	}
+	if !sessions["sid-2"].Invalidated() || sessions["sid-3"].Invalidated() {
+		t.Fatalf("expected only the session of sid-2 to end")
+	}
+
+	if code := postBackChannelLogout(t, m, idp, logoutToken(func(c map[string]any) { delete(c, "sid") })); code != http.StatusOK {
+		t.Fatalf("expected logout token with sub to be accepted, got %d", code)
+	}
+	if !sessions["sid-3"].Invalidated() {
+		t.Fatalf("expected every session of the subject to end")
+	}
+}
+
+func TestAuthOIDCBackChannelLogoutAfterReload(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.patch = func(c map[string]any) { c["sid"] = "sid-1" }
+	newModule := func() *modules.AuthOIDCModule {
+		return &modules.AuthOIDCModule{Metadata: manifest.ObjectMeta{Name: "reloaded"}, Issuer: idp.URL, ClientId: "app", ClientSecret: "secret"}
+	}
+	old := newModule()
+	startOIDC(t, old)
+	sess := state.NewSession("s", 60)
+	loggedIn(t, old, idp, sess)
+
+	// a reload starts the replacement before it stops the old instance
+	replacement := newModule()
+	startOIDC(t, replacement)
+	if err := old.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+
+	token := map[string]any{
+		"sub":    "alice",
+		"iss":    idp.URL,
+		"aud":    "app",
+		"iat":    time.Now().Unix(),
+		"jti":    "logout-1",
+		"sid":    "sid-1",
+		"events": map[string]any{"http://schemas.openid.net/event/backchannel-logout": map[string]any{}},
+	}
+	if code := postBackChannelLogout(t, replacement, idp, token); code != http.StatusOK {
+		t.Fatalf("expected logout token to be accepted, got %d", code)
+	}
+	if !sess.Invalidated() {
+		t.Fatalf("expected session logged in before the reload to end")
+	}
+}
+
+func TestAuthOIDCFrontChannelLogout(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.patch = func(c map[string]any) { c["sid"] = "sid-1" }
+	m := &modules.AuthOIDCModule{Issuer: idp.URL, ClientId: "app", ClientSecret: "secret"}
+	startOIDC(t, m)
+
+	sess := state.NewSession("s", 60)
+	loggedIn(t, m, idp, sess)
+
+	for _, query := range []url.Values{
+		{"iss": {"https://evil.test"}, "sid": {"sid-1"}},
+		{"sid": {"sid-1"}},
+	} {
+		target := "https://app.test/_/oidc-frontchannel-logout?" + query.Encode()
+		if rec := serveSpecial(m, "/oidc-frontchannel-logout", target, state.NewSession("iframe", 60)); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected issuer mismatch to be rejected, got %d", query.Encode(), rec.Code)
+		}
+	}
+	if sess.Invalidated() {
+		t.Fatalf("expected rejected logout to end no session")
+	}
+
+	target := "https://app.test/_/oidc-frontchannel-logout?" + url.Values{"iss": {idp.URL}, "sid": {"sid-1"}}.Encode()
+	rec := serveSpecial(m, "/oidc-frontchannel-logout", target, state.NewSession("iframe", 60))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected front-channel logout to succeed, got %d", rec.Code)
+	}
+	if !sess.Invalidated() {
+		t.Fatalf("expected session of sid-1 to end without its cookie")
+	}
+
+	manual := &modules.AuthOIDCModule{ClientId: "app", ClientSecret: "secret", AuthorizeURL: idp.URL + "/authorize", TokenURL: idp.URL + "/token", JWKSURL: idp.URL + "/jwks"}
+	if _, ok := manual.SpecialRoutes()["/oidc-frontchannel-logout"]; ok {
+		t.Fatalf("expected front-channel logout to require an issuer")
+	}
+}
@@ -2,14 +2,20 @@ package modules
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/axent-pl/axproxy/manifest"
 	"github.com/axent-pl/axproxy/module"
 	"github.com/axent-pl/axproxy/modules/enrichment"
 	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/tracing"
 	"github.com/axent-pl/axproxy/utils/mapper"
 )
 
@@ -36,6 +42,7 @@ type EnrichmentModule struct {
 	Sources  []EnrichmentSource  `yaml:"sources"`
 	Lookups  []EnrichmentLookup  `yaml:"lookups"`
 
+	srcMu         sync.RWMutex
 	srcInterfaces map[string]enrichment.EnrichmentSourcer
 }
 
@@ -105,47 +112,66 @@ func (m *EnrichmentModule) doLookup(ctx context.Context, st *state.State) error
 			"lookup_name", lookup.Name,
 		)
 
-		src, ok := m.srcInterfaces[lookup.SourceName]
-		if !ok {
-			err := fmt.Errorf("invalid enrichment source %s", lookup.SourceName)
+		spanCtx, span := tracing.Start(ctx, "enrichment.lookup "+lookup.Name, tracing.SpanKindInternal)
+		span.SetAttribute("axproxy.module.name", m.Metadata.Name)
+		span.SetAttribute("axproxy.enrichment.source", lookup.SourceName)
+		span.SetAttribute("axproxy.enrichment.lookup", lookup.Name)
+		start := time.Now()
+		err := m.runLookup(spanCtx, lookup, st)
+		enrichmentLookupDuration.Observe(time.Since(start).Seconds(), m.Metadata.Name, lookup.SourceName, lookup.Name)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			enrichmentLookupErrorsTotal.Inc(m.Metadata.Name, lookup.SourceName, lookup.Name)
 			log_lookup.Error("lookup failed", "error", err)
-			return fmt.Errorf("undefined enrichment source %s", lookup.SourceName)
+			return err
 		}
 
-		lookupInputs, err := m.mapLookupInputs(ctx, lookup, st)
-		if err != nil {
-			log_lookup.Error("lookup failed", "error", fmt.Errorf("failed to map input: %w", err))
-			return fmt.Errorf("failed to map input: %w", err)
-		}
+		log_lookup.Info("lookup completed")
+	}
+	return nil
+}
 
-		lookupOutputs, err := src.Lookup(ctx, lookupInputs, lookup.Outputs)
-		if err != nil {
-			log_lookup.Error("lookup failed", "error", fmt.Errorf("failed to call source: %w", err))
-			return fmt.Errorf("failed to call source: %w", err)
-		}
+func (m *EnrichmentModule) runLookup(ctx context.Context, lookup EnrichmentLookup, st *state.State) error {
+	src, ok := m.source(lookup.SourceName)
+	if !ok {
+		return fmt.Errorf("undefined enrichment source %s", lookup.SourceName)
+	}
 
-		dst := map[string]any{}
-		if err := mapper.Apply(dst, lookupOutputs, lookup.Mappings); err != nil {
-			log_lookup.Error("lookup failed", "error", fmt.Errorf("failed to map output: %w", err))
-			return fmt.Errorf("failed to map output: %w", err)
-		}
+	lookupInputs, err := m.mapLookupInputs(ctx, lookup, st)
+	if err != nil {
+		return fmt.Errorf("failed to map input: %w", err)
+	}
 
-		if err := mapper.ApplyToTargets(dst, st.Session, nil, nil); err != nil {
-			log_lookup.Error("lookup failed", "error", fmt.Errorf("failed to map output to targets: %w", err))
-			return fmt.Errorf("failed to map output to targets: %w", err)
-		}
+	lookupOutputs, err := src.Lookup(ctx, lookupInputs, lookup.Outputs)
+	if err != nil {
+		return fmt.Errorf("failed to call source: %w", err)
+	}
 
-		log_lookup.Info("lookup completed")
+	dst := map[string]any{}
+	if err := mapper.Apply(dst, lookupOutputs, lookup.Mappings); err != nil {
+		return fmt.Errorf("failed to map output: %w", err)
+	}
+
+	if err := mapper.ApplyToTargets(dst, st.Session, nil, nil); err != nil {
+		return fmt.Errorf("failed to map output to targets: %w", err)
 	}
 	return nil
 }
 
-func (m *EnrichmentModule) Start() error {
+func (m *EnrichmentModule) source(name string) (enrichment.EnrichmentSourcer, bool) {
+	m.srcMu.RLock()
+	defer m.srcMu.RUnlock()
+	src, ok := m.srcInterfaces[name]
+	return src, ok
+}
+
+func (m *EnrichmentModule) Start(_ context.Context) error {
 	log_base := slog.With(
 		"module_kind", KIND_ENRICHMENT,
 		"module_name", m.Metadata.Name,
 	)
-	m.srcInterfaces = make(map[string]enrichment.EnrichmentSourcer)
+	srcInterfaces := make(map[string]enrichment.EnrichmentSourcer)
 	for _, source := range m.Sources {
 		log_source := log_base.With(
 			"source_type", source.Type,
@@ -156,15 +182,61 @@ func (m *EnrichmentModule) Start() error {
 			sourceInterface, err := enrichment.NewLdapEnrichmentSource(&source.LdapSourceConfig)
 			if err != nil {
 				log_source.Error("could not initialize enrichment source", "error", err)
-				return fmt.Errorf("could not initialize enrichment source: %w", err)
+				closeSources(srcInterfaces)
+				return fmt.Errorf("could not initialize enrichment source %s: %w", source.Name, err)
 			}
-			m.srcInterfaces[source.Name] = sourceInterface
+			srcInterfaces[source.Name] = sourceInterface
 		case "dummy":
-			m.srcInterfaces[source.Name] = enrichment.NewDummyEnrichmentSource()
+			srcInterfaces[source.Name] = enrichment.NewDummyEnrichmentSource()
 		default:
 			log_source.Error("invalid enrichment source")
+			closeSources(srcInterfaces)
 			return fmt.Errorf("invalid enrichment source (%s:%s)", source.Type, source.Name)
 		}
 	}
+	m.srcMu.Lock()
+	m.srcInterfaces = srcInterfaces
+	m.srcMu.Unlock()
 	return nil
 }
+
+// Health probes the sources without holding srcMu, so a slow source does not
+// block lookups or Stop.
+func (m *EnrichmentModule) Health(ctx context.Context) error {
+	m.srcMu.RLock()
+	sources := maps.Clone(m.srcInterfaces)
+	m.srcMu.RUnlock()
+	var errs []error
+	for name, src := range sources {
+		checker, ok := src.(enrichment.EnrichmentSourceHealthChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.Health(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("enrichment source %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *EnrichmentModule) Stop(_ context.Context) error {
+	m.srcMu.Lock()
+	defer m.srcMu.Unlock()
+	err := closeSources(m.srcInterfaces)
+	m.srcInterfaces = nil
+	return err
+}
+
+func closeSources(sources map[string]enrichment.EnrichmentSourcer) error {
+	var errs []error
+	for name, src := range sources {
+		closer, ok := src.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("could not close enrichment source %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -5,3 +5,7 @@ import "context"
 type EnrichmentSourcer interface {
 	Lookup(ctx context.Context, inputs map[string]string, outputs []string) (map[string]any, error)
 }
+
+type EnrichmentSourceHealthChecker interface {
+	Health(ctx context.Context) error
+}
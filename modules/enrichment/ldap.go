@@ -3,17 +3,16 @@ package enrichment
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/axent-pl/axproxy/utils"
 	"github.com/go-ldap/ldap/v3"
 )
 
@@ -32,20 +31,29 @@ type LdapEnrichmentSourceConfig struct {
 	TLSClientKeyFile      string `yaml:"tls_client_key_file"`
 }
 
+// ldapHealthTimeout bounds a health probe without deadline or configured
+// timeout.
+const ldapHealthTimeout = 5 * time.Second
+
 type LdapEnrichmentSource struct {
 	mu     sync.RWMutex
 	conn   *ldap.Conn
+	closed bool
 	cfg    *LdapEnrichmentSourceConfig
 	BaseDN string
 }
 
-// helper: establish a new connection + bind using cfg
-func dialAndBind(cfg *LdapEnrichmentSourceConfig) (*ldap.Conn, error) {
+// helper: establish a new connection + bind using cfg, dialing before the
+// deadline of ctx when it has one
+func dialAndBind(ctx context.Context, cfg *LdapEnrichmentSourceConfig) (*ldap.Conn, error) {
 	// TCP keep-alive to prevent idle disconnects at the TCP layer
 	dialer := &net.Dialer{
 		Timeout:   10 * time.Second, // connection timeout
 		KeepAlive: 30 * time.Second, // enable keepalive probes
 	}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
 
 	tlsCfg, err := buildTLSConfig(cfg)
 	if err != nil {
@@ -114,30 +122,8 @@ func buildTLSConfig(cfg *LdapEnrichmentSourceConfig) (*tls.Config, error) {
 		tlsCfg.ServerName = serverName
 	}
 
-	if cfg.TLSCAFile != "" {
-		caData, err := os.ReadFile(cfg.TLSCAFile)
-		if err != nil {
-			return nil, fmt.Errorf("read tls ca file: %w", err)
-		}
-		pool, err := x509.SystemCertPool()
-		if err != nil || pool == nil {
-			pool = x509.NewCertPool()
-		}
-		if !pool.AppendCertsFromPEM(caData) {
-			return nil, fmt.Errorf("append tls ca file: no certs found")
-		}
-		tlsCfg.RootCAs = pool
-	}
-
-	if cfg.TLSClientCertFile != "" || cfg.TLSClientKeyFile != "" {
-		if cfg.TLSClientCertFile == "" || cfg.TLSClientKeyFile == "" {
-			return nil, fmt.Errorf("tls client cert and key files must both be set")
-		}
-		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("load tls client cert: %w", err)
-		}
-		tlsCfg.Certificates = []tls.Certificate{cert}
+	if err := utils.LoadClientTLSFiles(tlsCfg, cfg.TLSCAFile, cfg.TLSClientCertFile, cfg.TLSClientKeyFile); err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
 	}
 
 	return tlsCfg, nil
@@ -162,7 +148,7 @@ func hostFromAddr(addr string) string {
 }
 
 func NewLdapEnrichmentSource(cfg *LdapEnrichmentSourceConfig) (*LdapEnrichmentSource, error) {
-	c, err := dialAndBind(cfg)
+	c, err := dialAndBind(context.Background(), cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -173,6 +159,7 @@ func NewLdapEnrichmentSource(cfg *LdapEnrichmentSourceConfig) (*LdapEnrichmentSo
 func (lc *LdapEnrichmentSource) Close() error {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
+	lc.closed = true
 	if lc.conn != nil {
 		lc.conn.Close()
 		lc.conn = nil
@@ -180,22 +167,45 @@ func (lc *LdapEnrichmentSource) Close() error {
 	return nil
 }
 
+// Health reports whether the LDAP connection is alive, reconnecting if needed.
+// It gives up when ctx is done, or after the configured timeout, or
+// ldapHealthTimeout, when ctx has no deadline.
+func (lc *LdapEnrichmentSource) Health(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := lc.cfg.Timeout
+		if timeout <= 0 {
+			timeout = ldapHealthTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() { done <- lc.ensureConn(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("ldap health: %w", ctx.Err())
+	}
+}
+
 // ensureConn makes sure we have a live, bound connection.
 // It performs a very cheap RootDSE base search as a ping when possible.
 // If the conn is dead, it reconnects.
-func (lc *LdapEnrichmentSource) ensureConn() error {
+func (lc *LdapEnrichmentSource) ensureConn(ctx context.Context) error {
 	lc.mu.RLock()
 	c := lc.conn
 	lc.mu.RUnlock()
 
 	if c == nil {
 		// reconnect
-		return lc.reconnect()
+		return lc.reconnect(ctx)
 	}
 
 	// If the underlying Conn reports closing, reconnect
 	if c.IsClosing() {
-		return lc.reconnect()
+		return lc.reconnect(ctx)
 	}
 
 	// Lightweight ping to catch half-closed sockets:
@@ -210,7 +220,7 @@ func (lc *LdapEnrichmentSource) ensureConn() error {
 	if _, err := c.Search(pingReq); err != nil {
 		// If it's a network error, reconnect.
 		if isNetworkError(err) {
-			return lc.reconnect()
+			return lc.reconnect(ctx)
 		}
 		// Otherwise bubble up (server-side auth/ACL issues, etc.)
 		return fmt.Errorf("ldap ping failed: %w", err)
@@ -219,16 +229,20 @@ func (lc *LdapEnrichmentSource) ensureConn() error {
 	return nil
 }
 
-func (lc *LdapEnrichmentSource) reconnect() error {
+func (lc *LdapEnrichmentSource) reconnect(ctx context.Context) error {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
 
+	// a probe running while the source is closed must not reopen it
+	if lc.closed {
+		return errors.New("ldap source closed")
+	}
 	// Double-check in case another goroutine already reconnected
 	if lc.conn != nil && !lc.conn.IsClosing() {
 		return nil
 	}
 
-	newConn, err := dialAndBind(lc.cfg)
+	newConn, err := dialAndBind(ctx, lc.cfg)
 	if err != nil {
 		return err
 	}
@@ -241,9 +255,9 @@ func (lc *LdapEnrichmentSource) reconnect() error {
 }
 
 // doSearch executes a search, retrying once if we hit a network/closed-conn error.
-func (lc *LdapEnrichmentSource) doSearch(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+func (lc *LdapEnrichmentSource) doSearch(ctx context.Context, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
 	// ensure we have a live connection first
-	if err := lc.ensureConn(); err != nil {
+	if err := lc.ensureConn(ctx); err != nil {
 		return nil, err
 	}
 
@@ -261,7 +275,7 @@ func (lc *LdapEnrichmentSource) doSearch(req *ldap.SearchRequest) (*ldap.SearchR
 	}
 
 	// network/closed-conn: reconnect and retry once
-	if rerr := lc.reconnect(); rerr != nil {
+	if rerr := lc.reconnect(ctx); rerr != nil {
 		return nil, fmt.Errorf("reconnect failed after network error: %v (orig: %w)", rerr, err)
 	}
 
@@ -323,7 +337,7 @@ func (lc *LdapEnrichmentSource) Lookup(ctx context.Context, inputs map[string]st
 		nil,
 	)
 
-	res, err := lc.doSearch(req)
+	res, err := lc.doSearch(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,76 @@
+package modules
+
+import "github.com/axent-pl/axproxy/metrics"
+
+var (
+	oidcRedirectsTotal = metrics.NewCounterVec(
+		"axproxy_oidc_redirects_total",
+		"Unauthenticated requests redirected to the OIDC login route.",
+		"module",
+	)
+	oidcLoginsTotal = metrics.NewCounterVec(
+		"axproxy_oidc_logins_total",
+		"Successful OIDC logins completed by the callback route.",
+		"module",
+	)
+	oidcCallbackFailuresTotal = metrics.NewCounterVec(
+		"axproxy_oidc_callback_failures_total",
+		"OIDC callbacks rejected, by reason.",
+		"module", "reason",
+	)
+	oidcRefreshesTotal = metrics.NewCounterVec(
+		"axproxy_oidc_token_refreshes_total",
+		"OIDC token refreshes, by result.",
+		"module", "result",
+	)
+	oidcLogoutsTotal = metrics.NewCounterVec(
+		"axproxy_oidc_logouts_total",
+		"OIDC logouts, by channel and result.",
+		"module", "channel", "result",
+	)
+	oidcDiscoveryFailuresTotal = metrics.NewCounterVec(
+		"axproxy_oidc_discovery_failures_total",
+		"OIDC discovery documents that could not be loaded.",
+		"module",
+	)
+
+	mtlsAuthenticationsTotal = metrics.NewCounterVec(
+		"axproxy_mtls_authentications_total",
+		"Client certificate authentications, by result.",
+		"module", "result",
+	)
+
+	enrichmentLookupDuration = metrics.NewHistogramVec(
+		"axproxy_enrichment_lookup_duration_seconds",
+		"Enrichment lookup latency.",
+		nil,
+		"module", "source", "lookup",
+	)
+	enrichmentLookupErrorsTotal = metrics.NewCounterVec(
+		"axproxy_enrichment_lookup_errors_total",
+		"Enrichment lookups that failed.",
+		"module", "source", "lookup",
+	)
+
+	sessionStoreSize = metrics.NewGaugeVec(
+		"axproxy_session_store_size",
+		"Sessions currently held in the session store.",
+		"module",
+	)
+	sessionsCreatedTotal = metrics.NewCounterVec(
+		"axproxy_sessions_created_total",
+		"Sessions created.",
+		"module",
+	)
+	sessionsExpiredTotal = metrics.NewCounterVec(
+		"axproxy_sessions_expired_total",
+		"Sessions removed from the store after expiring.",
+		"module",
+	)
+
+	rewriterBytesTotal = metrics.NewCounterVec(
+		"axproxy_rewriter_bytes_processed_total",
+		"Decoded response body bytes processed by the rewriter.",
+		"module",
+	)
+)
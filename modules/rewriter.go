@@ -85,8 +85,11 @@ func (m *RewriterModule) replaceHeaders(resp *http.Response, _ *state.State, rep
 	return nil
 }
 
+// replaceBody buffers and rewrites the response body. Streaming responses,
+// e.g. Server-Sent Events or chunked pages, are relayed as they arrive; only
+// their headers are rewritten.
 func (m *RewriterModule) replaceBody(resp *http.Response, _ *state.State, replacer *strings.Replacer) error {
-	if !m.ReplaceBody {
+	if !m.ReplaceBody || module.IsStreaming(resp) {
 		return nil
 	}
 	if resp.Body == nil || resp.Body == http.NoBody {
@@ -114,6 +117,7 @@ func (m *RewriterModule) replaceBody(resp *http.Response, _ *state.State, replac
 		}
 		_ = resp.Body.Close()
 
+		rewriterBytesTotal.Add(float64(len(bodyBytes)), m.Metadata.Name)
 		bodyStr := string(bodyBytes)
 		newBodyStr := replacer.Replace(bodyStr)
 
@@ -148,6 +152,7 @@ func (m *RewriterModule) replaceBody(resp *http.Response, _ *state.State, replac
 		return nil
 	}
 
+	rewriterBytesTotal.Add(float64(len(bodyBytes)), m.Metadata.Name)
 	bodyStr := string(bodyBytes)
 	newBodyStr := replacer.Replace(bodyStr)
 	resp.Body = io.NopCloser(strings.NewReader(newBodyStr))
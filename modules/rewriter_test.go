@@ -0,0 +1,59 @@
+package modules_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/modules"
+	"github.com/axent-pl/axproxy/state"
+)
+
+func TestRewriterStreamingResponse(t *testing.T) {
+	m := &modules.RewriterModule{
+		Metadata:       manifest.ObjectMeta{Name: "rewriter"},
+		Rewrite:        map[string]string{"internal.test": "app.example.test"},
+		ReplaceHeaders: true,
+		ReplaceBody:    true,
+	}
+	hook := m.ProxyModifyResponseMiddleware(func(*http.Response, *state.State) error { return nil })
+	newResponse := func(contentLength int64) *http.Response {
+		body := `<a href="http://internal.test/next">next</a>`
+		if contentLength >= 0 {
+			contentLength = int64(len(body))
+		}
+		return &http.Response{
+			StatusCode:    http.StatusFound,
+			Header:        http.Header{"Content-Type": {"text/html"}, "Location": {"http://internal.test/login"}, "Set-Cookie": {"sid=1; Domain=internal.test"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: contentLength,
+		}
+	}
+
+	cases := []struct {
+		name          string
+		contentLength int64
+		wantBody      string
+	}{
+		{"buffered", 0, `<a href="http://app.example.test/next">next</a>`},
+		{"chunked", -1, `<a href="http://internal.test/next">next</a>`},
+	}
+	for _, tc := range cases {
+		resp := newResponse(tc.contentLength)
+		if err := hook(resp, state.NewState()); err != nil {
+			t.Fatalf("%s: hook error: %v", tc.name, err)
+		}
+		if got := resp.Header.Get("Location"); got != "http://app.example.test/login" {
+			t.Fatalf("%s: expected Location to be rewritten, got %q", tc.name, got)
+		}
+		if got := resp.Header.Get("Set-Cookie"); got != "sid=1; Domain=app.example.test" {
+			t.Fatalf("%s: expected Set-Cookie to be rewritten, got %q", tc.name, got)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != tc.wantBody {
+			t.Fatalf("%s: expected body %q, got %q", tc.name, tc.wantBody, body)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
@@ -58,7 +59,7 @@ func (m *SessionModule) Middleware(next http.HandlerFunc) http.HandlerFunc {
 
 		next.ServeHTTP(w, r)
 
-		m.saveSession(sess)
+		m.storeSession(sess)
 	})
 }
 
@@ -77,7 +78,7 @@ func (m *SessionModule) ProxyMiddleware(next module.ProxyHandlerFunc) module.Pro
 
 		next(w, r, st)
 
-		m.saveSession(sess)
+		m.storeSession(sess)
 	})
 }
 
@@ -88,8 +89,11 @@ func (m *SessionModule) getOrCreateSession(r *http.Request) (*state.Session, boo
 	if name != "" {
 		if c, err := r.Cookie(name); err == nil && c.Value != "" {
 			if sess, ok := m.getSessionByID(c.Value); ok {
-				if sess.IsExpired() {
+				if sess.Invalidated() {
 					m.deleteSession(c.Value)
+				} else if sess.IsExpired() {
+					m.deleteSession(c.Value)
+					sessionsExpiredTotal.Inc(m.Metadata.Name)
 				} else {
 					sess.UpdatedAt = time.Now().UTC()
 					return sess, false
@@ -105,6 +109,7 @@ func (m *SessionModule) getOrCreateSession(r *http.Request) (*state.Session, boo
 	}
 	sess := state.NewSession(id, m.MaxAgeSeconds)
 	m.saveSession(sess)
+	sessionsCreatedTotal.Inc(m.Metadata.Name)
 	return sess, true
 }
 
@@ -119,12 +124,24 @@ func (m *SessionModule) saveSession(sess *state.Session) {
 	m.storeMu.Lock()
 	defer m.storeMu.Unlock()
 	m.store[sess.ID] = sess
+	sessionStoreSize.Set(float64(len(m.store)), m.Metadata.Name)
+}
+
+// storeSession saves the session after a request, or deletes it when the
+// request invalidated it.
+func (m *SessionModule) storeSession(sess *state.Session) {
+	if sess.Invalidated() {
+		m.deleteSession(sess.ID)
+		return
+	}
+	m.saveSession(sess)
 }
 
 func (m *SessionModule) deleteSession(id string) {
 	m.storeMu.Lock()
 	defer m.storeMu.Unlock()
 	delete(m.store, id)
+	sessionStoreSize.Set(float64(len(m.store)), m.Metadata.Name)
 }
 
 func (m *SessionModule) initStore() {
@@ -133,6 +150,35 @@ func (m *SessionModule) initStore() {
 	})
 }
 
+// liveSessionModules counts the started instances per name. A reload starts the
+// replacement before stopping the old instance, so the store size series of a
+// name is deleted only when its last instance stops.
+var liveSessionModules = struct {
+	sync.Mutex
+	names map[string]int
+}{names: map[string]int{}}
+
+func (m *SessionModule) Start(_ context.Context) error {
+	liveSessionModules.Lock()
+	defer liveSessionModules.Unlock()
+	liveSessionModules.names[m.Metadata.Name]++
+	return nil
+}
+
+func (m *SessionModule) Stop(_ context.Context) error {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	clear(m.store)
+
+	liveSessionModules.Lock()
+	defer liveSessionModules.Unlock()
+	if liveSessionModules.names[m.Metadata.Name]--; liveSessionModules.names[m.Metadata.Name] <= 0 {
+		delete(liveSessionModules.names, m.Metadata.Name)
+		sessionStoreSize.Delete(m.Metadata.Name)
+	}
+	return nil
+}
+
 func (m *SessionModule) buildCookie(r *http.Request, sess *state.Session) *http.Cookie {
 	cookie := &http.Cookie{
 		Name:     m.cookieName(),
@@ -0,0 +1,53 @@
+package modules_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/metrics"
+	"github.com/axent-pl/axproxy/modules"
+	"github.com/axent-pl/axproxy/state"
+)
+
+func storeSizeExported(t *testing.T, name string) bool {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return strings.Contains(rec.Body.String(), `axproxy_session_store_size{module="`+name+`"}`)
+}
+
+func TestSessionStoreSizeSurvivesReload(t *testing.T) {
+	ctx := context.Background()
+	old := &modules.SessionModule{Metadata: manifest.ObjectMeta{Name: "reloaded"}}
+	if err := old.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	h := old.Middleware(func(w http.ResponseWriter, r *http.Request) {})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	h(httptest.NewRecorder(), r.WithContext(state.WithState(r.Context(), state.NewState())))
+	if !storeSizeExported(t, "reloaded") {
+		t.Fatalf("expected store size of the session module to be exported")
+	}
+
+	// a reload starts the replacement before it stops the old instance
+	replacement := &modules.SessionModule{Metadata: manifest.ObjectMeta{Name: "reloaded"}}
+	if err := replacement.Start(ctx); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if err := old.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if !storeSizeExported(t, "reloaded") {
+		t.Fatalf("expected store size to stay exported while the replacement serves")
+	}
+	if err := replacement.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if storeSizeExported(t, "reloaded") {
+		t.Fatalf("expected store size to be deleted with the last instance")
+	}
+}
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	s "github.com/axent-pl/axproxy/state"
+)
+
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyWeighted         = "weighted"
+	StrategyLeastConnections = "least_connections"
+	StrategyConsistentHash   = "consistent_hash"
+
+	HashOnSession = "session"
+	HashOnHeader  = "header"
+
+	defaultEjectionTime = 30 * time.Second
+	hashReplicas        = 64
+)
+
+// Target is one backend of an upstream pool. Name and Metadata are reported in
+// the audit log of requests proxied to it.
+type Target struct {
+	URL      string            `yaml:"url"`
+	Name     string            `yaml:"name"`
+	Weight   int               `yaml:"weight"`
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+// LoadBalancing selects how a target is picked from the pool. consistent_hash
+// keeps a session, or a header value, on the same target while it is available.
+type LoadBalancing struct {
+	Strategy   string `yaml:"strategy"`
+	HashOn     string `yaml:"hash_on"`
+	HashHeader string `yaml:"hash_header"`
+}
+
+// OutlierDetection ejects a target after ConsecutiveFailures connection errors or
+// 5xx responses in a row. Ejected targets rejoin the pool after EjectionTime.
+type OutlierDetection struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	EjectionTime        time.Duration `yaml:"ejection_time"`
+}
+
+// targets returns the pool of the upstream; a single Target is a pool of one.
+func (u *Upstream) targets() []Target {
+	if len(u.Targets) > 0 {
+		return u.Targets
+	}
+	return []Target{{URL: u.Target}}
+}
+
+type backend struct {
+	target Target
+	url    *url.URL
+	weight int
+	active atomic.Int64
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	current      int
+	check        checkState
+}
+
+// available reports whether the target is neither ejected nor failing its active
+// health check.
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.check.healthy && !now.Before(b.ejectedUntil)
+}
+
+func (b *backend) healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.check.healthy
+}
+
+func (b *backend) origin() string {
+	return b.url.Scheme + "://" + b.url.Host
+}
+
+type ringEntry struct {
+	hash    uint64
+	backend *backend
+}
+
+type balancer struct {
+	upstream string
+	lb       LoadBalancing
+	outlier  OutlierDetection
+	check    *HealthCheck
+	backends []*backend
+	next     atomic.Uint64
+	wrrMu    sync.Mutex
+	ring     []ringEntry
+}
+
+func newBalancer(u *Upstream) (*balancer, error) {
+	b := &balancer{upstream: u.Label(), lb: u.LoadBalancing, outlier: u.OutlierDetection}
+	switch b.lb.Strategy {
+	case "":
+		b.lb.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyWeighted, StrategyLeastConnections:
+	case StrategyConsistentHash:
+		switch b.lb.HashOn {
+		case "":
+			b.lb.HashOn = HashOnSession
+		case HashOnSession:
+		case HashOnHeader:
+			if b.lb.HashHeader == "" {
+				return nil, fmt.Errorf("load_balancing: hash_header is required when hashing on header")
+			}
+		default:
+			return nil, fmt.Errorf("load_balancing: unsupported hash_on %q", b.lb.HashOn)
+		}
+	default:
+		return nil, fmt.Errorf("load_balancing: unsupported strategy %q", b.lb.Strategy)
+	}
+	if b.outlier.ConsecutiveFailures < 0 {
+		return nil, fmt.Errorf("outlier_detection: consecutive_failures must not be negative")
+	}
+	if b.outlier.EjectionTime <= 0 {
+		b.outlier.EjectionTime = defaultEjectionTime
+	}
+	if u.HealthCheck != nil {
+		if err := u.HealthCheck.validate(); err != nil {
+			return nil, err
+		}
+		hc := u.HealthCheck.withDefaults()
+		b.check = &hc
+	}
+
+	for i, t := range u.targets() {
+		if t.URL == "" {
+			return nil, fmt.Errorf("targets[%d]: url is empty", i)
+		}
+		target, err := url.Parse(t.URL)
+		if err != nil {
+			return nil, fmt.Errorf("targets[%d]: %w", i, err)
+		}
+		if t.Weight < 0 {
+			return nil, fmt.Errorf("targets[%d]: weight must not be negative", i)
+		}
+		weight := t.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		b.backends = append(b.backends, &backend{target: t, url: target, weight: weight, check: checkState{healthy: true}})
+	}
+	if b.lb.Strategy == StrategyConsistentHash {
+		b.buildRing()
+	}
+	return b, nil
+}
+
+func (b *balancer) buildRing() {
+	for _, be := range b.backends {
+		for i := 0; i < hashReplicas*be.weight; i++ {
+			b.ring = append(b.ring, ringEntry{hash: hashKey(be.target.URL + "#" + strconv.Itoa(i)), backend: be})
+		}
+	}
+	slices.SortFunc(b.ring, func(x, y ringEntry) int {
+		switch {
+		case x.hash < y.hash:
+			return -1
+		case x.hash > y.hash:
+			return 1
+		}
+		return 0
+	})
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// pick selects the target for the request and counts it as active. Ejected and
+// unhealthy targets, and the tried ones, are skipped unless no other target is
+// left.
+func (b *balancer) pick(r *http.Request, st *s.State, tried ...*backend) *backend {
+	if len(b.backends) == 1 {
+		be := b.backends[0]
+		be.active.Add(1)
+		return be
+	}
+	now := time.Now()
+	pool := make([]*backend, 0, len(b.backends))
+	for _, be := range b.backends {
+		if be.available(now) && !slices.Contains(tried, be) {
+			pool = append(pool, be)
+		}
+	}
+	if len(pool) == 0 {
+		pool = b.backends
+	}
+
+	var be *backend
+	switch b.lb.Strategy {
+	case StrategyWeighted:
+		be = b.pickWeighted(pool)
+	case StrategyLeastConnections:
+		be = b.pickLeastConnections(pool)
+	case StrategyConsistentHash:
+		if key := b.hashKeyOf(r, st); key != "" {
+			be = b.pickHashed(key, pool)
+		}
+	}
+	if be == nil {
+		be = pool[b.next.Add(1)%uint64(len(pool))]
+	}
+	be.active.Add(1)
+	return be
+}
+
+// pickWeighted implements smooth weighted round robin.
+func (b *balancer) pickWeighted(pool []*backend) *backend {
+	b.wrrMu.Lock()
+	defer b.wrrMu.Unlock()
+	total := 0
+	var best *backend
+	for _, be := range pool {
+		be.current += be.weight
+		total += be.weight
+		if best == nil || be.current > best.current {
+			best = be
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (b *balancer) pickLeastConnections(pool []*backend) *backend {
+	offset := int(b.next.Add(1) % uint64(len(pool)))
+	var best *backend
+	for i := range pool {
+		be := pool[(offset+i)%len(pool)]
+		if best == nil || be.active.Load() < best.active.Load() {
+			best = be
+		}
+	}
+	return best
+}
+
+// pickHashed walks the ring from the key to the first target of the pool.
+func (b *balancer) pickHashed(key string, pool []*backend) *backend {
+	h := hashKey(key)
+	start, _ := slices.BinarySearchFunc(b.ring, h, func(e ringEntry, h uint64) int {
+		switch {
+		case e.hash < h:
+			return -1
+		case e.hash > h:
+			return 1
+		}
+		return 0
+	})
+	for i := range b.ring {
+		be := b.ring[(start+i)%len(b.ring)].backend
+		if slices.Contains(pool, be) {
+			return be
+		}
+	}
+	return nil
+}
+
+func (b *balancer) hashKeyOf(r *http.Request, st *s.State) string {
+	if b.lb.HashOn == HashOnHeader {
+		return r.Header.Get(b.lb.HashHeader)
+	}
+	if st != nil && st.Session != nil {
+		return st.Session.ID
+	}
+	return ""
+}
+
+// done releases the target and feeds the outcome to outlier detection.
+func (b *balancer) done(be *backend, failed bool) {
+	be.active.Add(-1)
+	if b.outlier.ConsecutiveFailures == 0 {
+		return
+	}
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if !failed {
+		be.failures = 0
+		return
+	}
+	be.failures++
+	if be.failures >= b.outlier.ConsecutiveFailures {
+		be.failures = 0
+		be.ejectedUntil = time.Now().Add(b.outlier.EjectionTime)
+		targetEjectionsTotal.Inc(b.upstream, be.target.URL)
+	}
+}
+
+type pickedTarget struct {
+	balancer *balancer
+	backend  *backend
+	tried    []*backend
+	upstream url.URL
+	failed   bool
+	released atomic.Bool
+}
+
+const pickedTargetStateKey = "proxy.picked_target"
+
+// pickTarget selects the target of the route and records it on the state so the
+// outcome can be reported once the round trip completes. The request URL must
+// already be rewritten for the upstream.
+func pickTarget(rt *route, r *http.Request, st *s.State) *backend {
+	be := rt.balancer.pick(r, st)
+	if st != nil {
+		st.Set(pickedTargetStateKey, &pickedTarget{balancer: rt.balancer, backend: be, upstream: *r.URL})
+		setUpstreamTarget(st, be)
+	}
+	return be
+}
+
+func setUpstreamTarget(st *s.State, be *backend) {
+	st.Set(s.UpstreamTargetKey, s.UpstreamTarget{Origin: be.origin(), Name: be.target.Name, Metadata: be.target.Metadata})
+}
+
+// repick reports the current target as failed and returns a copy of the request
+// pointed at a newly picked target.
+func (pt *pickedTarget) repick(req *http.Request, st *s.State) *http.Request {
+	pt.balancer.done(pt.backend, true)
+	pt.tried = append(pt.tried, pt.backend)
+	pt.backend = pt.balancer.pick(req, st, pt.tried...)
+	pt.failed = false
+	setUpstreamTarget(st, pt.backend)
+
+	next := req.Clone(req.Context())
+	u := pt.upstream
+	next.URL = &u
+	applyTarget(next, pt.backend.url)
+	return next
+}
+
+// markTargetFailed records a connection error or 5xx response for the target the
+// request was sent to.
+func markTargetFailed(st *s.State) {
+	if pt := pickedTargetFromState(st); pt != nil {
+		pt.failed = true
+	}
+}
+
+// releaseTarget ends the request on the picked target and reports whether it
+// failed.
+func releaseTarget(st *s.State) bool {
+	pt := pickedTargetFromState(st)
+	if pt == nil || pt.released.Swap(true) {
+		return false
+	}
+	pt.balancer.done(pt.backend, pt.failed)
+	return pt.failed
+}
+
+func pickedTargetFromState(st *s.State) *pickedTarget {
+	if st == nil {
+		return nil
+	}
+	v, _ := st.Get(pickedTargetStateKey)
+	pt, _ := v.(*pickedTarget)
+	return pt
+}
@@ -0,0 +1,114 @@
+package proxy_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+func newPool(t *testing.T, u proxy.Upstream) *proxy.AuthProxy {
+	t.Helper()
+	p := &proxy.AuthProxy{
+		Metadata:  manifest.ObjectMeta{Name: "pool"},
+		Prefix:    "/_",
+		Upstreams: []proxy.Upstream{u},
+	}
+	if err := p.Init(module.NewRegistry(), nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	return p
+}
+
+func countBackends(t *testing.T, p *proxy.AuthProxy, n int, header http.Header) map[string]int {
+	t.Helper()
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		_, body := serve(t, p, "GET", "http://example.test/", header, "")
+		name, _, _ := strings.Cut(body, " ")
+		counts[name]++
+	}
+	return counts
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	a := newBackend(t, echoHandler("a"))
+	b := newBackend(t, echoHandler("b"))
+	p := newPool(t, proxy.Upstream{Name: "pool", Targets: []proxy.Target{{URL: a.URL}, {URL: b.URL}}})
+
+	counts := countBackends(t, p, 10, nil)
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	a := newBackend(t, echoHandler("a"))
+	b := newBackend(t, echoHandler("b"))
+	p := newPool(t, proxy.Upstream{
+		Name:          "pool",
+		Targets:       []proxy.Target{{URL: a.URL, Weight: 3}, {URL: b.URL}},
+		LoadBalancing: proxy.LoadBalancing{Strategy: proxy.StrategyWeighted},
+	})
+
+	counts := countBackends(t, p, 8, nil)
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestBalancerConsistentHashOnHeader(t *testing.T) {
+	a := newBackend(t, echoHandler("a"))
+	b := newBackend(t, echoHandler("b"))
+	c := newBackend(t, echoHandler("c"))
+	p := newPool(t, proxy.Upstream{
+		Name:          "pool",
+		Targets:       []proxy.Target{{URL: a.URL}, {URL: b.URL}, {URL: c.URL}},
+		LoadBalancing: proxy.LoadBalancing{Strategy: proxy.StrategyConsistentHash, HashOn: proxy.HashOnHeader, HashHeader: "X-User"},
+	})
+
+	for _, user := range []string{"alice", "bob", "carol", "dave"} {
+		counts := countBackends(t, p, 5, http.Header{"X-User": {user}})
+		if len(counts) != 1 {
+			t.Fatalf("expected %s to stick to one target, got %v", user, counts)
+		}
+	}
+}
+
+func TestBalancerOutlierEjection(t *testing.T) {
+	healthy := newBackend(t, echoHandler("healthy"))
+	failing := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failing", http.StatusServiceUnavailable)
+	})
+
+	p := newPool(t, proxy.Upstream{
+		Name:             "pool",
+		Targets:          []proxy.Target{{URL: failing.URL}, {URL: healthy.URL}},
+		OutlierDetection: proxy.OutlierDetection{ConsecutiveFailures: 2, EjectionTime: time.Minute},
+	})
+
+	countBackends(t, p, 4, nil)
+	counts := countBackends(t, p, 6, nil)
+	if counts["healthy"] != 6 {
+		t.Fatalf("expected failing target to be ejected, got %v", counts)
+	}
+}
+
+func TestBalancerInvalidConfig(t *testing.T) {
+	cases := map[string]proxy.Upstream{
+		"target and targets": {Target: "http://a.test", Targets: []proxy.Target{{URL: "http://b.test"}}},
+		"unknown strategy":   {Targets: []proxy.Target{{URL: "http://a.test"}}, LoadBalancing: proxy.LoadBalancing{Strategy: "random"}},
+		"missing header":     {Targets: []proxy.Target{{URL: "http://a.test"}}, LoadBalancing: proxy.LoadBalancing{Strategy: proxy.StrategyConsistentHash, HashOn: proxy.HashOnHeader}},
+		"empty target url":   {Targets: []proxy.Target{{Name: "a"}}},
+	}
+	for name, u := range cases {
+		p := &proxy.AuthProxy{Metadata: manifest.ObjectMeta{Name: "invalid"}, Upstreams: []proxy.Upstream{u}}
+		if err := p.Init(module.NewRegistry(), nil); err == nil {
+			t.Fatalf("%s: expected config to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures     = 5
+	defaultBreakerOpenDuration = 30 * time.Second
+	defaultBreakerBody         = "upstream unavailable\n"
+)
+
+// CircuitBreaker stops sending requests to an upstream after ConsecutiveFailures
+// failed requests in a row and answers them with Status and Body instead. After
+// OpenDuration one trial request is let through; its outcome closes or reopens
+// the circuit.
+type CircuitBreaker struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	OpenDuration        time.Duration `yaml:"open_duration"`
+	Status              int           `yaml:"status"`
+	Body                string        `yaml:"body"`
+	ContentType         string        `yaml:"content_type"`
+}
+
+func (cb *CircuitBreaker) validate() error {
+	if cb.ConsecutiveFailures < 0 || cb.OpenDuration < 0 {
+		return fmt.Errorf("circuit_breaker: consecutive_failures and open_duration must not be negative")
+	}
+	if cb.Status != 0 && (cb.Status < 400 || cb.Status > 599) {
+		return fmt.Errorf("circuit_breaker: status must be a 4xx or 5xx code, got %d", cb.Status)
+	}
+	return nil
+}
+
+func (cb CircuitBreaker) withDefaults() CircuitBreaker {
+	if cb.ConsecutiveFailures == 0 {
+		cb.ConsecutiveFailures = defaultBreakerFailures
+	}
+	if cb.OpenDuration == 0 {
+		cb.OpenDuration = defaultBreakerOpenDuration
+	}
+	if cb.Status == 0 {
+		cb.Status = http.StatusServiceUnavailable
+	}
+	if cb.Body == "" {
+		cb.Body = defaultBreakerBody
+	}
+	if cb.ContentType == "" {
+		cb.ContentType = "text/plain; charset=utf-8"
+	}
+	return cb
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breaker struct {
+	cfg      CircuitBreaker
+	upstream string
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func newBreaker(cfg *CircuitBreaker, upstream string) (*breaker, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &breaker{cfg: cfg.withDefaults(), upstream: upstream}, nil
+}
+
+// allow reports whether the request may be sent to the upstream. Every allowed
+// request must be followed by done.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// done records the outcome of an allowed request.
+func (b *breaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.trial = false
+		if failed {
+			b.open()
+		} else {
+			b.state = breakerClosed
+			b.failures = 0
+			circuitOpen.Set(0, b.upstream)
+			slog.Info("Upstream circuit closed", "upstream", b.upstream)
+		}
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.cfg.ConsecutiveFailures {
+		b.open()
+	}
+}
+
+func (b *breaker) open() {
+	b.state = breakerOpen
+	b.failures = 0
+	b.openUntil = time.Now().Add(b.cfg.OpenDuration)
+	circuitOpen.Set(1, b.upstream)
+	slog.Warn("Upstream circuit opened", "upstream", b.upstream, "open_duration", b.cfg.OpenDuration)
+}
+
+func (b *breaker) reject(w http.ResponseWriter) {
+	circuitRejectionsTotal.Inc(b.upstream)
+	w.Header().Set("Content-Type", b.cfg.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(b.cfg.Status)
+	_, _ = io.WriteString(w, b.cfg.Body)
+}
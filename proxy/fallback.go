@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/axent-pl/axproxy/utils"
+)
+
+const (
+	FallbackStatus   = "status"
+	FallbackRedirect = "redirect"
+	FallbackUpstream = "upstream"
+
+	defaultFallbackBody = "no upstream configured for host {{.Host}}\n"
+)
+
+// Fallback decides what happens to requests that match no upstream. It is
+// applied before the module chain runs, except for the upstream action which
+// proxies through the proxy chain to Target. Body and RedirectURL are Go
+// templates rendered with FallbackRequest.
+type Fallback struct {
+	Action         string `yaml:"action"`
+	Status         int    `yaml:"status"`
+	Body           string `yaml:"body"`
+	ContentType    string `yaml:"content_type"`
+	RedirectURL    string `yaml:"redirect_url"`
+	RedirectStatus int    `yaml:"redirect_status"`
+	Target         string `yaml:"target"`
+}
+
+// FallbackRequest is the template data of fallback bodies and redirect URLs.
+type FallbackRequest struct {
+	Scheme string
+	Host   string
+	Method string
+	Path   string
+	Query  string
+	URI    string
+}
+
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+type fallback struct {
+	cfg      Fallback
+	body     executor
+	redirect *template.Template
+	route    *route
+}
+
+func compileFallback(f Fallback) (*fallback, error) {
+	fb := &fallback{cfg: f}
+	switch f.Action {
+	case "", FallbackStatus:
+		fb.cfg.Action = FallbackStatus
+		if fb.cfg.Status == 0 {
+			fb.cfg.Status = http.StatusNotFound
+		}
+		if fb.cfg.Status < 400 || fb.cfg.Status > 599 {
+			return nil, fmt.Errorf("fallback: status must be a 4xx or 5xx code, got %d", f.Status)
+		}
+		if fb.cfg.ContentType == "" {
+			fb.cfg.ContentType = "text/plain; charset=utf-8"
+		}
+		body := fb.cfg.Body
+		if body == "" {
+			body = defaultFallbackBody
+		}
+		var err error
+		if strings.Contains(fb.cfg.ContentType, "html") {
+			fb.body, err = htmltemplate.New("fallback").Parse(body)
+		} else {
+			fb.body, err = template.New("fallback").Parse(body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fallback: body: %w", err)
+		}
+	case FallbackRedirect:
+		if f.RedirectURL == "" {
+			return nil, fmt.Errorf("fallback: redirect_url is empty")
+		}
+		if fb.cfg.RedirectStatus == 0 {
+			fb.cfg.RedirectStatus = http.StatusFound
+		}
+		if fb.cfg.RedirectStatus < 300 || fb.cfg.RedirectStatus > 399 {
+			return nil, fmt.Errorf("fallback: redirect_status must be a 3xx code, got %d", f.RedirectStatus)
+		}
+		tmpl, err := template.New("fallback").Parse(f.RedirectURL)
+		if err != nil {
+			return nil, fmt.Errorf("fallback: redirect_url: %w", err)
+		}
+		fb.redirect = tmpl
+	case FallbackUpstream:
+		if f.Target == "" {
+			return nil, fmt.Errorf("fallback: target is empty")
+		}
+		rt, err := compileRoute(&Upstream{Name: "fallback", Target: f.Target})
+		if err != nil {
+			return nil, fmt.Errorf("fallback: %w", err)
+		}
+		fb.route = rt
+	default:
+		return nil, fmt.Errorf("fallback: unsupported action %q", f.Action)
+	}
+	return fb, nil
+}
+
+func newFallbackRequest(r *http.Request) FallbackRequest {
+	return FallbackRequest{
+		Scheme: utils.RequestScheme(r),
+		Host:   utils.RequestHost(r),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		URI:    r.URL.RequestURI(),
+	}
+}
+
+// serve answers a request that matched no upstream. It returns false when the
+// request should continue to the fallback upstream instead.
+func (fb *fallback) serve(w http.ResponseWriter, r *http.Request, proxyName string) bool {
+	data := newFallbackRequest(r)
+	switch fb.cfg.Action {
+	case FallbackRedirect:
+		var buf bytes.Buffer
+		if err := fb.redirect.Execute(&buf, data); err != nil {
+			slog.Error("fallback redirect rendering failed", "proxy_name", proxyName, "error", err)
+			http.Error(w, "not found", http.StatusNotFound)
+			return true
+		}
+		http.Redirect(w, r, buf.String(), fb.cfg.RedirectStatus)
+		return true
+	case FallbackUpstream:
+		return false
+	}
+
+	var buf bytes.Buffer
+	if err := fb.body.Execute(&buf, data); err != nil {
+		slog.Error("fallback body rendering failed", "proxy_name", proxyName, "error", err)
+		buf.Reset()
+		buf.WriteString(http.StatusText(fb.cfg.Status) + "\n")
+	}
+	w.Header().Set("Content-Type", fb.cfg.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(fb.cfg.Status)
+	_, _ = w.Write(buf.Bytes())
+	return true
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	s "github.com/axent-pl/axproxy/state"
+)
+
+// parseTrustedProxies parses the trusted_proxies entries, CIDR ranges or single
+// addresses.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if prefix, err := netip.ParsePrefix(e); err == nil {
+			out = append(out, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: invalid address or cidr %q", e)
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func (p *AuthProxy) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withState creates the request state and resolves the originating client
+// before routing, so route matching and the modules see the same client.
+func (p *AuthProxy) withState(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := s.NewState()
+		st.Set(s.ClientKey, p.resolveClient(r))
+		next.ServeHTTP(w, r.WithContext(s.WithState(r.Context(), st)))
+	})
+}
+
+// forwardedHop is one proxy hop as described by a Forwarded element or by the
+// X-Forwarded-* headers.
+type forwardedHop struct {
+	node  string
+	proto string
+	host  string
+}
+
+// resolveClient derives the originating client of the request. The forwarding
+// headers are only read when the connection comes from a trusted proxy; the hops
+// are then walked from the nearest one until the first address that is not a
+// trusted proxy, which is the client.
+func (p *AuthProxy) resolveClient(r *http.Request) s.Client {
+	c := s.Client{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		c.Scheme = "https"
+	}
+	peer, ok := nodeAddr(r.RemoteAddr)
+	if !ok {
+		c.IP, c.Peer = r.RemoteAddr, r.RemoteAddr
+		return c
+	}
+	c.IP, c.Peer = peer.String(), peer.String()
+	if !p.trustedProxy(peer) {
+		return c
+	}
+	c.PeerTrusted = true
+
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if proto := strings.ToLower(hop.proto); proto == "http" || proto == "https" {
+			c.Scheme = proto
+		}
+		if validHost(hop.host) {
+			c.Host = hop.host
+		}
+		addr, ok := nodeAddr(hop.node)
+		if !ok {
+			break
+		}
+		c.IP = addr.String()
+		if !p.trustedProxy(addr) {
+			break
+		}
+	}
+	return c
+}
+
+// forwardedHops returns the hops of the RFC 7239 Forwarded header or, without
+// it, of X-Forwarded-For. X-Forwarded-Proto and X-Forwarded-Host are aligned
+// with X-Forwarded-For when they list every hop, otherwise their last value
+// belongs to the nearest hop.
+func forwardedHops(h http.Header) []forwardedHop {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		return parseForwarded(values)
+	}
+	fors := headerList(h, "X-Forwarded-For")
+	protos := headerList(h, "X-Forwarded-Proto")
+	hosts := headerList(h, "X-Forwarded-Host")
+	n := max(len(fors), 1)
+	hops := make([]forwardedHop, n)
+	for i, node := range fors {
+		hops[i].node = node
+	}
+	align := func(values []string, set func(*forwardedHop, string)) {
+		if len(values) == len(fors) {
+			for i, v := range values {
+				set(&hops[i], v)
+			}
+		} else if len(values) > 0 {
+			set(&hops[n-1], values[len(values)-1])
+		}
+	}
+	align(protos, func(hop *forwardedHop, v string) { hop.proto = v })
+	align(hosts, func(hop *forwardedHop, v string) { hop.host = v })
+	return hops
+}
+
+func headerList(h http.Header, name string) []string {
+	var out []string
+	for _, v := range h.Values(name) {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+// parseForwarded parses Forwarded header values into hops, ignoring unknown
+// parameters and malformed pairs.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			var hop forwardedHop
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				value = unquote(strings.TrimSpace(value))
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					hop.node = value
+				case "proto":
+					hop.proto = value
+				case "host":
+					hop.host = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits v on sep outside of quoted strings.
+func splitQuoted(v string, sep byte) []string {
+	var out []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(v); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && v[i] == '\\':
+			escaped = true
+		case v[i] == '"':
+			quoted = !quoted
+		case !quoted && v[i] == sep:
+			out = append(out, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, v[start:])
+}
+
+func unquote(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	escaped := false
+	for i := 1; i < len(v)-1; i++ {
+		if !escaped && v[i] == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// nodeAddr parses a node as found in RemoteAddr, X-Forwarded-For or a Forwarded
+// for parameter: an IP address, optionally bracketed and with a port.
+// Obfuscated and unknown nodes are rejected.
+func nodeAddr(node string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func validHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, " \t/\\@?#,;\"")
+}
+
+// setForwardedHeaders replaces the forwarding headers of an upstream request.
+// Headers received from a trusted proxy are extended with this hop, others are
+// dropped so a client cannot forge them. X-Forwarded-For itself is appended by
+// the reverse proxy. Must run before the request host is pointed at the target.
+func setForwardedHeaders(req *http.Request, st *s.State) {
+	v, _ := st.Get(s.ClientKey)
+	c, ok := v.(s.Client)
+	if !ok {
+		return
+	}
+	if !c.PeerTrusted {
+		req.Header.Del("Forwarded")
+		req.Header.Del("X-Forwarded-For")
+	}
+	req.Header.Set("X-Forwarded-Proto", c.Scheme)
+	req.Header.Set("X-Forwarded-Host", c.Host)
+	if len(req.Header.Values("Forwarded")) > 0 {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		node := c.Peer
+		if addr, ok := nodeAddr(node); ok && addr.Is6() {
+			node = `"[` + node + `]"`
+		}
+		req.Header.Add("Forwarded", fmt.Sprintf("for=%s;proto=%s;host=%q", node, proto, req.Host))
+	}
+}
@@ -0,0 +1,69 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Join([]string{
+			r.Header.Get("X-Forwarded-For"),
+			r.Header.Get("X-Forwarded-Proto"),
+			r.Header.Get("X-Forwarded-Host"),
+			strings.Join(r.Header.Values("Forwarded"), ", "),
+		}, "|"))
+	})
+	p := &proxy.AuthProxy{
+		Metadata:       manifest.ObjectMeta{Name: "forwarded"},
+		Prefix:         "/_",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Upstreams:      []proxy.Upstream{{Name: "app", Target: backend.URL}},
+	}
+	if err := p.Init(module.NewRegistry(), nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	spoofed := http.Header{
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"evil.test"},
+		"Forwarded":         {"for=203.0.113.7;proto=https"},
+	}
+
+	// httptest requests come from 192.0.2.1, which is not trusted.
+	if _, body := serve(t, p, "GET", "http://example.test/", spoofed, ""); body != "192.0.2.1|http|example.test|" {
+		t.Fatalf("expected forwarding headers of an untrusted client to be replaced, got %q", body)
+	}
+
+	p.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	if err := p.Init(module.NewRegistry(), nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	header := http.Header{
+		"X-Forwarded-For":   {"198.51.100.9, 10.0.0.2"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"app.example.com"},
+	}
+	if _, body := serve(t, p, "GET", "http://example.test/", header, ""); body != "198.51.100.9, 10.0.0.2, 192.0.2.1|https|app.example.com|" {
+		t.Fatalf("expected trusted forwarding headers to be extended, got %q", body)
+	}
+
+	header = http.Header{"Forwarded": {`for=198.51.100.9;proto=https;host="app.example.com", for=10.0.0.2`}}
+	want := `192.0.2.1|https|app.example.com|for=198.51.100.9;proto=https;host="app.example.com", for=10.0.0.2, for=192.0.2.1;proto=http;host="example.test"`
+	if _, body := serve(t, p, "GET", "http://example.test/", header, ""); body != want {
+		t.Fatalf("unexpected Forwarded handling, got %q", body)
+	}
+}
+
+func TestTrustedProxiesInvalid(t *testing.T) {
+	p := &proxy.AuthProxy{TrustedProxies: []string{"10.0.0.0/33"}, Upstreams: []proxy.Upstream{{Target: "http://a.test"}}}
+	if err := p.Init(module.NewRegistry(), nil); err == nil {
+		t.Fatalf("expected invalid trusted_proxies to be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	s "github.com/axent-pl/axproxy/state"
+)
+
+// upstreamRespondedKey is set once the response of the upstream passed the
+// response hooks; from then on it is relayed to gRPC clients unchanged.
+const upstreamRespondedKey = "proxy.upstream_responded"
+
+// gRPC status codes the proxy answers with.
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// grpcStatus maps an HTTP status to a gRPC status code as gRPC clients do for
+// responses that are not gRPC.
+func grpcStatus(code int) int {
+	switch code {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// grpcWriter turns the responses the proxy writes itself to a gRPC call, e.g.
+// module denials, unmatched routes and open circuit breakers, into
+// trailers-only gRPC responses. The status is mapped from the HTTP status and
+// the body is dropped, so clients report UNAUTHENTICATED or PERMISSION_DENIED
+// instead of failing to parse an HTML page. Upstream responses pass unchanged.
+type grpcWriter struct {
+	http.ResponseWriter
+	st          *s.State
+	wroteHeader bool
+	discard     bool
+}
+
+func (w *grpcWriter) WriteHeader(code int) {
+	if w.wroteHeader || code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+	if responded, _ := w.st.Get(upstreamRespondedKey); responded == true || code < http.StatusMultipleChoices {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.discard = true
+	h := w.Header()
+	for _, k := range []string{"Content-Length", "Content-Encoding", "Location", "X-Content-Type-Options"} {
+		h.Del(k)
+	}
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcStatus(code)))
+	h.Set("Grpc-Message", http.StatusText(code))
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+func (w *grpcWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *grpcWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *grpcWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,111 @@
+package proxy_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+func h2cProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+func newGRPCProxy(t *testing.T, backend http.Handler) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(backend)
+	upstream.Config.Protocols = h2cProtocols()
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	reg := module.NewRegistry()
+	reg.Register(bufferingModule{})
+	p := &proxy.AuthProxy{
+		Metadata:  manifest.ObjectMeta{Name: "grpc"},
+		Prefix:    "/_",
+		Upstreams: []proxy.Upstream{{Name: "app", Target: upstream.URL, Protocol: proxy.UpstreamProtocolH2C}},
+		Chain:     []proxy.Step{{ModuleRef: proxy.ModuleRef{Kind: "Buffering", Name: "upper"}}},
+	}
+	if err := p.Init(reg, nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(p)
+	srv.Config.Protocols = h2cProtocols()
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func grpcCall(t *testing.T, url, auth string) *http.Response {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{Protocols: h2cProtocols()}}
+	req, _ := http.NewRequest(http.MethodPost, url+"/echo.Echo/Say", bytes.NewReader([]byte("\x00\x00\x00\x00\x02hi")))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if auth != "" {
+		req.Header.Set("X-Auth", auth)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("grpc call: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestGRPCOverH2C(t *testing.T) {
+	srv := newGRPCProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			http.Error(w, "expected HTTP/2 with TE: trailers", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = w.Write(body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+
+	resp := grpcCall(t, srv.URL, "token")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "\x00\x00\x00\x00\x02hi" {
+		t.Fatalf("expected message to be relayed unmodified, got %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("expected grpc-status trailer 0, got %q", got)
+	}
+}
+
+func TestGRPCDenial(t *testing.T) {
+	srv := newGRPCProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("denied call reached the upstream")
+	}))
+
+	resp := grpcCall(t, srv.URL, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("expected gRPC response, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if got := resp.Header.Get("Grpc-Status"); got != "16" {
+		t.Fatalf("expected UNAUTHENTICATED (16), got %q", got)
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+		t.Fatalf("expected trailers-only response, got body %q", body)
+	}
+}
+
+func TestUpstreamProtocolRequiresMatchingScheme(t *testing.T) {
+	p := &proxy.AuthProxy{
+		Metadata:  manifest.ObjectMeta{Name: "grpc"},
+		Prefix:    "/_",
+		Upstreams: []proxy.Upstream{{Name: "app", Target: "https://backend.test", Protocol: proxy.UpstreamProtocolH2C}},
+	}
+	if err := p.Init(module.NewRegistry(), nil); err == nil {
+		t.Fatalf("expected h2c upstream with https target to be rejected")
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/axent-pl/axproxy/module"
+)
+
+const upstreamDialTimeout = 2 * time.Second
+
+// HealthEndpoints configures the liveness and readiness routes served under the
+// special prefix. Details adds the per-module and per-upstream breakdown to the
+// readiness response.
+type HealthEndpoints struct {
+	Enabled       bool   `yaml:"enabled"`
+	LivenessPath  string `yaml:"liveness_path"`
+	ReadinessPath string `yaml:"readiness_path"`
+	Details       bool   `yaml:"details"`
+}
+
+func (h HealthEndpoints) livenessPath() string {
+	if h.LivenessPath != "" {
+		return h.LivenessPath
+	}
+	return "/healthz"
+}
+
+func (h HealthEndpoints) readinessPath() string {
+	if h.ReadinessPath != "" {
+		return h.ReadinessPath
+	}
+	return "/readyz"
+}
+
+func (h HealthEndpoints) routes() []string {
+	if !h.Enabled {
+		return nil
+	}
+	return []string{h.livenessPath(), h.readinessPath()}
+}
+
+type ProxyHealth struct {
+	Name      string           `json:"name"`
+	Status    module.Status    `json:"status"`
+	Modules   []module.Health  `json:"modules,omitempty"`
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"`
+}
+
+func (h ProxyHealth) OK() bool {
+	return h.Status == module.StatusRunning
+}
+
+type UpstreamHealth struct {
+	Upstream string        `json:"upstream"`
+	Source   string        `json:"source"`
+	Target   string        `json:"target"`
+	Status   module.Status `json:"status"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Health aggregates the health of every chain module and the reachability of every
+// upstream. The proxy is degraded when any of them is not healthy.
+func (p *AuthProxy) Health(ctx context.Context) ProxyHealth {
+	h := ProxyHealth{Name: p.Metadata.Name, Status: module.StatusRunning}
+	if p.lifecycle != nil {
+		for _, mod := range p.Modules() {
+			mh := p.lifecycle.Health(ctx, mod)
+			if !mh.OK() {
+				h.Status = module.StatusDegraded
+			}
+			h.Modules = append(h.Modules, mh)
+		}
+	}
+	h.Upstreams = p.upstreamsHealth(ctx)
+	for _, uh := range h.Upstreams {
+		if uh.Status != module.StatusRunning {
+			h.Status = module.StatusDegraded
+		}
+	}
+	return h
+}
+
+// upstreamsHealth reports every upstream target. Targets with an active health
+// check report its last result, the others are dialed.
+func (p *AuthProxy) upstreamsHealth(ctx context.Context) []UpstreamHealth {
+	var out []UpstreamHealth
+	var dial []int
+	for _, rt := range p.declaredRoutes() {
+		for _, be := range rt.balancer.backends {
+			uh := UpstreamHealth{Upstream: rt.balancer.upstream, Source: rt.upstream.Source, Target: be.target.URL, Status: module.StatusRunning}
+			if rt.balancer.check == nil {
+				dial = append(dial, len(out))
+			} else {
+				be.mu.Lock()
+				if !be.check.healthy {
+					uh.Status = module.StatusDegraded
+					uh.Error = be.check.lastError
+				}
+				be.mu.Unlock()
+			}
+			out = append(out, uh)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, i := range dial {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := dialUpstream(ctx, out[i].Target); err != nil {
+				out[i].Status = module.StatusDegraded
+				out[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+func dialUpstream(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := net.Dialer{Timeout: upstreamDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// LivenessHandler reports that the process is serving requests.
+func LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+	}
+}
+
+// ReadinessHandler reports 200 when every proxy returned by proxies is healthy and
+// 503 otherwise. When details is false only the overall status is returned.
+func ReadinessHandler(proxies func() []*AuthProxy, details bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := struct {
+			Status  string        `json:"status"`
+			Proxies []ProxyHealth `json:"proxies,omitempty"`
+		}{Status: "ready"}
+		code := http.StatusOK
+		for _, p := range proxies() {
+			h := p.Health(r.Context())
+			if !h.OK() {
+				resp.Status = "not_ready"
+				code = http.StatusServiceUnavailable
+			}
+			if details {
+				resp.Proxies = append(resp.Proxies, h)
+			}
+		}
+		writeJSON(w, code, resp)
+	}
+}
+
+func (p *AuthProxy) registerHealthRoutes() {
+	if !p.HealthEndpoints.Enabled {
+		return
+	}
+	self := func() []*AuthProxy { return []*AuthProxy{p} }
+	p.specialMux.Handle(p.HealthEndpoints.livenessPath(), LivenessHandler())
+	p.specialMux.Handle(p.HealthEndpoints.readinessPath(), ReadinessHandler(self, p.HealthEndpoints.Details))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("could not write JSON response", "error", err)
+	}
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckInterval      = 10 * time.Second
+	defaultCheckTimeout       = 2 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+	maxHealthCheckBodyBytes   = 64 * 1024
+	healthCheckUserAgent      = "axproxy-health-check"
+)
+
+// HealthCheck actively probes every target of the upstream. A target is removed
+// from routing after UnhealthyThreshold failed probes in a row and added back after
+// HealthyThreshold successful ones. A probe succeeds when the status is one of
+// ExpectedStatus (any 2xx when empty) and the body contains ExpectedBody.
+type HealthCheck struct {
+	Path               string        `yaml:"path"`
+	Method             string        `yaml:"method"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	ExpectedStatus     []int         `yaml:"expected_status"`
+	ExpectedBody       string        `yaml:"expected_body"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+}
+
+func (hc *HealthCheck) validate() error {
+	if !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("health_check: path must start with /")
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return fmt.Errorf("health_check: interval and timeout must not be negative")
+	}
+	if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health_check: thresholds must not be negative")
+	}
+	for _, code := range hc.ExpectedStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("health_check: invalid expected status %d", code)
+		}
+	}
+	return nil
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Method == "" {
+		hc.Method = http.MethodGet
+	}
+	if hc.Interval == 0 {
+		hc.Interval = defaultCheckInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = defaultCheckTimeout
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = defaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	return hc
+}
+
+// probe sends one health check request to the target.
+func (hc *HealthCheck) probe(ctx context.Context, client *http.Client, target *url.URL) error {
+	ref, err := url.Parse(hc.Path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, hc.Method, target.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", healthCheckUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBodyBytes))
+	if err != nil {
+		return err
+	}
+	if len(hc.ExpectedStatus) > 0 {
+		if !slices.Contains(hc.ExpectedStatus, resp.StatusCode) {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if hc.ExpectedBody != "" && !bytes.Contains(body, []byte(hc.ExpectedBody)) {
+		return fmt.Errorf("response body does not contain %q", hc.ExpectedBody)
+	}
+	return nil
+}
+
+// checkState is the active health check state of a target.
+type checkState struct {
+	healthy   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// record applies a probe result and reports whether the target changed state.
+func (be *backend) record(hc *HealthCheck, err error) bool {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	cs := &be.check
+	cs.lastCheck = time.Now()
+	if err != nil {
+		cs.lastError = err.Error()
+		cs.successes = 0
+		cs.failures++
+		if cs.healthy && cs.failures >= hc.UnhealthyThreshold {
+			cs.healthy = false
+			return true
+		}
+		return false
+	}
+	cs.lastError = ""
+	cs.failures = 0
+	cs.successes++
+	if !cs.healthy && cs.successes >= hc.HealthyThreshold {
+		cs.healthy = true
+		return true
+	}
+	return false
+}
+
+func (b *balancer) runChecks(ctx context.Context, proxyName string, transport http.RoundTripper, wg *sync.WaitGroup) {
+	hc := b.check
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, be := range b.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(hc.Interval)
+			defer ticker.Stop()
+			for {
+				err := hc.probe(ctx, client, be.url)
+				if ctx.Err() != nil {
+					return
+				}
+				if be.record(hc, err) {
+					healthy := be.healthy()
+					targetHealthy.Set(boolGauge(healthy), proxyName, b.upstream, be.target.URL)
+					if healthy {
+						slog.Info("Upstream target healthy", "proxy_name", proxyName, "upstream", b.upstream, "target", be.target.URL)
+					} else {
+						slog.Warn("Upstream target unhealthy", "proxy_name", proxyName, "upstream", b.upstream, "target", be.target.URL, "error", err)
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+func boolGauge(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+type healthChecks struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// StartHealthChecks starts the active health checks of every upstream that
+// configures one. It is a no-op when the checks are already running.
+func (p *AuthProxy) StartHealthChecks() {
+	if p.checks != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.checks = &healthChecks{cancel: cancel}
+	for _, rt := range p.routes {
+		if rt.balancer.check != nil {
+			for _, be := range rt.balancer.backends {
+				targetHealthy.Set(boolGauge(be.healthy()), p.Metadata.Name, rt.balancer.upstream, be.target.URL)
+			}
+			rt.balancer.runChecks(ctx, p.Metadata.Name, rt.transport, &p.checks.wg)
+		}
+	}
+}
+
+// StopHealthChecks stops the active health checks and waits for running probes
+// to return.
+func (p *AuthProxy) StopHealthChecks() {
+	if p.checks == nil {
+		return
+	}
+	p.checks.cancel()
+	p.checks.wg.Wait()
+	p.checks = nil
+}
+
+// checkedTargets returns the label values of the targetHealthy series of the
+// proxy.
+func (p *AuthProxy) checkedTargets() [][3]string {
+	var out [][3]string
+	for _, rt := range p.routes {
+		if rt.balancer.check != nil {
+			for _, be := range rt.balancer.backends {
+				out = append(out, [3]string{p.Metadata.Name, rt.balancer.upstream, be.target.URL})
+			}
+		}
+	}
+	return out
+}
+
+// DeleteTargetMetrics deletes the health series of the targets checked by the
+// proxy but by none of kept, e.g. after a reload removed their upstream.
+func (p *AuthProxy) DeleteTargetMetrics(kept []*AuthProxy) {
+	reported := map[[3]string]bool{}
+	for _, k := range kept {
+		for _, labels := range k.checkedTargets() {
+			reported[labels] = true
+		}
+	}
+	for _, labels := range p.checkedTargets() {
+		if !reported[labels] {
+			targetHealthy.Delete(labels[:]...)
+		}
+	}
+}
+
+// TargetState reports the routing state of one upstream target.
+type TargetState struct {
+	Upstream       string     `json:"upstream"`
+	Target         string     `json:"target"`
+	Name           string     `json:"name,omitempty"`
+	Healthy        bool       `json:"healthy"`
+	Ejected        bool       `json:"ejected"`
+	ActiveRequests int64      `json:"active_requests"`
+	LastCheck      *time.Time `json:"last_check,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// TargetStates returns the state of every upstream target in declaration order.
+func (p *AuthProxy) TargetStates() []TargetState {
+	var out []TargetState
+	now := time.Now()
+	for _, rt := range p.declaredRoutes() {
+		for _, be := range rt.balancer.backends {
+			be.mu.Lock()
+			ts := TargetState{
+				Upstream:       rt.balancer.upstream,
+				Target:         be.target.URL,
+				Name:           be.target.Name,
+				Healthy:        be.check.healthy,
+				Ejected:        now.Before(be.ejectedUntil),
+				ActiveRequests: be.active.Load(),
+				LastError:      be.check.lastError,
+			}
+			if !be.check.lastCheck.IsZero() {
+				lastCheck := be.check.lastCheck
+				ts.LastCheck = &lastCheck
+			}
+			be.mu.Unlock()
+			out = append(out, ts)
+		}
+	}
+	return out
+}
+
+// declaredRoutes returns the routes in upstream declaration order.
+func (p *AuthProxy) declaredRoutes() []*route {
+	out := make([]*route, 0, len(p.routes))
+	for i := range p.Upstreams {
+		for _, rt := range p.routes {
+			if rt.upstream == &p.Upstreams[i] {
+				out = append(out, rt)
+			}
+		}
+	}
+	return out
+}
+
+// UpstreamsHandler reports the target states of every proxy returned by proxies.
+func UpstreamsHandler(proxies func() []*AuthProxy) http.HandlerFunc {
+	type proxyTargets struct {
+		Name    string        `json:"name"`
+		Targets []TargetState `json:"targets"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := struct {
+			Proxies []proxyTargets `json:"proxies"`
+		}{Proxies: []proxyTargets{}}
+		for _, p := range proxies() {
+			resp.Proxies = append(resp.Proxies, proxyTargets{Name: p.Metadata.Name, Targets: p.TargetStates()})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,168 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/metrics"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+// checkedHandler answers health checks on /health as healthy reports and echoes
+// other requests with name.
+func checkedHandler(name string, healthy *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if !healthy.Load() {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = io.WriteString(w, "status: ok")
+			return
+		}
+		echoHandler(name)(w, r)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestActiveHealthCheck(t *testing.T) {
+	var aHealthy, bHealthy atomic.Bool
+	aHealthy.Store(true)
+	bHealthy.Store(true)
+	a := newBackend(t, checkedHandler("a", &aHealthy))
+	b := newBackend(t, checkedHandler("b", &bHealthy))
+
+	p := newPool(t, proxy.Upstream{
+		Name:    "pool",
+		Targets: []proxy.Target{{URL: a.URL, Name: "a"}, {URL: b.URL, Name: "b"}},
+		HealthCheck: &proxy.HealthCheck{
+			Path:               "/health",
+			Interval:           10 * time.Millisecond,
+			ExpectedBody:       "ok",
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 2,
+		},
+	})
+	p.StartHealthChecks()
+	defer p.StopHealthChecks()
+
+	healthyTargets := func() int {
+		n := 0
+		for _, ts := range p.TargetStates() {
+			if ts.Healthy {
+				n++
+			}
+		}
+		return n
+	}
+
+	bHealthy.Store(false)
+	waitFor(t, "target b to become unhealthy", func() bool { return healthyTargets() == 1 })
+	if counts := countBackends(t, p, 4, nil); counts["a"] != 4 {
+		t.Fatalf("expected unhealthy target to be removed, got %v", counts)
+	}
+	if h := p.Health(context.Background()); h.OK() {
+		t.Fatalf("expected proxy to be degraded while a target is unhealthy")
+	}
+
+	bHealthy.Store(true)
+	waitFor(t, "target b to recover", func() bool { return healthyTargets() == 2 })
+	if counts := countBackends(t, p, 4, nil); counts["b"] != 2 {
+		t.Fatalf("expected recovered target to be routed again, got %v", counts)
+	}
+}
+
+func TestUpstreamsHandler(t *testing.T) {
+	var healthy atomic.Bool
+	a := newBackend(t, checkedHandler("a", &healthy))
+	p := newPool(t, proxy.Upstream{
+		Name:        "pool",
+		Targets:     []proxy.Target{{URL: a.URL, Name: "a"}},
+		HealthCheck: &proxy.HealthCheck{Path: "/health", Interval: 10 * time.Millisecond, UnhealthyThreshold: 1},
+	})
+	p.StartHealthChecks()
+	defer p.StopHealthChecks()
+	waitFor(t, "target to become unhealthy", func() bool { return !p.TargetStates()[0].Healthy })
+
+	rec := httptest.NewRecorder()
+	proxy.UpstreamsHandler(func() []*proxy.AuthProxy { return []*proxy.AuthProxy{p} })(rec, httptest.NewRequest("GET", "/upstreams", nil))
+	var resp struct {
+		Proxies []struct {
+			Name    string              `json:"name"`
+			Targets []proxy.TargetState `json:"targets"`
+		} `json:"proxies"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if len(resp.Proxies) != 1 || len(resp.Proxies[0].Targets) != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	ts := resp.Proxies[0].Targets[0]
+	if ts.Upstream != "pool" || ts.Name != "a" || ts.Healthy || ts.LastError == "" || ts.LastCheck == nil {
+		t.Fatalf("unexpected target state %+v", ts)
+	}
+}
+
+func TestDeleteTargetMetrics(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	a := newBackend(t, checkedHandler("a", &healthy))
+	b := newBackend(t, checkedHandler("b", &healthy))
+	check := &proxy.HealthCheck{Path: "/health", Interval: time.Hour}
+	newProxy := func(targets ...string) *proxy.AuthProxy {
+		p := &proxy.AuthProxy{Metadata: manifest.ObjectMeta{Name: "reloaded"}, Prefix: "/_"}
+		for _, target := range targets {
+			p.Upstreams = append(p.Upstreams, proxy.Upstream{Name: target, Target: target, HealthCheck: check})
+		}
+		if err := p.Init(module.NewRegistry(), nil); err != nil {
+			t.Fatalf("Init error: %v", err)
+		}
+		return p
+	}
+	exported := func(target string) bool {
+		rec := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return strings.Contains(rec.Body.String(), `target="`+target+`"`)
+	}
+
+	retired, active := newProxy(a.URL, b.URL), newProxy(a.URL)
+	retired.StartHealthChecks()
+	retired.StopHealthChecks()
+	active.StartHealthChecks()
+	defer active.StopHealthChecks()
+
+	retired.DeleteTargetMetrics([]*proxy.AuthProxy{active})
+	if !exported(a.URL) {
+		t.Fatalf("expected health series of the target kept by the reload to remain")
+	}
+	if exported(b.URL) {
+		t.Fatalf("expected health series of the removed target to be deleted")
+	}
+}
+
+func TestHealthCheckInvalidConfig(t *testing.T) {
+	p := &proxy.AuthProxy{Upstreams: []proxy.Upstream{{Target: "http://a.test", HealthCheck: &proxy.HealthCheck{Path: "health"}}}}
+	if err := p.Init(module.NewRegistry(), nil); err == nil {
+		t.Fatalf("expected relative health check path to be rejected")
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	ListenerTLS      = "tls"
+	ListenerPlain    = "plain"
+	ListenerRedirect = "redirect"
+
+	// DevCertFile and DevKeyFile are the bundled self-signed localhost
+	// certificate, only used by tls listeners without certificate when the
+	// development certificate is explicitly allowed.
+	DevCertFile = "assets/servercerts/localhost.crt"
+	DevKeyFile  = "assets/servercerts/localhost.key"
+)
+
+// Listener is one socket of the proxy. tls serves the proxy over HTTPS, plain
+// over HTTP, e.g. behind a TLS terminating load balancer, and redirect answers
+// every request with a redirect to the same URL over HTTPS on RedirectPort
+// (443 when zero). A tls listener picks the certificate whose names match the
+// SNI of the client hello, falling back to the first one. ClientAuth makes a
+// tls listener ask clients for a certificate and ProxyProtocol makes any
+// listener read the client address from a PROXY protocol header. tls listeners
+// negotiate HTTP/2 with clients; H2C makes a plain listener also accept HTTP/2
+// with prior knowledge, as gRPC clients without TLS send it.
+type Listener struct {
+	Name           string             `yaml:"name"`
+	Address        string             `yaml:"listen"`
+	Mode           string             `yaml:"mode"`
+	TLSCertFile    string             `yaml:"tls_crt_file"`
+	TLSKeyFile     string             `yaml:"tls_key_file"`
+	Certificates   []CertificateFiles `yaml:"certificates"`
+	ClientAuth     *ClientAuth        `yaml:"client_auth"`
+	ProxyProtocol  *ProxyProtocol     `yaml:"proxy_protocol"`
+	H2C            bool               `yaml:"h2c"`
+	RedirectPort   int                `yaml:"redirect_port"`
+	RedirectStatus int                `yaml:"redirect_status"`
+}
+
+// CertificateFiles is a PEM certificate chain and key pair.
+type CertificateFiles struct {
+	CertFile string `yaml:"tls_crt_file"`
+	KeyFile  string `yaml:"tls_key_file"`
+}
+
+const (
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// ClientAuth verifies client certificates against the CA bundle in CAFile.
+// request accepts clients without certificate and require rejects them during
+// the handshake; a presented certificate is always verified. The AuthMTLS
+// module turns the verified certificate into an identity.
+type ClientAuth struct {
+	CAFile string `yaml:"ca_file"`
+	Mode   string `yaml:"mode"`
+}
+
+// EffectiveListeners returns the listeners of the proxy with defaults applied.
+// Without listeners the top level listen address and certificate form a single
+// tls listener.
+func (p *AuthProxy) EffectiveListeners() []Listener {
+	listeners := p.Listeners
+	if len(listeners) == 0 {
+		listeners = []Listener{{Address: p.Address, TLSCertFile: p.TLSCertFile, TLSKeyFile: p.TLSKeyFile}}
+	}
+	out := make([]Listener, len(listeners))
+	for i, l := range listeners {
+		if l.Mode == "" {
+			l.Mode = ListenerTLS
+		}
+		if l.Name == "" {
+			l.Name = l.Address
+		}
+		if l.ClientAuth != nil && l.ClientAuth.Mode == "" {
+			ca := *l.ClientAuth
+			ca.Mode = ClientAuthRequire
+			l.ClientAuth = &ca
+		}
+		if l.Mode == ListenerRedirect && l.RedirectStatus == 0 {
+			l.RedirectStatus = http.StatusPermanentRedirect
+		}
+		out[i] = l
+	}
+	return out
+}
+
+func (p *AuthProxy) validateListeners() []error {
+	var errs []error
+	if len(p.Listeners) > 0 && (p.Address != "" || p.TLSCertFile != "" || p.TLSKeyFile != "") {
+		errs = append(errs, fmt.Errorf("listen, tls_crt_file and tls_key_file cannot be combined with listeners"))
+	}
+	names := map[string]bool{}
+	for _, l := range p.EffectiveListeners() {
+		if err := l.validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if names[l.Name] {
+			errs = append(errs, fmt.Errorf("listener %q: duplicate name", l.Name))
+		}
+		names[l.Name] = true
+	}
+	return errs
+}
+
+func (l Listener) validate() error {
+	if l.Address == "" {
+		return fmt.Errorf("listener %q: listen address is empty", l.Name)
+	}
+	if l.ProxyProtocol != nil {
+		if err := l.ProxyProtocol.validate(); err != nil {
+			return fmt.Errorf("listener %q: %w", l.Name, err)
+		}
+	}
+	switch l.Mode {
+	case ListenerTLS:
+		if l.H2C {
+			return fmt.Errorf("listener %q: h2c is only used in %s mode", l.Name, ListenerPlain)
+		}
+		if (l.TLSCertFile == "") != (l.TLSKeyFile == "") {
+			return fmt.Errorf("listener %q: tls_crt_file and tls_key_file must both be set", l.Name)
+		}
+		for i, c := range l.Certificates {
+			if c.CertFile == "" || c.KeyFile == "" {
+				return fmt.Errorf("listener %q: certificates[%d]: tls_crt_file and tls_key_file must both be set", l.Name, i)
+			}
+		}
+		if ca := l.ClientAuth; ca != nil {
+			if ca.CAFile == "" {
+				return fmt.Errorf("listener %q: client_auth.ca_file is empty", l.Name)
+			}
+			if ca.Mode != ClientAuthRequest && ca.Mode != ClientAuthRequire {
+				return fmt.Errorf("listener %q: unsupported client_auth.mode %q", l.Name, ca.Mode)
+			}
+		}
+	case ListenerPlain, ListenerRedirect:
+		if l.TLSCertFile != "" || l.TLSKeyFile != "" || len(l.Certificates) > 0 {
+			return fmt.Errorf("listener %q: certificates are only used in %s mode", l.Name, ListenerTLS)
+		}
+		if l.ClientAuth != nil {
+			return fmt.Errorf("listener %q: client_auth is only used in %s mode", l.Name, ListenerTLS)
+		}
+		if l.Mode == ListenerRedirect {
+			if l.H2C {
+				return fmt.Errorf("listener %q: h2c is only used in %s mode", l.Name, ListenerPlain)
+			}
+			switch l.RedirectStatus {
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				return fmt.Errorf("listener %q: unsupported redirect_status %d", l.Name, l.RedirectStatus)
+			}
+			if l.RedirectPort < 0 || l.RedirectPort > 65535 {
+				return fmt.Errorf("listener %q: invalid redirect_port %d", l.Name, l.RedirectPort)
+			}
+		}
+	default:
+		return fmt.Errorf("listener %q: unsupported mode %q", l.Name, l.Mode)
+	}
+	return nil
+}
+
+// CertificateFiles returns the certificates of a tls listener, the top level
+// pair first. The bundled development certificate is only used when dev is set;
+// otherwise a tls listener without certificate is an error.
+func (l Listener) CertificateFiles(dev bool) ([]CertificateFiles, error) {
+	if l.Mode != ListenerTLS {
+		return nil, nil
+	}
+	var out []CertificateFiles
+	if l.TLSCertFile != "" {
+		out = append(out, CertificateFiles{CertFile: l.TLSCertFile, KeyFile: l.TLSKeyFile})
+	}
+	out = append(out, l.Certificates...)
+	if len(out) > 0 {
+		return out, nil
+	}
+	if !dev {
+		return nil, fmt.Errorf("listener %q: tls mode requires tls_crt_file and tls_key_file (the bundled development certificate needs --dev-cert)", l.Name)
+	}
+	return []CertificateFiles{{CertFile: DevCertFile, KeyFile: DevKeyFile}}, nil
+}
+
+// TLSConfig returns the handshake policy and the pool of trusted client CAs.
+func (c *ClientAuth) TLSConfig() (tls.ClientAuthType, *x509.CertPool, error) {
+	data, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return tls.NoClientCert, nil, fmt.Errorf("client_auth: read ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return tls.NoClientCert, nil, fmt.Errorf("client_auth: ca file %s: no certs found", c.CAFile)
+	}
+	if c.Mode == ClientAuthRequest {
+		return tls.VerifyClientCertIfGiven, pool, nil
+	}
+	return tls.RequireAndVerifyClientCert, pool, nil
+}
+
+// RedirectHandler redirects every request to the same host and URI over HTTPS.
+// A port of 0 or 443 is omitted from the redirect URL.
+func RedirectHandler(port, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 0 && port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,90 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	cases := []struct {
+		port   int
+		target string
+		want   string
+	}{
+		{0, "http://example.test:8080/a?b=c", "https://example.test/a?b=c"},
+		{443, "http://example.test/", "https://example.test/"},
+		{8443, "http://example.test:8080/a", "https://example.test:8443/a"},
+		{0, "http://[::1]:8080/a", "https://[::1]/a"},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		proxy.RedirectHandler(tc.port, http.StatusPermanentRedirect).ServeHTTP(rec, httptest.NewRequest("POST", tc.target, nil))
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Fatalf("%s: unexpected status %d", tc.target, rec.Code)
+		}
+		if loc := rec.Header().Get("Location"); loc != tc.want {
+			t.Fatalf("%s: got location %q, want %q", tc.target, loc, tc.want)
+		}
+	}
+}
+
+func TestListenerCertificate(t *testing.T) {
+	p := &proxy.AuthProxy{Address: ":8443"}
+	l := p.EffectiveListeners()[0]
+	if l.Mode != proxy.ListenerTLS {
+		t.Fatalf("expected legacy listener to default to tls, got %q", l.Mode)
+	}
+	if _, err := l.CertificateFiles(false); err == nil {
+		t.Fatalf("expected tls listener without certificate to be rejected")
+	}
+	if certs, err := l.CertificateFiles(true); err != nil || len(certs) != 1 || certs[0].CertFile != proxy.DevCertFile {
+		t.Fatalf("expected development certificate, got %v %v", certs, err)
+	}
+
+	sni := proxy.Listener{Name: "https", Address: ":8443", Mode: proxy.ListenerTLS, TLSCertFile: "a.crt", TLSKeyFile: "a.key", Certificates: []proxy.CertificateFiles{{CertFile: "b.crt", KeyFile: "b.key"}}}
+	if certs, err := sni.CertificateFiles(false); err != nil || len(certs) != 2 || certs[0].CertFile != "a.crt" {
+		t.Fatalf("expected top level certificate first, got %v %v", certs, err)
+	}
+
+	plain := proxy.Listener{Name: "http", Address: ":8080", Mode: proxy.ListenerPlain}
+	if certs, err := plain.CertificateFiles(false); err != nil || len(certs) != 0 {
+		t.Fatalf("expected plain listener without certificate, got %v %v", certs, err)
+	}
+}
+
+func TestListenerValidation(t *testing.T) {
+	cases := map[string]*proxy.AuthProxy{
+		"no address":         {},
+		"unknown mode":       {Listeners: []proxy.Listener{{Address: ":80", Mode: "quic"}}},
+		"plain with cert":    {Listeners: []proxy.Listener{{Address: ":80", Mode: proxy.ListenerPlain, TLSCertFile: "a.crt", TLSKeyFile: "a.key"}}},
+		"redirect status":    {Listeners: []proxy.Listener{{Address: ":80", Mode: proxy.ListenerRedirect, RedirectStatus: http.StatusOK}}},
+		"duplicate name":     {Listeners: []proxy.Listener{{Name: "a", Address: ":80", Mode: proxy.ListenerPlain}, {Name: "a", Address: ":81", Mode: proxy.ListenerPlain}}},
+		"client auth ca":     {Listeners: []proxy.Listener{{Address: ":443", Mode: proxy.ListenerTLS, ClientAuth: &proxy.ClientAuth{}}}},
+		"client auth mode":   {Listeners: []proxy.Listener{{Address: ":443", Mode: proxy.ListenerTLS, ClientAuth: &proxy.ClientAuth{CAFile: "ca.pem", Mode: "optional"}}}},
+		"plain client auth":  {Listeners: []proxy.Listener{{Address: ":80", Mode: proxy.ListenerPlain, ClientAuth: &proxy.ClientAuth{CAFile: "ca.pem"}}}},
+		"proxy protocol":     {Listeners: []proxy.Listener{{Address: ":80", Mode: proxy.ListenerPlain, ProxyProtocol: &proxy.ProxyProtocol{TrustedSources: []string{"lb"}}}}},
+		"proxy protocol any": {Listeners: []proxy.Listener{{Address: ":80", Mode: proxy.ListenerPlain, ProxyProtocol: &proxy.ProxyProtocol{}}}},
+		"tls h2c":            {Listeners: []proxy.Listener{{Address: ":443", Mode: proxy.ListenerTLS, H2C: true}}},
+		"mixed":              {Address: ":443", Listeners: []proxy.Listener{{Address: ":80", Mode: proxy.ListenerPlain}}},
+	}
+	for name, p := range cases {
+		p.Metadata = manifest.ObjectMeta{Name: name}
+		if errs := p.Validate(module.NewRegistry()); len(errs) == 0 {
+			t.Fatalf("%s: expected listeners to be rejected", name)
+		}
+	}
+
+	valid := &proxy.AuthProxy{Listeners: []proxy.Listener{
+		{Address: ":80", Mode: proxy.ListenerRedirect},
+		{Address: ":8080", Mode: proxy.ListenerPlain, H2C: true},
+		{Address: ":8443", ClientAuth: &proxy.ClientAuth{CAFile: "ca.pem"}},
+	}}
+	if errs := valid.Validate(module.NewRegistry()); len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/axent-pl/axproxy/metrics"
+	s "github.com/axent-pl/axproxy/state"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"axproxy_http_requests_total",
+		"HTTP requests handled by the proxy.",
+		"proxy", "upstream", "status_class",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"axproxy_http_request_duration_seconds",
+		"HTTP request latency including the module chain and the upstream round trip.",
+		nil,
+		"proxy", "upstream", "status_class",
+	)
+	upstreamErrorsTotal = metrics.NewCounterVec(
+		"axproxy_upstream_errors_total",
+		"Upstream round trips that failed and were answered with 502.",
+		"proxy", "upstream",
+	)
+	targetEjectionsTotal = metrics.NewCounterVec(
+		"axproxy_upstream_target_ejections_total",
+		"Upstream targets ejected from the pool by outlier detection.",
+		"upstream", "target",
+	)
+	upstreamRetriesTotal = metrics.NewCounterVec(
+		"axproxy_upstream_retries_total",
+		"Upstream round trips retried by the retry policy.",
+		"upstream",
+	)
+	circuitOpen = metrics.NewGaugeVec(
+		"axproxy_upstream_circuit_open",
+		"Circuit breaker state of upstreams (1 open, 0 closed).",
+		"upstream",
+	)
+	circuitRejectionsTotal = metrics.NewCounterVec(
+		"axproxy_upstream_circuit_rejections_total",
+		"Requests answered by an open circuit breaker.",
+		"upstream",
+	)
+	proxyProtocolErrorsTotal = metrics.NewCounterVec(
+		"axproxy_proxy_protocol_errors_total",
+		"Connections closed because of a missing or invalid PROXY protocol header.",
+		"listener",
+	)
+	targetHealthy = metrics.NewGaugeVec(
+		"axproxy_upstream_target_healthy",
+		"Active health check state of upstream targets (1 healthy, 0 unhealthy).",
+		"proxy", "upstream", "target",
+	)
+)
+
+const (
+	unmatchedUpstream = "unmatched"
+	upstreamStateKey  = "proxy.upstream"
+)
+
+// instrument counts and times the requests by the upstream label the router
+// records on the request state, unmatchedUpstream when no route served them.
+func (p *AuthProxy) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		p.traceServer(sw, r, next)
+		upstream := unmatchedUpstream
+		if v, ok := s.GetState(r.Context()).Get(upstreamStateKey); ok {
+			upstream, _ = v.(string)
+		}
+		class := metrics.StatusClass(sw.status)
+		requestsTotal.Inc(p.Metadata.Name, upstream, class)
+		requestDuration.Observe(time.Since(start).Seconds(), p.Metadata.Name, upstream, class)
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.status = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack records the protocol switch, whose 101 response is written to the
+// hijacked connection instead of through WriteHeader.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		if !w.wroteHeader {
+			w.status = http.StatusSwitchingProtocols
+			w.wroteHeader = true
+		}
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -5,25 +5,58 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/axent-pl/axproxy/manifest"
 	"github.com/axent-pl/axproxy/module"
 	s "github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/utils"
 )
 
 type AuthProxy struct {
-	Metadata    manifest.ObjectMeta `yaml:"metadata"`
-	Address     string              `yaml:"listen"`
-	Prefix      string              `yaml:"special_prefix"`
-	TLSCertFile string              `yaml:"tls_crt_file"`
-	TLSKeyFile  string              `yaml:"tls_key_file"`
-	Upstreams   []Upstream          `yaml:"upstreams"`
-	upstreamMap map[string]*url.URL `yaml:"-"`
-	Chain       []Step              `yaml:"chain"`
+	Metadata        manifest.ObjectMeta `yaml:"metadata"`
+	Address         string              `yaml:"listen"`
+	Prefix          string              `yaml:"special_prefix"`
+	TLSCertFile     string              `yaml:"tls_crt_file"`
+	TLSKeyFile      string              `yaml:"tls_key_file"`
+	Listeners       []Listener          `yaml:"listeners"`
+	TrustedProxies  []string            `yaml:"trusted_proxies"`
+	Timeouts        ServerTimeouts      `yaml:"timeouts"`
+	HealthEndpoints HealthEndpoints     `yaml:"health"`
+	Upstreams       []Upstream          `yaml:"upstreams"`
+	Fallback        Fallback            `yaml:"fallback"`
+	Chain           []Step              `yaml:"chain"`
 
+	trusted    []netip.Prefix
+	routes     []*route
+	fallback   *fallback
 	specialMux *http.ServeMux
+	handler    http.Handler
+	lifecycle  *module.Lifecycle
+	checks     *healthChecks
+}
+
+// ServerTimeouts configures the listener http.Server. Zero values keep the
+// net/http defaults, except Shutdown which defaults to 30s.
+type ServerTimeouts struct {
+	Read       time.Duration `yaml:"read"`
+	ReadHeader time.Duration `yaml:"read_header"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+	Shutdown   time.Duration `yaml:"shutdown"`
+}
+
+const defaultShutdownTimeout = 30 * time.Second
+
+func (t ServerTimeouts) ShutdownTimeout() time.Duration {
+	if t.Shutdown > 0 {
+		return t.Shutdown
+	}
+	return defaultShutdownTimeout
 }
 
 type Step struct {
@@ -36,18 +69,28 @@ type ModuleRef struct {
 	Name string `yaml:"name"`
 }
 
-type Upstream struct {
-	Source string `yaml:"source"`
-	Target string `yaml:"target"`
-}
+// Init resolves the chain against the registry and builds the request handler.
+// The lifecycle is used to report module health.
+func (p *AuthProxy) Init(reg *module.Registry, lc *module.Lifecycle) error {
+	p.lifecycle = lc
 
-func (p *AuthProxy) ListenAndServe() error {
+	trusted, err := parseTrustedProxies(p.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	p.trusted = trusted
+
+	if err := p.initRoutes(); err != nil {
+		return err
+	}
 
-	if err := p.initUpstreamMap(); err != nil {
+	fb, err := compileFallback(p.Fallback)
+	if err != nil {
 		return err
 	}
+	p.fallback = fb
 
-	if err := p.initModules(); err != nil {
+	if err := p.initModules(reg); err != nil {
 		return err
 	}
 
@@ -55,16 +98,54 @@ func (p *AuthProxy) ListenAndServe() error {
 		return err
 	}
 
-	proxy := httputil.ReverseProxy{}
+	defaultHandler := p.buildPipeline(p.Chain)
+	for _, rt := range p.routes {
+		if len(rt.upstream.Chain) > 0 {
+			rt.handler = p.buildPipeline(rt.upstream.Chain)
+		} else {
+			rt.handler = defaultHandler
+		}
+	}
+	if p.fallback.route != nil {
+		p.fallback.route.handler = defaultHandler
+	}
+
+	rootMux := http.NewServeMux()
+	rootMux.Handle(p.Prefix+"/", http.StripPrefix(p.Prefix, p.specialMux))
+	rootMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		st := s.GetState(r.Context())
+		if utils.IsGRPC(r) {
+			w = &grpcWriter{ResponseWriter: w, st: st}
+		}
+		rt := p.matchRoute(r)
+		if rt == nil {
+			if p.fallback.serve(w, r, p.Metadata.Name) {
+				return
+			}
+			rt = p.fallback.route
+		}
+		st.Set(routeStateKey, rt)
+		st.Set(upstreamStateKey, rt.label())
+		rt.handler(w, r, st)
+	})
+
+	p.handler = p.withState(p.instrument(rootMux))
+	return nil
+}
+
+// buildPipeline wraps a reverse proxy with the hooks of the given chain.
+func (p *AuthProxy) buildPipeline(chain []Step) module.ProxyHandlerFunc {
+	proxy := httputil.ReverseProxy{Transport: upstreamTransport{}}
 
 	// --------------------
 	// Director
 	// --------------------
 	directorHandler := module.ProxyDirectorHandlerFunc(func(r *http.Request, st *s.State) {
-		p.proxyDirector(r)
+		p.proxyDirector(r, st)
+		p.startUpstreamSpan(r, st)
 	})
-	for i := len(p.Chain) - 1; i >= 0; i-- {
-		step := p.Chain[i]
+	for i := len(chain) - 1; i >= 0; i-- {
+		step := chain[i]
 		handlerWrapped := step.module.ProxyDirectorMiddleware(directorHandler)
 		if handlerWrapped != nil {
 			directorHandler = handlerWrapped
@@ -82,16 +163,27 @@ func (p *AuthProxy) ListenAndServe() error {
 	modifyResponseHandler := module.ProxyModifyResponseHandlerFunc(func(*http.Response, *s.State) error {
 		return nil
 	})
-	for i := len(p.Chain) - 1; i >= 0; i-- {
-		step := p.Chain[i]
+	for i := len(chain) - 1; i >= 0; i-- {
+		step := chain[i]
 		handlerWrapped := step.module.ProxyModifyResponseMiddleware(modifyResponseHandler)
 		if handlerWrapped != nil {
+			if module.BuffersResponseBody(step.module) {
+				handlerWrapped = skipStreaming(step.module, handlerWrapped, modifyResponseHandler)
+			}
 			modifyResponseHandler = handlerWrapped
 		}
 	}
 	proxy.ModifyResponse = func(resp *http.Response) error {
 		st := s.GetState(resp.Request.Context())
-		return modifyResponseHandler(resp, st)
+		err := modifyResponseHandler(resp, st)
+		if err == nil {
+			st.Set(upstreamRespondedKey, true)
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			markTargetFailed(st)
+		}
+		endUpstreamSpan(st, resp.StatusCode, err)
+		return err
 	}
 	// --------------------
 
@@ -99,95 +191,245 @@ func (p *AuthProxy) ListenAndServe() error {
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		st := s.GetState(r.Context())
 		slog.Error("proxy error", "error", err, "request_id", st.RequestID)
+		upstream, _ := st.Get(upstreamStateKey)
+		upstreamLabel, _ := upstream.(string)
+		upstreamErrorsTotal.Inc(p.Metadata.Name, upstreamLabel)
+		markTargetFailed(st)
+		endUpstreamSpan(st, http.StatusBadGateway, err)
 		http.Error(w, "bad gateway", http.StatusBadGateway)
 	}
 
-	rootMux := http.NewServeMux()
-	rootMux.Handle(p.Prefix+"/", http.StripPrefix(p.Prefix, p.specialMux))
-
 	handler := module.ProxyHandlerFunc(func(w http.ResponseWriter, r *http.Request, st *s.State) {
+		rt := routeFromState(st)
+		if rt != nil && rt.breaker != nil {
+			if !rt.breaker.allow() {
+				rt.breaker.reject(w)
+				return
+			}
+		}
+		// ReverseProxy aborts with a panic when the response copy fails, e.g.
+		// when the client disconnects, so the outcome is reported deferred
+		defer func() {
+			failed := releaseTarget(st)
+			if rt != nil && rt.breaker != nil {
+				rt.breaker.done(failed)
+			}
+		}()
 		proxy.ServeHTTP(w, r)
 	})
-	for i := len(p.Chain) - 1; i >= 0; i-- {
-		step := p.Chain[i]
+	for i := len(chain) - 1; i >= 0; i-- {
+		step := chain[i]
 		handlerWrapped := step.module.ProxyMiddleware(handler)
 		if handlerWrapped != nil {
-			handler = handlerWrapped
+			handler = traceStep(step.module, handlerWrapped)
 		}
 	}
+	return handler
+}
 
-	rootMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		st := s.NewState()
-		r = r.WithContext(s.WithState(r.Context(), st))
-		handler(w, r, st)
-	})
-
-	certFile := p.TLSCertFile
-	if certFile == "" {
-		certFile = "assets/servercerts/localhost.crt"
-	}
-	keyFile := p.TLSKeyFile
-	if keyFile == "" {
-		keyFile = "assets/servercerts/localhost.key"
+func (p *AuthProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.handler == nil {
+		http.Error(w, "proxy not initialized", http.StatusServiceUnavailable)
+		return
 	}
-	return http.ListenAndServeTLS(p.Address, certFile, keyFile, rootMux)
+	p.handler.ServeHTTP(w, r)
 }
 
 func (p *AuthProxy) registerSpecialRoutes() error {
 	p.specialMux = http.NewServeMux()
 
-	specialRoutes := make(map[string]http.HandlerFunc)
+	specialRoutes, err := p.collectSpecialRoutes()
+	if err != nil {
+		return err
+	}
+	for r, sr := range specialRoutes {
+		h := sr.handler
+		for i := len(sr.chain) - 1; i >= 0; i-- {
+			if wrapped := sr.chain[i].module.Middleware(h); wrapped != nil {
+				h = wrapped
+			}
+		}
+		p.specialMux.HandleFunc(r, h)
+	}
+	p.registerHealthRoutes()
+	return nil
+}
+
+// specialRoute is a special route handler with the chain declaring its module.
+// The middlewares of that chain wrap the handler, so modules that only appear
+// in an upstream chain override see the state set up by that override.
+type specialRoute struct {
+	handler http.HandlerFunc
+	chain   []Step
+}
+
+func (p *AuthProxy) collectSpecialRoutes() (map[string]specialRoute, error) {
+	specialRoutes := make(map[string]specialRoute)
 	type routeOwner struct {
 		kind string
 		name string
 	}
 	routeOwners := make(map[string]routeOwner)
-	for i := len(p.Chain) - 1; i >= 0; i-- {
-		step := p.Chain[i]
-		if moduleSpecialRoutes := step.module.SpecialRoutes(); moduleSpecialRoutes != nil {
+	for _, path := range p.HealthEndpoints.routes() {
+		routeOwners[path] = routeOwner{kind: "AuthProxy", name: p.Metadata.Name}
+	}
+	chains := p.declaringChains()
+	mods := p.Modules()
+	for i := len(mods) - 1; i >= 0; i-- {
+		mod := mods[i]
+		if moduleSpecialRoutes := mod.SpecialRoutes(); moduleSpecialRoutes != nil {
 			for path, handler := range moduleSpecialRoutes {
 				if owner, exists := routeOwners[path]; exists {
-					return fmt.Errorf("special route already registered: %s (new %s/%s, existing %s/%s)", path, step.module.Kind(), step.module.Name(), owner.kind, owner.name)
+					return nil, fmt.Errorf("special route already registered: %s (new %s/%s, existing %s/%s)", path, mod.Kind(), mod.Name(), owner.kind, owner.name)
 				}
-				slog.Info("Proxy special route", "proxy_name", p.Metadata.Name, "path", path, "module_kind", step.module.Kind(), "module_name", step.module.Name())
-				specialRoutes[path] = handler
+				slog.Info("Proxy special route", "proxy_name", p.Metadata.Name, "path", path, "module_kind", mod.Kind(), "module_name", mod.Name())
+				specialRoutes[path] = specialRoute{handler: handler, chain: chains[mod]}
 				routeOwners[path] = routeOwner{
-					kind: step.module.Kind(),
-					name: step.module.Name(),
+					kind: mod.Kind(),
+					name: mod.Name(),
 				}
 			}
 		}
 	}
-	for i := len(p.Chain) - 1; i >= 0; i-- {
-		step := p.Chain[i]
-		for r, h := range specialRoutes {
-			if wrapped := step.module.Middleware(h); wrapped != nil {
-				specialRoutes[r] = wrapped
+	return specialRoutes, nil
+}
+
+// declaringChains maps every module to the proxy chain when it is part of it,
+// and otherwise to the first upstream chain override listing it.
+func (p *AuthProxy) declaringChains() map[module.Module][]Step {
+	chains := map[module.Module][]Step{}
+	add := func(chain []Step) {
+		for _, step := range chain {
+			if _, ok := chains[step.module]; step.module != nil && !ok {
+				chains[step.module] = chain
 			}
 		}
 	}
-	for r, h := range specialRoutes {
-		p.specialMux.HandleFunc(r, func(w http.ResponseWriter, r *http.Request) {
-			st := s.NewState()
-			r = r.WithContext(s.WithState(r.Context(), st))
-			h.ServeHTTP(w, r)
-		})
+	add(p.Chain)
+	for _, u := range p.Upstreams {
+		add(u.Chain)
 	}
-	return nil
+	return chains
 }
 
-func (p *AuthProxy) proxyDirector(req *http.Request) {
-	scheme := "http"
-	if req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
-		scheme = "https"
+// Validate resolves every chain step against the registry and checks special
+// route collisions without building the handler. All problems are reported.
+func (p *AuthProxy) Validate(reg *module.Registry) []error {
+	errs := p.validateListeners()
+	if _, err := parseTrustedProxies(p.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	for i := range p.Upstreams {
+		if _, err := compileRoute(&p.Upstreams[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := compileFallback(p.Fallback); err != nil {
+		errs = append(errs, err)
+	}
+	for idx, step := range p.Chain {
+		mod, err := reg.Get(step.ModuleRef.Kind, step.ModuleRef.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chain[%d]: %w", idx, err))
+			continue
+		}
+		p.Chain[idx].module = mod
+	}
+	for i := range p.Upstreams {
+		u := &p.Upstreams[i]
+		for idx, step := range u.Chain {
+			mod, err := reg.Get(step.ModuleRef.Kind, step.ModuleRef.Name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("upstream %s: chain[%d]: %w", u.Label(), idx, err))
+				continue
+			}
+			u.Chain[idx].module = mod
+		}
+	}
+	if len(errs) > 0 {
+		return errs
 	}
+	if _, err := p.collectSpecialRoutes(); err != nil {
+		errs = append(errs, err)
+	}
+	return append(errs, p.validateChains()...)
+}
 
-	key := strings.ToLower(scheme + "://" + req.Host)
-	target, ok := p.upstreamMap[key]
-	if !ok {
+// validateChains lets the modules implementing module.ChainValidator check the
+// proxy chain and every upstream chain override they appear in.
+func (p *AuthProxy) validateChains() []error {
+	clientCerts := slices.ContainsFunc(p.EffectiveListeners(), func(l Listener) bool { return l.ClientAuth != nil })
+	validate := func(chain []Step) []error {
+		info := module.ChainInfo{ClientCertificates: clientCerts}
+		for _, step := range chain {
+			info.Modules = append(info.Modules, step.module)
+		}
+		var errs []error
+		for idx, step := range chain {
+			if v, ok := step.module.(module.ChainValidator); ok {
+				for _, err := range v.ValidateChain(info) {
+					errs = append(errs, fmt.Errorf("chain[%d]: %w", idx, err))
+				}
+			}
+		}
+		return errs
+	}
+	errs := validate(p.Chain)
+	for i := range p.Upstreams {
+		u := &p.Upstreams[i]
+		for _, err := range validate(u.Chain) {
+			errs = append(errs, fmt.Errorf("upstream %s: %w", u.Label(), err))
+		}
+	}
+	return errs
+}
+
+// Modules returns the resolved chain modules in chain order, followed by the
+// modules that only appear in upstream chain overrides.
+func (p *AuthProxy) Modules() []module.Module {
+	var mods []module.Module
+	seen := map[module.Module]bool{}
+	add := func(chain []Step) {
+		for _, step := range chain {
+			if step.module != nil && !seen[step.module] {
+				seen[step.module] = true
+				mods = append(mods, step.module)
+			}
+		}
+	}
+	add(p.Chain)
+	for _, u := range p.Upstreams {
+		add(u.Chain)
+	}
+	return mods
+}
+
+// ChainModules returns the resolved modules of the proxy chain.
+func (p *AuthProxy) ChainModules() []module.Module {
+	mods := make([]module.Module, 0, len(p.Chain))
+	for _, step := range p.Chain {
+		if step.module != nil {
+			mods = append(mods, step.module)
+		}
+	}
+	return mods
+}
+
+func (p *AuthProxy) proxyDirector(req *http.Request, st *s.State) {
+	rt := routeFromState(st)
+	if rt == nil {
 		return
 	}
 
+	setForwardedHeaders(req, st)
+	rt.rewritePath(req.URL)
+	be := pickTarget(rt, req, st)
+	applyTarget(req, be.url)
+}
+
+// applyTarget points the request, whose path is relative to the upstream, at
+// the target.
+func applyTarget(req *http.Request, target *url.URL) {
 	targetQuery := target.RawQuery
 	req.URL.Scheme = target.Scheme
 	req.URL.Host = target.Host
@@ -200,25 +442,25 @@ func (p *AuthProxy) proxyDirector(req *http.Request) {
 	req.Host = target.Host
 }
 
-func (p *AuthProxy) initUpstreamMap() error {
-	p.upstreamMap = map[string]*url.URL{}
-	for _, u := range p.Upstreams {
-		target, err := url.Parse(u.Target)
-		if err != nil {
-			return err
+func (p *AuthProxy) initModules(reg *module.Registry) error {
+	if err := resolveChain(reg, p.Chain); err != nil {
+		return err
+	}
+	for i := range p.Upstreams {
+		if err := resolveChain(reg, p.Upstreams[i].Chain); err != nil {
+			return fmt.Errorf("upstream %s: %w", p.Upstreams[i].Label(), err)
 		}
-		p.upstreamMap[u.Source] = target
 	}
 	return nil
 }
 
-func (p *AuthProxy) initModules() error {
-	for idx, step := range p.Chain {
-		mod, err := module.Get(step.ModuleRef.Kind, step.ModuleRef.Name)
+func resolveChain(reg *module.Registry, chain []Step) error {
+	for idx, step := range chain {
+		mod, err := reg.Get(step.ModuleRef.Kind, step.ModuleRef.Name)
 		if err != nil {
 			return err
 		}
-		p.Chain[idx].module = mod
+		chain[idx].module = mod
 	}
 	return nil
 }
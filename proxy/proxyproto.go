@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+// ProxyProtocol makes a listener read the HAProxy PROXY protocol (v1 or v2)
+// header sent by TCP load balancers and use the client address it carries as
+// the remote address of the connection. Connections from TrustedSources, which
+// is required, must start with the header; connections from other sources are
+// served as they are.
+type ProxyProtocol struct {
+	TrustedSources []string      `yaml:"trusted_sources"`
+	HeaderTimeout  time.Duration `yaml:"header_timeout"`
+}
+
+func (pp *ProxyProtocol) validate() error {
+	if len(pp.TrustedSources) == 0 {
+		return fmt.Errorf("proxy_protocol: trusted_sources is empty")
+	}
+	if _, err := parseTrustedProxies(pp.TrustedSources); err != nil {
+		return fmt.Errorf("proxy_protocol: %w", err)
+	}
+	if pp.HeaderTimeout < 0 {
+		return fmt.Errorf("proxy_protocol: header_timeout must not be negative")
+	}
+	return nil
+}
+
+// Wrap returns a listener whose connections expose the address from the PROXY
+// protocol header. The header is read on the first Read or RemoteAddr call, so
+// Accept never blocks on a slow client.
+func (pp *ProxyProtocol) Wrap(ln net.Listener, name string) (net.Listener, error) {
+	if err := pp.validate(); err != nil {
+		return nil, err
+	}
+	sources, _ := parseTrustedProxies(pp.TrustedSources)
+	timeout := pp.HeaderTimeout
+	if timeout == 0 {
+		timeout = defaultProxyProtocolTimeout
+	}
+	return &proxyProtoListener{Listener: ln, name: name, sources: sources, timeout: timeout}, nil
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	name    string
+	sources []netip.Prefix
+	timeout time.Duration
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyProtoConn{Conn: c, listener: l}, nil
+}
+
+func (l *proxyProtoListener) trusted(addr net.Addr) bool {
+	ip, ok := nodeAddr(addr.String())
+	if !ok {
+		return false
+	}
+	for _, prefix := range l.sources {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	listener *proxyProtoListener
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.r = bufio.NewReader(c.Conn)
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.listener.timeout))
+		addr, err := readProxyHeader(c.r)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("proxy protocol: %w", err)
+			proxyProtocolErrorsTotal.Inc(c.listener.name)
+			slog.Warn("Invalid PROXY protocol header, closing connection", "listener_name", c.listener.name, "source", c.remote.String(), "error", err)
+			_ = c.Conn.Close()
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const proxyV1MaxLength = 107
+
+// readProxyHeader consumes a v1 or v2 header and returns the source address it
+// carries. A nil address without error means the header does not describe a
+// proxied TCP connection (v1 UNKNOWN, v2 LOCAL or a non-IP family).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	default:
+		return nil, errors.New("missing header")
+	}
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, proxyV1Prefix) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed v1 header")
+	}
+	fields := strings.Fields(string(line[len(proxyV1Prefix) : len(line)-2]))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, errors.New("malformed v1 header")
+	}
+	ip, err := netip.ParseAddr(fields[1])
+	if err != nil || ip.Is4() != (fields[0] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[1])
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[3])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("malformed v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks of the load balancer
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", header[12]&0x0f)
+	}
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short v2 ipv4 address block")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 ipv6 address block")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34]))), nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,107 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+func newProxyProtoServer(t *testing.T, pp *proxy.ProxyProtocol) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	wrapped, err := pp.Wrap(ln, "test")
+	if err != nil {
+		t.Fatalf("Wrap error: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.RemoteAddr)
+	})}
+	go func() { _ = srv.Serve(wrapped) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return ln.Addr().String()
+}
+
+// roundTrip sends header followed by a GET request and returns the response
+// body, or an error when the connection is closed without response.
+func roundTrip(t *testing.T, addr string, header []byte) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append(header, "GET / HTTP/1.1\r\nHost: example.test\r\nConnection: close\r\n\r\n"...)); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func proxyV2Header(command byte, family byte, addr []byte) []byte {
+	h := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addr)))
+	return append(h, addr...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	addr := newProxyProtoServer(t, &proxy.ProxyProtocol{TrustedSources: []string{"127.0.0.0/8"}})
+
+	if body, err := roundTrip(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n")); err != nil || body != "203.0.113.7:51000" {
+		t.Fatalf("v1: got %q %v", body, err)
+	}
+
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::7"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:], 51000)
+	binary.BigEndian.PutUint16(ipv6[34:], 443)
+	if body, err := roundTrip(t, addr, proxyV2Header(0x1, 0x2, ipv6)); err != nil || body != "[2001:db8::7]:51000" {
+		t.Fatalf("v2: got %q %v", body, err)
+	}
+
+	if body, err := roundTrip(t, addr, proxyV2Header(0x0, 0x0, nil)); err != nil || !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Fatalf("v2 local: got %q %v", body, err)
+	}
+
+	if body, err := roundTrip(t, addr, nil); err == nil {
+		t.Fatalf("expected connection without header to be closed, got %q", body)
+	}
+	if body, err := roundTrip(t, addr, []byte("PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\n")); err == nil {
+		t.Fatalf("expected malformed header to be rejected, got %q", body)
+	}
+}
+
+func TestProxyProtocolUntrustedSource(t *testing.T) {
+	addr := newProxyProtoServer(t, &proxy.ProxyProtocol{TrustedSources: []string{"10.0.0.0/8"}})
+
+	if body, err := roundTrip(t, addr, nil); err != nil || !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Fatalf("expected untrusted source to be served without header, got %q %v", body, err)
+	}
+}
+
+func TestProxyProtocolRequiresTrustedSources(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	if _, err := (&proxy.ProxyProtocol{}).Wrap(ln, "test"); err == nil {
+		t.Fatalf("expected proxy protocol without trusted_sources to be rejected")
+	}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/axent-pl/axproxy/module"
+	s "github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/utils"
+)
+
+// Upstream routes matching requests to Target, or to one of Targets picked by
+// LoadBalancing. Source, when set, matches the request origin (scheme://host) and
+// Match narrows the selection further. Protocol selects HTTP/2 towards the
+// targets, h2 over TLS or h2c over cleartext, e.g. for gRPC services. Routes are
+// tried by descending Priority, then in declaration order. A non-empty Chain
+// replaces the proxy chain for requests routed to this upstream.
+type Upstream struct {
+	Name             string           `yaml:"name"`
+	Source           string           `yaml:"source"`
+	Target           string           `yaml:"target"`
+	Targets          []Target         `yaml:"targets"`
+	LoadBalancing    LoadBalancing    `yaml:"load_balancing"`
+	OutlierDetection OutlierDetection `yaml:"outlier_detection"`
+	HealthCheck      *HealthCheck     `yaml:"health_check"`
+	Timeouts         UpstreamTimeouts `yaml:"timeouts"`
+	TLS              *UpstreamTLS     `yaml:"tls"`
+	Protocol         string           `yaml:"protocol"`
+	Retry            *RetryPolicy     `yaml:"retry"`
+	CircuitBreaker   *CircuitBreaker  `yaml:"circuit_breaker"`
+	Priority         int              `yaml:"priority"`
+	Match            RouteMatch       `yaml:"match"`
+	StripPrefix      bool             `yaml:"strip_prefix"`
+	PathRewrite      *PathRewrite     `yaml:"path_rewrite"`
+	Chain            []Step           `yaml:"chain"`
+}
+
+// RouteMatch lists the request conditions of a route. Every configured condition
+// must hold. Header and query conditions with an empty value only require the
+// key to be present.
+type RouteMatch struct {
+	Hosts      []string          `yaml:"hosts"`
+	PathPrefix string            `yaml:"path_prefix"`
+	PathRegex  string            `yaml:"path_regex"`
+	Methods    []string          `yaml:"methods"`
+	Headers    map[string]string `yaml:"headers"`
+	Query      map[string]string `yaml:"query"`
+}
+
+// PathRewrite replaces the request path using a regular expression before it is
+// joined with the target path.
+type PathRewrite struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Label identifies the upstream in logs and metrics.
+func (u *Upstream) Label() string {
+	switch {
+	case u.Name != "":
+		return u.Name
+	case u.Source != "":
+		return u.Source
+	case u.Target == "" && len(u.Targets) > 0:
+		return u.Targets[0].URL
+	}
+	return u.Target
+}
+
+// Modules returns the resolved modules of the route chain override.
+func (u *Upstream) Modules() []module.Module {
+	mods := make([]module.Module, 0, len(u.Chain))
+	for _, step := range u.Chain {
+		if step.module != nil {
+			mods = append(mods, step.module)
+		}
+	}
+	return mods
+}
+
+const routeStateKey = "proxy.route"
+
+type route struct {
+	upstream  *Upstream
+	source    string
+	balancer  *balancer
+	transport *http.Transport
+	retry     *RetryPolicy
+	breaker   *breaker
+	pathRegex *regexp.Regexp
+	rewrite   *regexp.Regexp
+	handler   module.ProxyHandlerFunc
+}
+
+func compileRoute(u *Upstream) (*route, error) {
+	if u.Target != "" && len(u.Targets) > 0 {
+		return nil, fmt.Errorf("upstream %s: target and targets are mutually exclusive", u.Label())
+	}
+	lb, err := newBalancer(u)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", u.Label(), err)
+	}
+	rt := &route{upstream: u, source: strings.ToLower(u.Source), balancer: lb}
+	tlsCfg, err := buildUpstreamTLSConfig(u.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", u.Label(), err)
+	}
+	if err := validateUpstreamProtocol(u); err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", u.Label(), err)
+	}
+	if rt.transport, err = newUpstreamTransport(u.Timeouts, tlsCfg, u.Protocol); err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", u.Label(), err)
+	}
+	if u.Retry != nil {
+		if err := u.Retry.validate(); err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Label(), err)
+		}
+		retry := u.Retry.withDefaults()
+		rt.retry = &retry
+	}
+	if u.CircuitBreaker != nil {
+		if rt.breaker, err = newBreaker(u.CircuitBreaker, u.Label()); err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Label(), err)
+		}
+	}
+	if u.Match.PathRegex != "" {
+		if rt.pathRegex, err = regexp.Compile(u.Match.PathRegex); err != nil {
+			return nil, fmt.Errorf("upstream %s: path_regex: %w", u.Label(), err)
+		}
+	}
+	if u.PathRewrite != nil {
+		if rt.rewrite, err = regexp.Compile(u.PathRewrite.Pattern); err != nil {
+			return nil, fmt.Errorf("upstream %s: path_rewrite: %w", u.Label(), err)
+		}
+	}
+	if u.StripPrefix && u.Match.PathPrefix == "" {
+		return nil, fmt.Errorf("upstream %s: strip_prefix requires match.path_prefix", u.Label())
+	}
+	return rt, nil
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	m := rt.upstream.Match
+	if rt.source != "" && rt.source != strings.ToLower(utils.RequestScheme(r)+"://"+utils.RequestHost(r)) {
+		return false
+	}
+	if len(m.Hosts) > 0 && !slices.ContainsFunc(m.Hosts, func(h string) bool { return hostMatches(h, utils.RequestHost(r)) }) {
+		return false
+	}
+	if m.PathPrefix != "" && !pathHasPrefix(r.URL.Path, m.PathPrefix) {
+		return false
+	}
+	if rt.pathRegex != nil && !rt.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(m.Methods) > 0 && !slices.ContainsFunc(m.Methods, func(method string) bool { return strings.EqualFold(method, r.Method) }) {
+		return false
+	}
+	for name, want := range m.Headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || (want != "" && !slices.Contains(values, want)) {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := r.URL.Query()
+		for name, want := range m.Query {
+			values, ok := query[name]
+			if !ok || (want != "" && !slices.Contains(values, want)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pathHasPrefix reports whether path is prefix or lies below it, so /api
+// matches /api and /api/users but not /apidocs.
+func pathHasPrefix(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// hostMatches compares a configured host with the request host. A configured
+// host without a port matches the request host on any port. IPv6 literals
+// match with or without brackets.
+func hostMatches(pattern, host string) bool {
+	if strings.EqualFold(pattern, host) {
+		return true
+	}
+	if _, _, err := net.SplitHostPort(pattern); err == nil {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(strings.Trim(pattern, "[]"), strings.Trim(host, "[]"))
+}
+
+// rewritePath applies prefix stripping and the path rewrite to the request path.
+func (rt *route) rewritePath(u *url.URL) {
+	path := u.Path
+	if rt.upstream.StripPrefix {
+		path = strings.TrimPrefix(path, rt.upstream.Match.PathPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if rt.rewrite != nil {
+		path = rt.rewrite.ReplaceAllString(path, rt.upstream.PathRewrite.Replacement)
+	}
+	if path != u.Path {
+		u.Path = path
+		u.RawPath = ""
+	}
+}
+
+func (p *AuthProxy) initRoutes() error {
+	p.routes = nil
+	for i := range p.Upstreams {
+		rt, err := compileRoute(&p.Upstreams[i])
+		if err != nil {
+			return err
+		}
+		p.routes = append(p.routes, rt)
+	}
+	slices.SortStableFunc(p.routes, func(a, b *route) int {
+		return b.upstream.Priority - a.upstream.Priority
+	})
+	return nil
+}
+
+// matchRoute returns the first route matching the request, or nil.
+func (p *AuthProxy) matchRoute(r *http.Request) *route {
+	for _, rt := range p.routes {
+		if rt.matches(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// label returns the metrics label of the route, unmatchedUpstream for nil.
+func (rt *route) label() string {
+	if rt == nil {
+		return unmatchedUpstream
+	}
+	return rt.upstream.Label()
+}
+
+func routeFromState(st *s.State) *route {
+	if st == nil {
+		return nil
+	}
+	v, _ := st.Get(routeStateKey)
+	rt, _ := v.(*route)
+	return rt
+}
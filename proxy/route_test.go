@@ -0,0 +1,255 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/metrics"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+// newBackend starts a backend serving handler, closed with the test.
+func newBackend(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// echoHandler answers with name, the request method and path, followed by the request
+// body when there is one.
+func echoHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reply := name + " " + r.Method + " " + r.URL.Path
+		if body, _ := io.ReadAll(r.Body); len(body) > 0 {
+			reply += " " + string(body)
+		}
+		_, _ = io.WriteString(w, reply)
+	}
+}
+
+// serve sends a request with header and body through the proxy and returns the
+// response status and body.
+func serve(t *testing.T, p *proxy.AuthProxy, method, target string, header http.Header, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestRoutingByPathPrefixAndPriority(t *testing.T) {
+	api := newBackend(t, echoHandler("api"))
+	app := newBackend(t, echoHandler("app"))
+	admin := newBackend(t, echoHandler("admin"))
+
+	p := &proxy.AuthProxy{
+		Metadata: manifest.ObjectMeta{Name: "routing"},
+		Prefix:   "/_",
+		Upstreams: []proxy.Upstream{
+			{Name: "app", Target: app.URL, Match: proxy.RouteMatch{Hosts: []string{"example.test", "::1"}}},
+			{Name: "api", Target: api.URL + "/v1", Priority: 10, StripPrefix: true, Match: proxy.RouteMatch{Hosts: []string{"example.test"}, PathPrefix: "/api"}},
+			{Name: "admin", Target: admin.URL, Priority: 20, Match: proxy.RouteMatch{
+				PathRegex: "^/api/admin/",
+				Methods:   []string{"POST"},
+				Headers:   map[string]string{"X-Admin": ""},
+			}, PathRewrite: &proxy.PathRewrite{Pattern: "^/api/admin/(.*)$", Replacement: "/manage/$1"}},
+		},
+	}
+	if err := p.Init(module.NewRegistry(), nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		want   string
+	}{
+		{"prefix stripped", "GET", "http://example.test/api/users", nil, "api GET /v1/users"},
+		{"fallback route", "GET", "http://example.test/index.html", nil, "app GET /index.html"},
+		{"host with port", "GET", "http://example.test:8443/", nil, "app GET /"},
+		{"IPv6 host with port", "GET", "http://[::1]:8443/", nil, "app GET /"},
+		{"prefix only", "GET", "http://example.test/api", nil, "api GET /v1/"},
+		{"prefix is not a path segment", "GET", "http://example.test/apidocs", nil, "app GET /apidocs"},
+		{"method and header rewrite", "POST", "http://other.test/api/admin/users", http.Header{"X-Admin": {"1"}}, "admin POST /manage/users"},
+		{"missing header", "POST", "http://example.test/api/admin/users", nil, "api POST /v1/admin/users"},
+	}
+	for _, tc := range cases {
+		code, body := serve(t, p, tc.method, tc.target, tc.header, "")
+		if code != http.StatusOK || body != tc.want {
+			t.Fatalf("%s: got %d %q, want %q", tc.name, code, body, tc.want)
+		}
+	}
+}
+
+func TestRequestMetricsLabeledByRoute(t *testing.T) {
+	api := newBackend(t, echoHandler("api"))
+	p := &proxy.AuthProxy{
+		Metadata:  manifest.ObjectMeta{Name: "labeled"},
+		Prefix:    "/_",
+		Upstreams: []proxy.Upstream{{Name: "api", Target: api.URL, Match: proxy.RouteMatch{PathPrefix: "/api"}}},
+	}
+	if err := p.Init(module.NewRegistry(), nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	serve(t, p, http.MethodGet, "http://example.test/api/users", nil, "")
+	serve(t, p, http.MethodGet, "http://example.test/other", nil, "")
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, series := range []string{
+		`axproxy_http_requests_total{proxy="labeled",upstream="api",status_class="2xx"} 1`,
+		`axproxy_http_requests_total{proxy="labeled",upstream="unmatched",status_class="4xx"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), series) {
+			t.Fatalf("expected %s in\n%s", series, rec.Body.String())
+		}
+	}
+}
+
+func TestRoutingQueryMatch(t *testing.T) {
+	beta := newBackend(t, echoHandler("beta"))
+	stable := newBackend(t, echoHandler("stable"))
+
+	p := &proxy.AuthProxy{
+		Metadata: manifest.ObjectMeta{Name: "query"},
+		Prefix:   "/_",
+		Upstreams: []proxy.Upstream{
+			{Name: "beta", Target: beta.URL, Priority: 1, Match: proxy.RouteMatch{Query: map[string]string{"channel": "beta"}}},
+			{Name: "stable", Target: stable.URL},
+		},
+	}
+	if err := p.Init(module.NewRegistry(), nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	if _, body := serve(t, p, "GET", "http://example.test/x?channel=beta", nil, ""); body != "beta GET /x" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if _, body := serve(t, p, "GET", "http://example.test/x?channel=stable", nil, ""); body != "stable GET /x" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+// chainTagModule appends its name to the X-Chain response header of the
+// requests it wraps and serves /tag/<name> as special route.
+type chainTagModule struct {
+	module.NoopModule
+	name string
+}
+
+func (m chainTagModule) Kind() string { return "ChainTag" }
+func (m chainTagModule) Name() string { return m.name }
+
+func (m chainTagModule) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Chain", m.name)
+		next(w, r)
+	}
+}
+
+func (m chainTagModule) SpecialRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{"/tag/" + m.name: func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, m.name)
+	}}
+}
+
+func TestSpecialRoutesWrappedByDeclaringChain(t *testing.T) {
+	api := newBackend(t, echoHandler("api"))
+	reg := module.NewRegistry()
+	for _, name := range []string{"outer", "inner", "override"} {
+		reg.Register(chainTagModule{name: name})
+	}
+	step := func(name string) proxy.Step {
+		return proxy.Step{ModuleRef: proxy.ModuleRef{Kind: "ChainTag", Name: name}}
+	}
+	p := &proxy.AuthProxy{
+		Metadata:  manifest.ObjectMeta{Name: "override"},
+		Prefix:    "/_",
+		Upstreams: []proxy.Upstream{{Name: "api", Target: api.URL, Chain: []proxy.Step{step("inner"), step("override")}}},
+		Chain:     []proxy.Step{step("outer")},
+	}
+	if err := p.Init(reg, nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+
+	cases := []struct {
+		path  string
+		chain []string
+	}{
+		{"/_/tag/outer", []string{"outer"}},
+		{"/_/tag/override", []string{"inner", "override"}},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://example.test"+tc.path, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if got := rec.Header().Values("X-Chain"); rec.Code != http.StatusOK || !slices.Equal(got, tc.chain) {
+			t.Fatalf("%s: expected chain %v, got %d %v", tc.path, tc.chain, rec.Code, got)
+		}
+	}
+}
+
+func TestRoutingInvalidConfig(t *testing.T) {
+	p := &proxy.AuthProxy{
+		Metadata:  manifest.ObjectMeta{Name: "invalid"},
+		Upstreams: []proxy.Upstream{{Name: "bad", Target: "http://localhost", StripPrefix: true}},
+	}
+	if err := p.Init(module.NewRegistry(), nil); err == nil {
+		t.Fatalf("expected strip_prefix without path_prefix to be rejected")
+	}
+}
+
+func TestFallback(t *testing.T) {
+	known := newBackend(t, echoHandler("known"))
+	other := newBackend(t, echoHandler("other"))
+	upstreams := []proxy.Upstream{{Name: "known", Target: known.URL, Match: proxy.RouteMatch{Hosts: []string{"known.test"}}}}
+
+	cases := []struct {
+		name     string
+		fallback proxy.Fallback
+		wantCode int
+		wantBody string
+		wantLoc  string
+	}{
+		{"default", proxy.Fallback{}, http.StatusNotFound, "no upstream configured for host unknown.test\n", ""},
+		{"misdirected", proxy.Fallback{Status: http.StatusMisdirectedRequest, Body: "{{.Method}} {{.Host}}{{.URI}}"}, http.StatusMisdirectedRequest, "GET unknown.test/a?b=c", ""},
+		{"html escaped", proxy.Fallback{Body: "<p>{{.Host}}</p>", ContentType: "text/html"}, http.StatusNotFound, "<p>unknown.test</p>", ""},
+		{"redirect", proxy.Fallback{Action: proxy.FallbackRedirect, RedirectURL: "https://known.test{{.URI}}"}, http.StatusFound, "", "https://known.test/a?b=c"},
+		{"upstream", proxy.Fallback{Action: proxy.FallbackUpstream, Target: other.URL}, http.StatusOK, "other GET /a", ""},
+	}
+	for _, tc := range cases {
+		p := &proxy.AuthProxy{
+			Metadata:  manifest.ObjectMeta{Name: "fallback"},
+			Prefix:    "/_",
+			Upstreams: upstreams,
+			Fallback:  tc.fallback,
+		}
+		if err := p.Init(module.NewRegistry(), nil); err != nil {
+			t.Fatalf("%s: Init error: %v", tc.name, err)
+		}
+		req := httptest.NewRequest("GET", "http://unknown.test/a?b=c", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Fatalf("%s: got status %d, want %d", tc.name, rec.Code, tc.wantCode)
+		}
+		if tc.wantBody != "" && rec.Body.String() != tc.wantBody {
+			t.Fatalf("%s: got body %q, want %q", tc.name, rec.Body.String(), tc.wantBody)
+		}
+		if loc := rec.Header().Get("Location"); loc != tc.wantLoc {
+			t.Fatalf("%s: got location %q, want %q", tc.name, loc, tc.wantLoc)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/axent-pl/axproxy/module"
+	s "github.com/axent-pl/axproxy/state"
+)
+
+// skipStreaming bypasses the response hook of a module that buffers bodies
+// when the response is streamed, so Server-Sent Events, long polling, large
+// downloads and upgraded connections are relayed as they arrive.
+func skipStreaming(mod module.Module, hook, next module.ProxyModifyResponseHandlerFunc) module.ProxyModifyResponseHandlerFunc {
+	return func(resp *http.Response, st *s.State) error {
+		if module.IsStreaming(resp) {
+			slog.Debug("Streaming response, skipping buffering module", "request_id", st.RequestID, "module_kind", mod.Kind(), "module_name", mod.Name())
+			return next(resp, st)
+		}
+		return hook(resp, st)
+	}
+}
@@ -0,0 +1,156 @@
+package proxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+	"github.com/axent-pl/axproxy/state"
+)
+
+// bufferingModule requires an X-Auth header and upper-cases response bodies,
+// which it reads whole.
+type bufferingModule struct {
+	module.NoopModule
+}
+
+func (bufferingModule) Kind() string              { return "Buffering" }
+func (bufferingModule) Name() string              { return "upper" }
+func (bufferingModule) BuffersResponseBody() bool { return true }
+
+func (bufferingModule) ProxyMiddleware(next module.ProxyHandlerFunc) module.ProxyHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, st *state.State) {
+		if r.Header.Get("X-Auth") == "" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		next(w, r, st)
+	}
+}
+
+func (bufferingModule) ProxyModifyResponseMiddleware(next module.ProxyModifyResponseHandlerFunc) module.ProxyModifyResponseHandlerFunc {
+	return func(resp *http.Response, st *state.State) error {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		upper := strings.ToUpper(string(body))
+		resp.Body = io.NopCloser(strings.NewReader(upper))
+		resp.ContentLength = int64(len(upper))
+		resp.Header.Del("Content-Length")
+		return next(resp, st)
+	}
+}
+
+func newStreamingProxy(t *testing.T, backend http.Handler) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+	reg := module.NewRegistry()
+	reg.Register(bufferingModule{})
+	p := &proxy.AuthProxy{
+		Metadata:  manifest.ObjectMeta{Name: "streaming"},
+		Prefix:    "/_",
+		Upstreams: []proxy.Upstream{{Name: "app", Target: upstream.URL}},
+		Chain:     []proxy.Step{{ModuleRef: proxy.ModuleRef{Kind: "Buffering", Name: "upper"}}},
+	}
+	if err := p.Init(reg, nil); err != nil {
+		t.Fatalf("Init error: %v", err)
+	}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamingResponseBypassesBufferingModule(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := newStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+
+	// The upstream never completes, so the event only arrives within the
+	// client timeout when it is streamed.
+	client := &http.Client{Timeout: 2 * time.Second}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	req.Header.Set("X-Auth", "token")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("event was not streamed: %v", err)
+	}
+	defer resp.Body.Close()
+	if line, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil || line != "data: one\n" {
+		t.Fatalf("event was not streamed: %q %v", line, err)
+	}
+}
+
+func TestBufferedResponseRunsBufferingModule(t *testing.T) {
+	srv := newStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	req.Header.Set("X-Auth", "token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "HELLO" {
+		t.Fatalf("expected buffered body to be rewritten, got %q", body)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	srv := newStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+		msg, _ := brw.ReadString('\n')
+		_, _ = brw.WriteString(msg)
+		_ = brw.Flush()
+	}))
+
+	handshake := func(auth string) (*http.Response, net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n"+auth+"\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read handshake: %v", err)
+		}
+		return resp, conn, br
+	}
+
+	if resp, _, _ := handshake(""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthenticated handshake to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp, conn, br := handshake("X-Auth: token\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected protocol switch, got %d", resp.StatusCode)
+	}
+	_, _ = io.WriteString(conn, "ping\n")
+	if msg, err := br.ReadString('\n'); err != nil || msg != "ping\n" {
+		t.Fatalf("expected echo over upgraded connection, got %q %v", msg, err)
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/axent-pl/axproxy/utils"
+)
+
+// UpstreamTLS configures the TLS client used towards the upstream targets.
+// ServerName overrides the name sent in SNI and verified against the
+// certificate. PinnedSPKI lists base64 SHA-256 digests of the accepted
+// certificate public keys; when set, the leaf certificate must match one of
+// them.
+type UpstreamTLS struct {
+	CAFile             string   `yaml:"ca_file"`
+	ClientCertFile     string   `yaml:"client_cert_file"`
+	ClientKeyFile      string   `yaml:"client_key_file"`
+	ServerName         string   `yaml:"server_name"`
+	MinVersion         string   `yaml:"min_version"`
+	PinnedSPKI         []string `yaml:"pinned_spki_sha256"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func buildUpstreamTLSConfig(cfg *UpstreamTLS) (*tls.Config, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls: unsupported min_version %q", cfg.MinVersion)
+		}
+		tlsCfg.MinVersion = v
+	}
+
+	if err := utils.LoadClientTLSFiles(tlsCfg, cfg.CAFile, cfg.ClientCertFile, cfg.ClientKeyFile); err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	if len(cfg.PinnedSPKI) > 0 {
+		pins := make([]string, 0, len(cfg.PinnedSPKI))
+		for _, pin := range cfg.PinnedSPKI {
+			pin = strings.TrimPrefix(pin, "sha256/")
+			if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("tls: invalid pinned_spki_sha256 %q", pin)
+			}
+			pins = append(pins, pin)
+		}
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("tls: no peer certificate to match the pinned keys")
+			}
+			if !slices.Contains(pins, SPKIFingerprint(cs.PeerCertificates[0])) {
+				return fmt.Errorf("tls: certificate public key of %s does not match any pinned key", cs.PeerCertificates[0].Subject)
+			}
+			return nil
+		}
+	}
+
+	if cfg.InsecureSkipVerify {
+		slog.Warn("Upstream TLS certificate verification disabled", "server_name", cfg.ServerName, "pinned", len(cfg.PinnedSPKI) > 0)
+	}
+
+	return tlsCfg, nil
+}
+
+// SPKIFingerprint returns the base64 SHA-256 digest of the certificate public
+// key, as used by UpstreamTLS.PinnedSPKI.
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
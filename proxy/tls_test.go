@@ -0,0 +1,129 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+func newTLSBackend(t *testing.T, clientAuth tls.ClientAuthType) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := "anonymous"
+		if len(r.TLS.PeerCertificates) > 0 {
+			client = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		_, _ = io.WriteString(w, "tls "+client)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: clientAuth}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+}
+
+func newClientCert(t *testing.T, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return writePEM(t, "client.pem", "CERTIFICATE", der), writePEM(t, "client.key", "PRIVATE KEY", keyDER)
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	srv, caFile := newTLSBackend(t, tls.NoClientCert)
+	pin := proxy.SPKIFingerprint(srv.Certificate())
+
+	cases := []struct {
+		name     string
+		tls      *proxy.UpstreamTLS
+		wantCode int
+	}{
+		{"unknown authority", nil, http.StatusBadGateway},
+		{"custom ca", &proxy.UpstreamTLS{CAFile: caFile}, http.StatusOK},
+		{"server name override", &proxy.UpstreamTLS{CAFile: caFile, ServerName: "example.com"}, http.StatusOK},
+		{"server name mismatch", &proxy.UpstreamTLS{CAFile: caFile, ServerName: "other.test"}, http.StatusBadGateway},
+		{"pinned key", &proxy.UpstreamTLS{CAFile: caFile, PinnedSPKI: []string{"sha256/" + pin}}, http.StatusOK},
+		{"pin mismatch", &proxy.UpstreamTLS{InsecureSkipVerify: true, PinnedSPKI: []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}, http.StatusBadGateway},
+		{"insecure", &proxy.UpstreamTLS{InsecureSkipVerify: true}, http.StatusOK},
+	}
+	for _, tc := range cases {
+		p := newPool(t, proxy.Upstream{Name: "tls", Target: srv.URL, TLS: tc.tls})
+		if code, body := serve(t, p, http.MethodGet, "http://example.test/", nil, ""); code != tc.wantCode {
+			t.Fatalf("%s: got %d %q, want %d", tc.name, code, body, tc.wantCode)
+		}
+	}
+}
+
+func TestUpstreamTLSClientCertificate(t *testing.T) {
+	srv, caFile := newTLSBackend(t, tls.RequireAnyClientCert)
+	certFile, keyFile := newClientCert(t, "axproxy")
+
+	p := newPool(t, proxy.Upstream{Name: "mtls", Target: srv.URL, TLS: &proxy.UpstreamTLS{CAFile: caFile}})
+	if code, _ := serve(t, p, http.MethodGet, "http://example.test/", nil, ""); code != http.StatusBadGateway {
+		t.Fatalf("expected handshake without client certificate to fail, got %d", code)
+	}
+
+	p = newPool(t, proxy.Upstream{Name: "mtls", Target: srv.URL, TLS: &proxy.UpstreamTLS{
+		CAFile:         caFile,
+		ClientCertFile: certFile,
+		ClientKeyFile:  keyFile,
+		MinVersion:     "1.3",
+	}})
+	if code, body := serve(t, p, http.MethodGet, "http://example.test/", nil, ""); code != http.StatusOK || body != "tls axproxy" {
+		t.Fatalf("got %d %q", code, body)
+	}
+}
+
+func TestUpstreamTLSInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]*proxy.UpstreamTLS{
+		"min version": {MinVersion: "2.0"},
+		"missing key": {ClientCertFile: "client.pem"},
+		"missing ca":  {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"invalid pin": {PinnedSPKI: []string{"not-a-digest"}},
+	} {
+		p := &proxy.AuthProxy{Upstreams: []proxy.Upstream{{Target: "https://a.test", TLS: cfg}}}
+		if err := p.Init(module.NewRegistry(), nil); err == nil {
+			t.Fatalf("%s: expected config to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/axent-pl/axproxy/module"
+	s "github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/tracing"
+)
+
+const upstreamSpanStateKey = "proxy.upstream_span"
+
+// traceServer continues the trace of the incoming request, or starts a new one,
+// and wraps the whole request in a server span.
+func (p *AuthProxy) traceServer(w *statusWriter, r *http.Request, next http.Handler) {
+	ctx := r.Context()
+	if sc, ok := tracing.Extract(r.Header); ok {
+		ctx = tracing.ContextWithRemoteSpanContext(ctx, sc)
+	}
+	ctx, span := tracing.Start(ctx, "proxy "+p.Metadata.Name, tracing.SpanKindServer)
+	defer span.End()
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("server.address", r.Host)
+	span.SetAttribute("axproxy.proxy", p.Metadata.Name)
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+
+	span.SetAttribute("http.response.status_code", w.status)
+	if w.status >= http.StatusInternalServerError {
+		span.RecordError(fmt.Errorf("status %d", w.status))
+	}
+}
+
+// traceStep wraps a chain step so that it runs in its own span. The span covers
+// the step and every step after it.
+func traceStep(mod module.Module, next module.ProxyHandlerFunc) module.ProxyHandlerFunc {
+	name := "module " + mod.Kind() + "/" + mod.Name()
+	return func(w http.ResponseWriter, r *http.Request, st *s.State) {
+		ctx, span := tracing.Start(r.Context(), name, tracing.SpanKindInternal)
+		defer span.End()
+		span.SetAttribute("axproxy.module.kind", mod.Kind())
+		span.SetAttribute("axproxy.module.name", mod.Name())
+		next(w, r.WithContext(ctx), st)
+	}
+}
+
+// startUpstreamSpan starts the client span of the upstream round trip and
+// propagates it in the outgoing request headers.
+func (p *AuthProxy) startUpstreamSpan(r *http.Request, st *s.State) {
+	ctx, span := tracing.Start(r.Context(), "upstream "+r.Method, tracing.SpanKindClient)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("server.address", r.URL.Host)
+	span.SetAttribute("url.full", r.URL.String())
+	tracing.InjectContext(ctx, r.Header)
+	if st != nil {
+		st.Set(upstreamSpanStateKey, span)
+	}
+}
+
+func endUpstreamSpan(st *s.State, status int, err error) {
+	if st == nil {
+		return
+	}
+	v, ok := st.Get(upstreamSpanStateKey)
+	if !ok {
+		return
+	}
+	span, _ := v.(*tracing.Span)
+	span.SetAttribute("http.response.status_code", status)
+	span.RecordError(err)
+	span.End()
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	s "github.com/axent-pl/axproxy/state"
+)
+
+const (
+	defaultRetryAttempts     = 2
+	defaultRetryMaxBodyBytes = 64 * 1024
+)
+
+// UpstreamTimeouts bounds the round trips to the upstream targets. Zero values
+// keep the net/http defaults.
+type UpstreamTimeouts struct {
+	Dial           time.Duration `yaml:"dial"`
+	TLSHandshake   time.Duration `yaml:"tls_handshake"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	IdleConn       time.Duration `yaml:"idle_conn"`
+}
+
+const (
+	UpstreamProtocolAuto = ""
+	UpstreamProtocolH2   = "h2"
+	UpstreamProtocolH2C  = "h2c"
+)
+
+// validateUpstreamProtocol checks that the targets of an upstream can be reached
+// with its protocol. The default negotiates HTTP/2 over TLS and speaks HTTP/1.1
+// otherwise, h2 requires HTTP/2 over TLS and h2c speaks HTTP/2 with prior
+// knowledge over cleartext, as gRPC servers without TLS expect.
+func validateUpstreamProtocol(u *Upstream) error {
+	var scheme string
+	switch u.Protocol {
+	case UpstreamProtocolAuto:
+		return nil
+	case UpstreamProtocolH2:
+		scheme = "https"
+	case UpstreamProtocolH2C:
+		scheme = "http"
+	default:
+		return fmt.Errorf("unsupported protocol %q", u.Protocol)
+	}
+	targets := []string{u.Target}
+	for _, t := range u.Targets {
+		targets = append(targets, t.URL)
+	}
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		if tu, err := url.Parse(target); err == nil && tu.Scheme != scheme {
+			return fmt.Errorf("protocol %s requires %s targets, got %s", u.Protocol, scheme, target)
+		}
+	}
+	return nil
+}
+
+// RetryPolicy retries idempotent requests on connection failures and on the
+// listed response statuses, each time on a newly picked target. Request bodies up
+// to MaxBodyBytes are buffered for replay; larger bodies are sent once.
+type RetryPolicy struct {
+	Attempts     int           `yaml:"attempts"`
+	OnStatus     []int         `yaml:"on_status"`
+	Backoff      time.Duration `yaml:"backoff"`
+	MaxBodyBytes int64         `yaml:"max_body_bytes"`
+}
+
+func (rp *RetryPolicy) validate() error {
+	if rp.Attempts < 0 || rp.Backoff < 0 || rp.MaxBodyBytes < 0 {
+		return fmt.Errorf("retry: attempts, backoff and max_body_bytes must not be negative")
+	}
+	for _, code := range rp.OnStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retry: invalid status %d", code)
+		}
+	}
+	return nil
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.Attempts == 0 {
+		rp.Attempts = defaultRetryAttempts
+	}
+	if rp.MaxBodyBytes == 0 {
+		rp.MaxBodyBytes = defaultRetryMaxBodyBytes
+	}
+	return rp
+}
+
+func (rp *RetryPolicy) retryStatus(code int) bool {
+	return slices.Contains(rp.OnStatus, code)
+}
+
+func newUpstreamTransport(t UpstreamTimeouts, tlsCfg *tls.Config, protocol string) (*http.Transport, error) {
+	if t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.IdleConn < 0 {
+		return nil, fmt.Errorf("timeouts must not be negative")
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if t.Dial > 0 {
+		dialer := &net.Dialer{Timeout: t.Dial, KeepAlive: 30 * time.Second}
+		tr.DialContext = dialer.DialContext
+	}
+	if t.TLSHandshake > 0 {
+		tr.TLSHandshakeTimeout = t.TLSHandshake
+	}
+	if t.ResponseHeader > 0 {
+		tr.ResponseHeaderTimeout = t.ResponseHeader
+	}
+	if t.IdleConn > 0 {
+		tr.IdleConnTimeout = t.IdleConn
+	}
+	if tlsCfg != nil {
+		tr.TLSClientConfig = tlsCfg
+	}
+	switch protocol {
+	case UpstreamProtocolH2:
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP2(true)
+	case UpstreamProtocolH2C:
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return tr, nil
+}
+
+// CloseIdleConnections closes the idle upstream connections of every route. A
+// reload builds new transports, so the retired proxy releases its connections.
+func (p *AuthProxy) CloseIdleConnections() {
+	for _, rt := range p.routes {
+		rt.transport.CloseIdleConnections()
+	}
+	if p.fallback != nil && p.fallback.route != nil {
+		p.fallback.route.transport.CloseIdleConnections()
+	}
+}
+
+// upstreamTransport sends requests through the transport of the route they were
+// matched to and applies its retry policy.
+type upstreamTransport struct{}
+
+func (upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	st := s.GetState(req.Context())
+	rt := routeFromState(st)
+	if rt == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	pt := pickedTargetFromState(st)
+	if rt.retry == nil || pt == nil || !idempotent(req.Method) {
+		return rt.transport.RoundTrip(req)
+	}
+
+	replay, err := bufferBody(req, rt.retry.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		if replay != nil {
+			req.Body = io.NopCloser(bytes.NewReader(replay))
+		}
+		resp, err := rt.transport.RoundTrip(req)
+		last := attempt >= rt.retry.Attempts || (req.Body != nil && req.Body != http.NoBody && replay == nil)
+		if last || !shouldRetry(req.Context(), rt.retry, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, defaultRetryMaxBodyBytes))
+			resp.Body.Close()
+		}
+		upstreamRetriesTotal.Inc(rt.label())
+		if rt.retry.Backoff > 0 {
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(rt.retry.Backoff):
+			}
+		}
+		req = pt.repick(req, st)
+	}
+}
+
+func shouldRetry(ctx context.Context, rp *RetryPolicy, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil && !errors.Is(err, context.Canceled)
+	}
+	return rp.retryStatus(resp.StatusCode)
+}
+
+// bufferBody reads a request body of up to limit bytes so it can be replayed. It
+// returns nil, leaving the body readable, when the body is empty or larger.
+func bufferBody(req *http.Request, limit int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.ContentLength > limit {
+		return nil, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, nil
+	}
+	_ = req.Body.Close()
+	return buf, nil
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
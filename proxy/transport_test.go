@@ -0,0 +1,202 @@
+package proxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+// failingHandler counts its requests in hits and answers them with status.
+func failingHandler(status int, hits *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+		http.Error(w, "failing", status)
+	}
+}
+
+func TestRetryOnStatusReplaysBody(t *testing.T) {
+	var hits atomic.Int32
+	failing := newBackend(t, failingHandler(http.StatusServiceUnavailable, &hits))
+	echo := newBackend(t, echoHandler("echo"))
+	p := newPool(t, proxy.Upstream{
+		Name:    "pool",
+		Targets: []proxy.Target{{URL: failing.URL}, {URL: echo.URL}},
+		Retry:   &proxy.RetryPolicy{OnStatus: []int{http.StatusServiceUnavailable}},
+	})
+
+	for i := 0; i < 4; i++ {
+		code, body := serve(t, p, http.MethodPut, "http://example.test/items", nil, "payload")
+		if code != http.StatusOK || body != "echo PUT /items payload" {
+			t.Fatalf("attempt %d: got %d %q", i, code, body)
+		}
+	}
+	if hits.Load() == 0 {
+		t.Fatalf("expected failing target to be tried")
+	}
+}
+
+func TestRetrySkipsNonIdempotentMethods(t *testing.T) {
+	var hits atomic.Int32
+	failing := newBackend(t, failingHandler(http.StatusServiceUnavailable, &hits))
+	p := newPool(t, proxy.Upstream{
+		Name:   "pool",
+		Target: failing.URL,
+		Retry:  &proxy.RetryPolicy{Attempts: 3, OnStatus: []int{http.StatusServiceUnavailable}},
+	})
+
+	if code, _ := serve(t, p, http.MethodPost, "http://example.test/items", nil, "payload"); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("expected a single attempt, got %d", hits.Load())
+	}
+	if code, _ := serve(t, p, http.MethodGet, "http://example.test/items", nil, ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if hits.Load() != 4 {
+		t.Fatalf("expected three attempts for GET, got %d", hits.Load()-1)
+	}
+}
+
+func TestRetryOnConnectionFailure(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	echo := newBackend(t, echoHandler("echo"))
+	p := newPool(t, proxy.Upstream{
+		Name:    "pool",
+		Targets: []proxy.Target{{URL: closed.URL}, {URL: echo.URL}},
+		Retry:   &proxy.RetryPolicy{},
+	})
+
+	for i := 0; i < 4; i++ {
+		if code, body := serve(t, p, http.MethodGet, "http://example.test/items", nil, ""); code != http.StatusOK {
+			t.Fatalf("attempt %d: got %d %q", i, code, body)
+		}
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	slow := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	p := newPool(t, proxy.Upstream{
+		Name:     "slow",
+		Target:   slow.URL,
+		Timeouts: proxy.UpstreamTimeouts{ResponseHeader: 20 * time.Millisecond},
+	})
+
+	if code, _ := serve(t, p, http.MethodGet, "http://example.test/items", nil, ""); code != http.StatusBadGateway {
+		t.Fatalf("expected timeout to answer 502, got %d", code)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	failing := newBackend(t, failingHandler(http.StatusInternalServerError, &hits))
+	p := newPool(t, proxy.Upstream{
+		Name:   "pool",
+		Target: failing.URL,
+		CircuitBreaker: &proxy.CircuitBreaker{
+			ConsecutiveFailures: 2,
+			OpenDuration:        50 * time.Millisecond,
+			Body:                "circuit open",
+		},
+	})
+
+	serve(t, p, http.MethodGet, "http://example.test/items", nil, "")
+	serve(t, p, http.MethodGet, "http://example.test/items", nil, "")
+	code, body := serve(t, p, http.MethodGet, "http://example.test/items", nil, "")
+	if code != http.StatusServiceUnavailable || body != "circuit open" {
+		t.Fatalf("expected open circuit, got %d %q", code, body)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("expected open circuit to skip the upstream, got %d hits", hits.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if code, _ := serve(t, p, http.MethodGet, "http://example.test/items", nil, ""); code != http.StatusInternalServerError {
+		t.Fatalf("expected trial request to reach the upstream, got %d", code)
+	}
+	if code, _ := serve(t, p, http.MethodGet, "http://example.test/items", nil, ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected failed trial to reopen the circuit, got %d", code)
+	}
+}
+
+func TestCircuitBreakerAbortedTrial(t *testing.T) {
+	var abort atomic.Bool
+	var hits atomic.Int32
+	failing := failingHandler(http.StatusInternalServerError, &hits)
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if !abort.Load() {
+			failing(w, r)
+			return
+		}
+		// announce a body longer than sent, then drop the connection
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "partial")
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		_ = conn.Close()
+	})
+	p := newPool(t, proxy.Upstream{
+		Name:           "pool",
+		Target:         backend.URL,
+		CircuitBreaker: &proxy.CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: 50 * time.Millisecond},
+	})
+	front := httptest.NewServer(p)
+	t.Cleanup(front.Close)
+
+	if code, _ := serve(t, p, http.MethodGet, "http://example.test/items", nil, ""); code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status %d", code)
+	}
+	time.Sleep(60 * time.Millisecond)
+	abort.Store(true)
+	if resp, err := http.Get(front.URL + "/items"); err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Fatalf("expected the trial response to be aborted")
+		}
+	}
+
+	abort.Store(false)
+	waitFor(t, "aborted trial to end", func() bool {
+		code, _ := serve(t, p, http.MethodGet, "http://example.test/items", nil, "")
+		return code == http.StatusInternalServerError
+	})
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	var closed atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+	p := newPool(t, proxy.Upstream{Name: "pool", Target: backend.URL})
+
+	if code, _ := serve(t, p, http.MethodGet, "http://example.test/items", nil, ""); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if closed.Load() != 0 {
+		t.Fatalf("expected the upstream connection to be kept alive")
+	}
+	p.CloseIdleConnections()
+	waitFor(t, "idle upstream connection to close", func() bool { return closed.Load() == 1 })
+}
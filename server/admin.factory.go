@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+var _ manifest.KindHandler[Admin] = AdminHandler{}
+
+type AdminV1 struct {
+	manifest.TypeMeta `yaml:",inline"`
+	Metadata          manifest.ObjectMeta `yaml:"metadata"`
+	Spec              Admin               `yaml:"spec"`
+}
+
+type AdminHandler struct{}
+
+func (AdminHandler) Kind() string { return KIND_ADMIN }
+
+func (AdminHandler) Unmarshal(apiVersion string, rawYAML []byte) (Admin, error) {
+	switch apiVersion {
+	case "v1":
+		var obj AdminV1
+		if err := yaml.Unmarshal(rawYAML, &obj); err != nil {
+			return Admin{}, err
+		}
+		obj.Spec.Metadata = obj.Metadata
+		if obj.Spec.Address == "" {
+			return Admin{}, fmt.Errorf("listen address is empty")
+		}
+		return obj.Spec, nil
+	default:
+		return Admin{}, fmt.Errorf("unsupported apiVersion %q", apiVersion)
+	}
+}
+
+func init() {
+	if err := manifest.RegisterHandler(&AdminHandler{}); err != nil {
+		slog.Error("init AdminHandler", "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/metrics"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+const KIND_ADMIN string = "Admin"
+
+const adminListenerName = "admin"
+
+// Admin configures the optional administrative listener which serves the
+// liveness and readiness endpoints of every proxy with full details, the upstream
+// target states and the Prometheus metrics.
+type Admin struct {
+	Metadata    manifest.ObjectMeta  `yaml:"metadata"`
+	Address     string               `yaml:"listen"`
+	TLSCertFile string               `yaml:"tls_crt_file"`
+	TLSKeyFile  string               `yaml:"tls_key_file"`
+	Timeouts    proxy.ServerTimeouts `yaml:"timeouts"`
+}
+
+func (a *Admin) listenerConfig() listenerConfig {
+	cfg := listenerConfig{
+		name:     adminListenerName,
+		address:  a.Address,
+		mode:     proxy.ListenerPlain,
+		timeouts: a.Timeouts,
+	}
+	if a.TLSCertFile != "" {
+		cfg.mode = proxy.ListenerTLS
+		cfg.certs = []proxy.CertificateFiles{{CertFile: a.TLSCertFile, KeyFile: a.TLSKeyFile}}
+	}
+	return cfg
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /healthz", proxy.LivenessHandler())
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.Handle("GET /readyz", proxy.ReadinessHandler(s.activeProxies, true))
+	mux.HandleFunc("GET /readyz/{proxy}", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := s.activeProxy(r.PathValue("proxy"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.ReadinessHandler(func() []*proxy.AuthProxy { return []*proxy.AuthProxy{p} }, true)(w, r)
+	})
+	mux.Handle("GET /upstreams", proxy.UpstreamsHandler(s.activeProxies))
+	mux.HandleFunc("GET /upstreams/{proxy}", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := s.activeProxy(r.PathValue("proxy"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.UpstreamsHandler(func() []*proxy.AuthProxy { return []*proxy.AuthProxy{p} })(w, r)
+	})
+	return mux
+}
+
+// activeProxy returns the named proxy of the active generation.
+func (s *Server) activeProxy(name string) (*proxy.AuthProxy, bool) {
+	gen := s.generation.Load()
+	if gen == nil {
+		return nil, false
+	}
+	p, ok := gen.proxies[name]
+	return p, ok
+}
+
+// activeProxies returns the proxies of the active generation sorted by name.
+func (s *Server) activeProxies() []*proxy.AuthProxy {
+	gen := s.generation.Load()
+	if gen == nil {
+		return nil
+	}
+	out := make([]*proxy.AuthProxy, 0, len(gen.proxies))
+	for _, p := range gen.proxies {
+		out = append(out, p)
+	}
+	slices.SortFunc(out, func(a, b *proxy.AuthProxy) int {
+		return strings.Compare(a.Metadata.Name, b.Metadata.Name)
+	})
+	return out
+}
@@ -0,0 +1,90 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+type readiness struct {
+	Status  string `json:"status"`
+	Proxies []struct {
+		Name    string `json:"name"`
+		Status  string `json:"status"`
+		Modules []struct {
+			Name     string `json:"name"`
+			Status   string `json:"status"`
+			Error    string `json:"error"`
+			Attempts int    `json:"start_attempts"`
+		} `json:"modules"`
+		Upstreams []struct {
+			Target string `json:"target"`
+			Status string `json:"status"`
+		} `json:"upstreams"`
+	} `json:"proxies"`
+}
+
+func adminDoc(addr string) string {
+	return fmt.Sprintf("apiVersion: v1\nkind: Admin\nmetadata:\n  name: admin\nspec:\n  listen: %q\n", addr)
+}
+
+func getReadiness(t *testing.T, url string) (int, readiness) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var out readiness
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode readiness: %v", err)
+	}
+	return resp.StatusCode, out
+}
+
+func TestAdminReadinessAggregatesProxies(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	adminAddr, addrA, addrB := freeAddr(t), freeAddr(t), freeAddr(t)
+	dir := t.TempDir()
+
+	writeConfig(t, dir,
+		adminDoc(adminAddr),
+		probeDoc("ok", "1"),
+		probeDoc("broken", "1")+"  start_error: backend unavailable\n",
+		proxyDoc("a", addrA, backend.URL, "Probe/ok"),
+		proxyDoc("b", addrB, backend.URL, "Probe/ok", "Probe/broken"),
+	)
+	newServer(t, dir)
+
+	code, got := getReadiness(t, "http://"+adminAddr+"/readyz")
+	if code != http.StatusServiceUnavailable || got.Status != "not_ready" {
+		t.Fatalf("expected 503 not_ready with a degraded proxy, got %d %q", code, got.Status)
+	}
+	if len(got.Proxies) != 2 || got.Proxies[0].Name != "a" || got.Proxies[1].Name != "b" {
+		t.Fatalf("expected details of proxies a and b, got %+v", got.Proxies)
+	}
+	if a := got.Proxies[0]; a.Status != "running" || len(a.Modules) != 1 || len(a.Upstreams) != 1 || a.Upstreams[0].Status != "running" {
+		t.Fatalf("expected proxy a to be running, got %+v", a)
+	}
+	b := got.Proxies[1]
+	if b.Status != "degraded" || len(b.Modules) != 2 {
+		t.Fatalf("expected proxy b to be degraded with two modules, got %+v", b)
+	}
+	if m := b.Modules[1]; m.Name != "broken" || m.Status != "degraded" || m.Error != "backend unavailable" || m.Attempts != 1 {
+		t.Fatalf("expected failed start of broken in the details, got %+v", m)
+	}
+
+	code, got = getReadiness(t, "http://"+adminAddr+"/readyz/a")
+	if code != http.StatusOK || got.Status != "ready" || len(got.Proxies) != 1 {
+		t.Fatalf("expected proxy a alone to be ready, got %d %+v", code, got)
+	}
+	resp, err := http.Get("http://" + adminAddr + "/readyz/missing")
+	if err != nil {
+		t.Fatalf("GET /readyz/missing: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown proxy, got %d", resp.StatusCode)
+	}
+}
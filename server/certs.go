@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+const (
+	certReloadInterval = 10 * time.Second
+	certExpiryWarning  = 30 * 24 * time.Hour
+	certWarnInterval   = 24 * time.Hour
+)
+
+// certStore serves the certificates of a tls listener by SNI and reloads them
+// when the files change on disk. A certificate that fails to reload keeps being
+// served until the files are fixed.
+type certStore struct {
+	listener string
+
+	mu    sync.RWMutex
+	certs []*loadedCert
+}
+
+type loadedCert struct {
+	files    proxy.CertificateFiles
+	cert     *tls.Certificate
+	names    []string
+	notAfter time.Time
+	modTime  time.Time
+	warnedAt time.Time
+}
+
+// newCertStore loads the certificates of a listener. Their expiry is exported
+// by observeAll once the listener serves.
+func newCertStore(listener string, files []proxy.CertificateFiles) (*certStore, error) {
+	cs := &certStore{listener: listener}
+	for _, f := range files {
+		lc, err := loadCert(f)
+		if err != nil {
+			return nil, err
+		}
+		cs.certs = append(cs.certs, lc)
+	}
+	if len(cs.certs) == 0 {
+		return nil, fmt.Errorf("no certificate configured")
+	}
+	return cs, nil
+}
+
+func loadCert(f proxy.CertificateFiles) (*loadedCert, error) {
+	modTime, err := certModTime(f)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate %s: %w", f.CertFile, err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("parse tls certificate %s: %w", f.CertFile, err)
+		}
+	}
+	names := make([]string, 0, len(leaf.DNSNames)+1)
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return &loadedCert{files: f, cert: &cert, names: names, notAfter: leaf.NotAfter, modTime: modTime}, nil
+}
+
+// certModTime returns the latest modification time of the certificate and key.
+func certModTime(f proxy.CertificateFiles) (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{f.CertFile, f.KeyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// getCertificate picks the certificate for the client hello: an exact name
+// match, then a wildcard match, then the first certificate.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		for _, lc := range cs.certs {
+			for _, n := range lc.names {
+				if n == name {
+					return lc.cert, nil
+				}
+			}
+		}
+		for _, lc := range cs.certs {
+			for _, n := range lc.names {
+				if wildcardMatches(n, name) {
+					return lc.cert, nil
+				}
+			}
+		}
+	}
+	return cs.certs[0].cert, nil
+}
+
+// wildcardMatches reports whether a *.example.com pattern matches exactly one
+// label in front of example.com.
+func wildcardMatches(pattern, name string) bool {
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, ok := strings.Cut(name, ".")
+	return ok && label != "" && rest == suffix
+}
+
+// reload loads the certificates whose files changed since they were loaded.
+func (cs *certStore) reload() error {
+	cs.mu.RLock()
+	certs := append([]*loadedCert(nil), cs.certs...)
+	cs.mu.RUnlock()
+
+	var errs []error
+	for i, lc := range certs {
+		modTime, err := certModTime(lc.files)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if modTime.Equal(lc.modTime) {
+			continue
+		}
+		next, err := loadCert(lc.files)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cs.mu.Lock()
+		cs.certs[i] = next
+		cs.mu.Unlock()
+		slog.Info("TLS certificate reloaded", "listener_name", cs.listener, "file", lc.files.CertFile, "not_after", next.notAfter)
+	}
+	cs.observeAll()
+	return errors.Join(errs...)
+}
+
+func (cs *certStore) observeAll() {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, lc := range cs.certs {
+		cs.observe(lc)
+	}
+}
+
+// observe exports the expiry of the certificate and warns, at most once a day,
+// when it expires within certExpiryWarning.
+func (cs *certStore) observe(lc *loadedCert) {
+	certExpiry.Set(float64(lc.notAfter.Unix()), cs.listener, lc.files.CertFile)
+	left := time.Until(lc.notAfter)
+	if left > certExpiryWarning || time.Since(lc.warnedAt) < certWarnInterval {
+		return
+	}
+	lc.warnedAt = time.Now()
+	if left <= 0 {
+		slog.Error("TLS certificate expired", "listener_name", cs.listener, "file", lc.files.CertFile, "not_after", lc.notAfter)
+		return
+	}
+	slog.Warn("TLS certificate expires soon", "listener_name", cs.listener, "file", lc.files.CertFile, "not_after", lc.notAfter, "expires_in", left.Round(time.Hour))
+}
+
+// watch reloads changed certificates every interval until ctx is done.
+func (cs *certStore) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cs.reload(); err != nil {
+				slog.Error("TLS certificate reload failed, keeping the loaded certificate", "listener_name", cs.listener, "error", err)
+			}
+		}
+	}
+}
+
+// forget removes the expiry metrics of the store.
+func (cs *certStore) forget() {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, lc := range cs.certs {
+		certExpiry.Delete(cs.listener, lc.files.CertFile)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/metrics"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+// writeCert writes a self-signed certificate for names expiring at notAfter
+// to <base>.pem and <base>.key in dir.
+func writeCert(t *testing.T, dir, base string, notAfter time.Time, names ...string) proxy.CertificateFiles {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	files := proxy.CertificateFiles{CertFile: filepath.Join(dir, base+".pem"), KeyFile: filepath.Join(dir, base+".key")}
+	for path, block := range map[string]*pem.Block{files.CertFile: {Type: "CERTIFICATE", Bytes: der}, files.KeyFile: {Type: "PRIVATE KEY", Bytes: keyDER}} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	return files
+}
+
+// touch moves the modification time of the certificate files forward so the
+// next reload picks them up.
+func touch(t *testing.T, files proxy.CertificateFiles, at time.Time) {
+	t.Helper()
+	for _, path := range []string{files.CertFile, files.KeyFile} {
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatalf("chtimes %s: %v", path, err)
+		}
+	}
+}
+
+func servedName(t *testing.T, cs *certStore, serverName string) string {
+	t.Helper()
+	cert, err := cs.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("getCertificate error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertStoreSelectsBySNI(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(24 * time.Hour)
+	cs, err := newCertStore("sni", []proxy.CertificateFiles{
+		writeCert(t, dir, "default", notAfter, "default.test"),
+		writeCert(t, dir, "wildcard", notAfter, "*.example.com"),
+		writeCert(t, dir, "api", notAfter, "api.example.com"),
+	})
+	if err != nil {
+		t.Fatalf("newCertStore error: %v", err)
+	}
+	t.Cleanup(cs.forget)
+
+	cases := []struct {
+		serverName string
+		want       string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"API.Example.com.", "api.example.com"},
+		{"www.example.com", "*.example.com"},
+		{"default.test", "default.test"},
+		{"example.com", "default.test"},
+		{"a.b.example.com", "default.test"},
+		{"", "default.test"},
+	}
+	for _, tc := range cases {
+		if got := servedName(t, cs, tc.serverName); got != tc.want {
+			t.Fatalf("%q: expected certificate %s, got %s", tc.serverName, tc.want, got)
+		}
+	}
+}
+
+func TestWildcardMatches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"www.example.com", "www.example.com", false},
+	}
+	for _, tc := range cases {
+		if got := wildcardMatches(tc.pattern, tc.name); got != tc.want {
+			t.Fatalf("wildcardMatches(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	files := writeCert(t, dir, "site", time.Now().Add(24*time.Hour), "old.test")
+	cs, err := newCertStore("reload", []proxy.CertificateFiles{files})
+	if err != nil {
+		t.Fatalf("newCertStore error: %v", err)
+	}
+	t.Cleanup(cs.forget)
+
+	if err := cs.reload(); err != nil || servedName(t, cs, "") != "old.test" {
+		t.Fatalf("expected unchanged files to keep the certificate, error %v", err)
+	}
+	writeCert(t, dir, "site", time.Now().Add(48*time.Hour), "new.test")
+	touch(t, files, time.Now().Add(time.Minute))
+	if err := cs.reload(); err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if got := servedName(t, cs, ""); got != "new.test" {
+		t.Fatalf("expected the changed certificate to be served, got %s", got)
+	}
+
+	if err := os.WriteFile(files.CertFile, []byte("broken"), 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	touch(t, files, time.Now().Add(2*time.Minute))
+	if err := cs.reload(); err == nil {
+		t.Fatalf("expected reload of a broken certificate to fail")
+	}
+	if got := servedName(t, cs, ""); got != "new.test" {
+		t.Fatalf("expected the loaded certificate to be kept after a failed reload, got %s", got)
+	}
+}
+
+func TestCertStoreExpiryMetric(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	files := writeCert(t, dir, "expiry", notAfter, "expiry.test")
+	cs, err := newCertStore("expiry", []proxy.CertificateFiles{files})
+	if err != nil {
+		t.Fatalf("newCertStore error: %v", err)
+	}
+	cs.observeAll()
+
+	series := `axproxy_tls_certificate_expiry_timestamp_seconds{listener="expiry",file="` + files.CertFile + `"}`
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if value, ok := strings.CutPrefix(line, series+" "); ok {
+				return value
+			}
+		}
+		return ""
+	}
+	value, err := strconv.ParseFloat(scrape(), 64)
+	if err != nil || int64(value) != notAfter.Unix() {
+		t.Fatalf("expected expiry %d, got %v (%v)", notAfter.Unix(), value, err)
+	}
+	cs.forget()
+	if got := scrape(); got != "" {
+		t.Fatalf("expected expiry series to be deleted, got %s", got)
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+const moduleStopTimeout = 10 * time.Second
+
+// generation is an immutable module graph and set of proxies built from one
+// configuration snapshot. Requests acquire the current generation and release it
+// when done, so a replaced generation can drain before it is discarded.
+type generation struct {
+	id       uint64
+	registry *module.Registry
+	proxies  map[string]*proxy.AuthProxy
+	admin    *Admin
+	tracing  *Tracing
+	digests  map[module.KindName]string
+
+	mu      sync.Mutex
+	active  int
+	retired bool
+	drained chan struct{}
+}
+
+func buildGeneration(id uint64, docs []manifest.Document, prev *generation, lc *module.Lifecycle) (*generation, error) {
+	gen := &generation{
+		id:       id,
+		registry: module.NewRegistry(),
+		proxies:  map[string]*proxy.AuthProxy{},
+		digests:  map[module.KindName]string{},
+		drained:  make(chan struct{}),
+	}
+
+	for _, doc := range docs {
+		kn := module.KindName{Kind: doc.Kind, Name: doc.Metadata.Name}
+		digest := doc.Digest()
+		if prev != nil && prev.digests[kn] == digest {
+			if mod, err := prev.registry.Get(kn.Kind, kn.Name); err == nil {
+				slog.Info("Module unchanged, reusing instance", "module_kind", kn.Kind, "module_name", kn.Name)
+				gen.registry.Register(mod)
+				gen.digests[kn] = digest
+				continue
+			}
+		}
+		mod, ok, err := manifest.DecodeDocument[module.Module](doc)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		gen.registry.Register(mod)
+		gen.digests[kn] = digest
+	}
+
+	admins, err := manifest.DecodeDocuments[Admin](docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(admins) > 1 {
+		return nil, fmt.Errorf("at most one %s manifest is allowed, got %d", KIND_ADMIN, len(admins))
+	}
+	if len(admins) == 1 {
+		gen.admin = &admins[0]
+	}
+
+	tracings, err := manifest.DecodeDocuments[Tracing](docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracings) > 1 {
+		return nil, fmt.Errorf("at most one %s manifest is allowed, got %d", KIND_TRACING, len(tracings))
+	}
+	if len(tracings) == 1 {
+		gen.tracing = &tracings[0]
+	}
+
+	proxies, err := manifest.DecodeDocuments[proxy.AuthProxy](docs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range proxies {
+		p := &proxies[i]
+		if _, exists := gen.proxies[p.Metadata.Name]; exists {
+			return nil, fmt.Errorf("duplicate proxy name %q", p.Metadata.Name)
+		}
+		if err := p.Init(gen.registry, lc); err != nil {
+			return nil, fmt.Errorf("proxy %q: %w", p.Metadata.Name, err)
+		}
+		gen.proxies[p.Metadata.Name] = p
+	}
+
+	return gen, nil
+}
+
+// start starts the modules of the generation in chain order, skipping the ones
+// already started by a previous generation, and the upstream health checks.
+func (g *generation) start(lc *module.Lifecycle) {
+	startOrder := g.stopOrder()
+	slices.Reverse(startOrder)
+	for _, mod := range startOrder {
+		lc.Start(mod)
+	}
+	for _, p := range g.proxies {
+		p.StartHealthChecks()
+	}
+}
+
+// stopHealthChecks stops the active upstream health checks of every proxy and
+// closes the idle upstream connections left behind by requests and probes.
+func (g *generation) stopHealthChecks() {
+	for _, p := range g.proxies {
+		p.StopHealthChecks()
+		p.CloseIdleConnections()
+	}
+}
+
+// deleteTargetMetrics deletes the upstream health series of the generation that
+// none of the live generations reports.
+func (g *generation) deleteTargetMetrics(live map[*generation]bool) {
+	var kept []*proxy.AuthProxy
+	for l := range live {
+		kept = slices.AppendSeq(kept, maps.Values(l.proxies))
+	}
+	for _, p := range g.proxies {
+		p.DeleteTargetMetrics(kept)
+	}
+}
+
+// stopOrder lists the generation modules in the order they should be stopped:
+// reverse chain order, followed by modules not referenced by any chain.
+func (g *generation) stopOrder() []module.Module {
+	var order []module.Module
+	seen := map[module.Module]bool{}
+	names := slices.Sorted(maps.Keys(g.proxies))
+	for _, name := range names {
+		for _, mod := range g.proxies[name].Modules() {
+			if !seen[mod] {
+				seen[mod] = true
+				order = append(order, mod)
+			}
+		}
+	}
+	slices.Reverse(order)
+	for _, mod := range g.registry.Modules() {
+		if !seen[mod] {
+			seen[mod] = true
+			order = append(order, mod)
+		}
+	}
+	return order
+}
+
+// modules returns the set of modules of the generation.
+func (g *generation) modules() map[module.Module]bool {
+	mods := map[module.Module]bool{}
+	for _, mod := range g.registry.Modules() {
+		mods[mod] = true
+	}
+	return mods
+}
+
+// stopModules stops every module of the generation that is not in kept.
+func (g *generation) stopModules(ctx context.Context, lc *module.Lifecycle, kept map[module.Module]bool) {
+	ctx, cancel := context.WithTimeout(ctx, moduleStopTimeout)
+	defer cancel()
+	for _, mod := range g.stopOrder() {
+		if kept[mod] {
+			continue
+		}
+		if err := lc.Stop(ctx, mod); err != nil {
+			slog.Error("Module stop failed", "module_kind", mod.Kind(), "module_name", mod.Name(), "error", err)
+			continue
+		}
+		slog.Info("Module stopped", "module_kind", mod.Kind(), "module_name", mod.Name())
+	}
+}
+
+// acquire marks a request as in-flight on this generation. It returns false once
+// the generation has been retired.
+func (g *generation) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.active++
+	return true
+}
+
+func (g *generation) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.retired && g.active == 0 {
+		close(g.drained)
+	}
+}
+
+// retire stops new requests from acquiring the generation. The drained channel is
+// closed once every in-flight request has been released.
+func (g *generation) retire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return
+	}
+	g.retired = true
+	if g.active == 0 {
+		close(g.drained)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+// listenerConfig holds every setting that requires a new socket or http.Server
+// when it changes. Without certificates the listener serves plain HTTP.
+type listenerConfig struct {
+	name       string
+	address    string
+	mode       string
+	certs      []proxy.CertificateFiles
+	clientAuth *proxy.ClientAuth
+	proxyProto *proxy.ProxyProtocol
+	h2c        bool
+	timeouts   proxy.ServerTimeouts
+
+	redirectPort   int
+	redirectStatus int
+}
+
+// proxyListenerConfigs returns the listener settings of every proxy listener,
+// keyed by listener name. dev allows tls listeners without certificate to use the
+// bundled development certificate.
+func proxyListenerConfigs(p *proxy.AuthProxy, dev bool) (map[string]listenerConfig, error) {
+	out := map[string]listenerConfig{}
+	var errs []error
+	for _, l := range p.EffectiveListeners() {
+		certs, err := l.CertificateFiles(dev)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proxy %q: %w", p.Metadata.Name, err))
+			continue
+		}
+		if l.Mode == proxy.ListenerTLS && l.TLSCertFile == "" && len(l.Certificates) == 0 {
+			slog.Warn("Listener uses the bundled development certificate", "proxy_name", p.Metadata.Name, "listener_name", l.Name)
+		}
+		out[l.Name] = listenerConfig{
+			name:           p.Metadata.Name + "/" + l.Name,
+			address:        l.Address,
+			mode:           l.Mode,
+			certs:          certs,
+			clientAuth:     l.ClientAuth,
+			proxyProto:     l.ProxyProtocol,
+			h2c:            l.H2C,
+			timeouts:       p.Timeouts,
+			redirectPort:   l.RedirectPort,
+			redirectStatus: l.RedirectStatus,
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+func (c listenerConfig) equal(o listenerConfig) bool {
+	return reflect.DeepEqual(c, o)
+}
+
+type listener struct {
+	cfg listenerConfig
+
+	srv       *http.Server
+	ln        net.Listener
+	certs     *certStore
+	stopWatch context.CancelFunc
+	closing   atomic.Bool
+}
+
+func startListener(cfg listenerConfig, handler http.Handler) (*listener, error) {
+	l, err := newListener(cfg, handler)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.bind(); err != nil {
+		return nil, err
+	}
+	l.serve()
+	return l, nil
+}
+
+// newListener loads the certificates of cfg and builds its server without
+// binding the address, so a reload can check every listener before it
+// replaces any.
+func newListener(cfg listenerConfig, handler http.Handler) (*listener, error) {
+	l := &listener{
+		cfg: cfg,
+		srv: &http.Server{
+			Handler:           handler,
+			ReadTimeout:       cfg.timeouts.Read,
+			ReadHeaderTimeout: cfg.timeouts.ReadHeader,
+			WriteTimeout:      cfg.timeouts.Write,
+			IdleTimeout:       cfg.timeouts.Idle,
+		},
+	}
+	if len(cfg.certs) > 0 {
+		certs, err := newCertStore(cfg.name, cfg.certs)
+		if err != nil {
+			return nil, err
+		}
+		l.certs = certs
+		l.srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+		if cfg.clientAuth != nil {
+			if l.srv.TLSConfig.ClientAuth, l.srv.TLSConfig.ClientCAs, err = cfg.clientAuth.TLSConfig(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfg.h2c {
+		l.srv.Protocols = new(http.Protocols)
+		l.srv.Protocols.SetHTTP1(true)
+		l.srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return l, nil
+}
+
+// bind opens the listening socket. Connections wait in the backlog until the
+// listener serves.
+func (l *listener) bind() error {
+	ln, err := net.Listen("tcp", l.cfg.address)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", l.cfg.address, err)
+	}
+	if l.cfg.proxyProto != nil {
+		wrapped, err := l.cfg.proxyProto.Wrap(ln, l.cfg.name)
+		if err != nil {
+			_ = ln.Close()
+			return err
+		}
+		ln = wrapped
+	}
+	l.ln = ln
+	return nil
+}
+
+// serve exports the certificate expiry, watches the certificate files and
+// serves the bound socket.
+func (l *listener) serve() {
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	l.stopWatch = stopWatch
+	if l.certs != nil {
+		l.certs.observeAll()
+		go l.certs.watch(watchCtx, certReloadInterval)
+	}
+	go func() {
+		cfg := l.cfg
+		slog.Info("Listener started", "listener_name", cfg.name, "address", cfg.address, "mode", cfg.mode, "proxy_protocol", cfg.proxyProto != nil, "h2c", cfg.h2c)
+		var err error
+		if l.srv.TLSConfig != nil {
+			err = l.srv.ServeTLS(l.ln, "", "")
+		} else {
+			err = l.srv.Serve(l.ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !l.closing.Load() {
+			slog.Error("Listener failed", "listener_name", cfg.name, "error", err)
+		}
+	}()
+}
+
+// discard releases the socket of a listener that never served.
+func (l *listener) discard() {
+	if l.ln != nil {
+		_ = l.ln.Close()
+	}
+}
+
+// close releases the listening socket so the address can be reused immediately.
+// Open connections are left to shutdown.
+func (l *listener) close() {
+	if l.closing.Swap(true) {
+		return
+	}
+	l.stopWatch()
+	if l.certs != nil {
+		l.certs.forget()
+	}
+	if err := l.ln.Close(); err != nil {
+		slog.Debug("Listener close", "listener_name", l.cfg.name, "error", err)
+	}
+}
+
+// shutdown stops accepting connections and waits for in-flight requests to
+// complete, up to the configured shutdown timeout. Connections still open after
+// the timeout are closed forcibly.
+func (l *listener) shutdown(ctx context.Context) {
+	l.close()
+	ctx, cancel := context.WithTimeout(ctx, l.cfg.timeouts.ShutdownTimeout())
+	defer cancel()
+	if err := l.srv.Shutdown(ctx); err != nil {
+		slog.Warn("Listener drain incomplete, closing connections", "listener_name", l.cfg.name, "error", err)
+		_ = l.srv.Close()
+	}
+	slog.Info("Listener stopped", "listener_name", l.cfg.name, "address", l.cfg.address)
+}
@@ -0,0 +1,9 @@
+package server
+
+import "github.com/axent-pl/axproxy/metrics"
+
+var certExpiry = metrics.NewGaugeVec(
+	"axproxy_tls_certificate_expiry_timestamp_seconds",
+	"Expiry (NotAfter) of the certificates served by tls listeners, as a Unix timestamp.",
+	"listener", "file",
+)
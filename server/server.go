@@ -0,0 +1,308 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+	"github.com/axent-pl/axproxy/tracing"
+)
+
+// Server owns the proxy listeners and the currently active configuration
+// generation. Reload builds a new generation and swaps it in atomically; requests
+// already in flight complete on the generation they started on.
+type Server struct {
+	configPaths []string
+	opts        Options
+
+	lifecycle  *module.Lifecycle
+	tracingCfg *tracing.Config
+
+	// reloadMu serializes reloads and shutdown, mu guards the generations and
+	// listeners. Modules are started holding only reloadMu, so a slow start
+	// does not hold up the retirement of drained generations.
+	reloadMu   sync.Mutex
+	mu         sync.Mutex
+	lastID     uint64
+	generation atomic.Pointer[generation]
+	live       map[*generation]bool
+	listeners  map[string]*listener
+}
+
+// Options holds the command line settings of the server.
+type Options struct {
+	// DevCertificate lets tls listeners without certificate use the bundled
+	// self-signed localhost certificate.
+	DevCertificate bool
+}
+
+func New(configPaths []string, opts Options) *Server {
+	return &Server{
+		configPaths: configPaths,
+		opts:        opts,
+		lifecycle:   module.NewLifecycle(),
+		live:        map[*generation]bool{},
+		listeners:   map[string]*listener{},
+	}
+}
+
+// Reload reads the configuration, builds a new generation and activates it.
+// On error the active generation is left untouched.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	docs, err := manifest.ReadPaths(s.configPaths)
+	if err != nil {
+		return fmt.Errorf("read configuration: %w", err)
+	}
+
+	prev := s.generation.Load()
+	gen, err := buildGeneration(s.lastID+1, docs, prev, s.lifecycle)
+	if err != nil {
+		return err
+	}
+	gen.start(s.lifecycle)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := s.stageListeners(gen)
+	if err != nil {
+		s.discard(gen)
+		return err
+	}
+	s.lastID = gen.id
+	s.live[gen] = true
+	s.generation.Store(gen)
+	slog.Info("Configuration activated", "generation", gen.id)
+
+	if prev != nil {
+		go s.retire(prev)
+	}
+	s.commitListeners(change)
+	if err := s.applyTracing(gen.tracing); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	return nil
+}
+
+// discard stops what a generation that failed to activate started: its health
+// checks and the modules no live generation uses.
+func (s *Server) discard(gen *generation) {
+	gen.stopHealthChecks()
+	gen.deleteTargetMetrics(s.live)
+	kept := map[module.Module]bool{}
+	for g := range s.live {
+		maps.Copy(kept, g.modules())
+	}
+	gen.stopModules(context.Background(), s.lifecycle, kept)
+}
+
+// listenerChange holds the listeners a reload starts, bound but not serving
+// yet, and the ones it replaces or removes, whose sockets are already closed.
+type listenerChange struct {
+	started map[string]*listener
+	closed  map[string]*listener
+}
+
+// stageListeners builds the listeners of the generation that are new or whose
+// listen settings changed, loading their certificates, then closes the
+// listeners they replace and the removed ones and binds the new sockets. On
+// error the closed listeners are restarted and the active ones are left as they
+// were.
+func (s *Server) stageListeners(gen *generation) (*listenerChange, error) {
+	type desired struct {
+		cfg     listenerConfig
+		handler func() http.Handler
+	}
+	var errs []error
+	want := map[string]desired{}
+	for name, p := range gen.proxies {
+		cfgs, err := proxyListenerConfigs(p, s.opts.DevCertificate)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for listenerName, cfg := range cfgs {
+			handler := func() http.Handler { return s.proxyHandler(name) }
+			if cfg.mode == proxy.ListenerRedirect {
+				handler = func() http.Handler { return proxy.RedirectHandler(cfg.redirectPort, cfg.redirectStatus) }
+			}
+			want["proxy/"+name+"/"+listenerName] = desired{cfg: cfg, handler: handler}
+		}
+	}
+	if gen.admin != nil {
+		want[adminListenerName] = desired{cfg: gen.admin.listenerConfig(), handler: s.adminHandler}
+	}
+
+	change := &listenerChange{started: map[string]*listener{}, closed: map[string]*listener{}}
+	for key, d := range want {
+		if l, ok := s.listeners[key]; ok && d.cfg.equal(l.cfg) {
+			continue
+		}
+		l, err := newListener(d.cfg, d.handler())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listener %q: %w", key, err))
+			continue
+		}
+		change.started[key] = l
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// a replacement may bind the address of the listener it replaces or of a
+	// removed one, so those are closed first
+	for key, l := range s.listeners {
+		if _, ok := change.started[key]; ok {
+			l.close()
+			change.closed[key] = l
+		} else if _, ok := want[key]; !ok {
+			l.close()
+			change.closed[key] = l
+		}
+	}
+	for key, l := range change.started {
+		if err := l.bind(); err != nil {
+			s.rollbackListeners(change)
+			return nil, fmt.Errorf("listener %q: %w", key, err)
+		}
+	}
+	return change, nil
+}
+
+// rollbackListeners discards the staged listeners and restarts the closed ones
+// with their settings.
+func (s *Server) rollbackListeners(change *listenerChange) {
+	for _, l := range change.started {
+		l.discard()
+	}
+	for key, old := range change.closed {
+		go old.shutdown(context.Background())
+		l, err := startListener(old.cfg, old.srv.Handler)
+		if err != nil {
+			slog.Error("Listener restart failed", "listener_name", old.cfg.name, "error", err)
+			delete(s.listeners, key)
+			continue
+		}
+		s.listeners[key] = l
+	}
+}
+
+// commitListeners drains the closed listeners and serves the started ones.
+func (s *Server) commitListeners(change *listenerChange) {
+	for key, l := range change.closed {
+		go l.shutdown(context.Background())
+		delete(s.listeners, key)
+	}
+	for key, l := range change.started {
+		l.serve()
+		s.listeners[key] = l
+	}
+}
+
+func (s *Server) proxyHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gen := s.acquire()
+		if gen == nil {
+			http.Error(w, "proxy shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer gen.release()
+		p, ok := gen.proxies[name]
+		if !ok {
+			http.Error(w, "proxy not available", http.StatusServiceUnavailable)
+			return
+		}
+		p.ServeHTTP(w, r)
+	})
+}
+
+// acquire returns the active generation with the request registered as
+// in-flight, or nil when the server is shutting down.
+func (s *Server) acquire() *generation {
+	for {
+		gen := s.generation.Load()
+		if gen.acquire() {
+			return gen
+		}
+		if s.generation.Load() == gen {
+			return nil
+		}
+	}
+}
+
+// Shutdown stops every listener, waits for the in-flight requests of every
+// generation to drain, stops their modules, those of the active generation
+// first, in reverse chain order and flushes the pending trace spans.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, l := range s.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.shutdown(ctx)
+		}()
+		delete(s.listeners, name)
+	}
+	wg.Wait()
+
+	gens := slices.SortedFunc(maps.Keys(s.live), func(a, b *generation) int { return cmp.Compare(b.id, a.id) })
+	clear(s.live)
+	for _, gen := range gens {
+		gen.retire()
+	}
+	stopped := map[module.Module]bool{}
+	for _, gen := range gens {
+		select {
+		case <-gen.drained:
+		case <-ctx.Done():
+		}
+		gen.stopHealthChecks()
+		gen.stopModules(ctx, s.lifecycle, stopped)
+		maps.Copy(stopped, gen.modules())
+	}
+	if t := tracing.SetTracer(nil); t != nil {
+		shutdownTracer(ctx, t)
+	}
+	if len(gens) > 0 {
+		slog.Info("Shutdown completed", "generation", gens[0].id)
+	}
+}
+
+// retire waits for the generation to drain and then stops the modules that are
+// not referenced by a generation still serving or draining. Generations
+// retired by Shutdown meanwhile are left to it.
+func (s *Server) retire(gen *generation) {
+	gen.retire()
+	<-gen.drained
+	slog.Info("Configuration drained", "generation", gen.id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.live[gen] {
+		return
+	}
+	delete(s.live, gen)
+	gen.stopHealthChecks()
+	gen.deleteTargetMetrics(s.live)
+	kept := map[module.Module]bool{}
+	for g := range s.live {
+		maps.Copy(kept, g.modules())
+	}
+	gen.stopModules(context.Background(), s.lifecycle, kept)
+}
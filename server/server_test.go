@@ -0,0 +1,459 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/server"
+	"gopkg.in/yaml.v3"
+)
+
+// probeModule records its starts and stops in probeEvents as
+// "start <name>/<version>" and "stop <name>/<version>". Start takes StartDelay
+// and fails with StartError when set.
+type probeModule struct {
+	module.NoopModule
+	Metadata   manifest.ObjectMeta `yaml:"metadata"`
+	Version    string              `yaml:"version"`
+	StartDelay time.Duration       `yaml:"start_delay"`
+	StartError string              `yaml:"start_error"`
+}
+
+func (m *probeModule) Kind() string { return "Probe" }
+func (m *probeModule) Name() string { return m.Metadata.Name }
+
+func (m *probeModule) Start(context.Context) error {
+	probeEvents.add("start " + m.Metadata.Name + "/" + m.Version)
+	time.Sleep(m.StartDelay)
+	if m.StartError != "" {
+		return errors.New(m.StartError)
+	}
+	return nil
+}
+
+func (m *probeModule) Stop(context.Context) error {
+	probeEvents.add("stop " + m.Metadata.Name + "/" + m.Version)
+	return nil
+}
+
+type probeHandler struct{}
+
+func (probeHandler) Kind() string { return "Probe" }
+
+func (probeHandler) Unmarshal(apiVersion string, rawYAML []byte) (module.Module, error) {
+	var obj struct {
+		Metadata manifest.ObjectMeta `yaml:"metadata"`
+		Spec     probeModule         `yaml:"spec"`
+	}
+	if err := yaml.Unmarshal(rawYAML, &obj); err != nil {
+		return &probeModule{}, err
+	}
+	obj.Spec.Metadata = obj.Metadata
+	return &obj.Spec, nil
+}
+
+func init() {
+	if err := manifest.RegisterHandler[module.Module](probeHandler{}); err != nil {
+		slog.Error("init probeHandler", "error", err)
+	}
+}
+
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(e string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+func (l *eventLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = nil
+}
+
+func (l *eventLog) count(e string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, got := range l.events {
+		if got == e {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *eventLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.events)
+}
+
+var probeEvents eventLog
+
+// freeAddr returns a loopback address with a port that was free a moment ago.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// writeConfig replaces the manifest file of dir with the given documents.
+func writeConfig(t *testing.T, dir string, docs ...string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(strings.Join(docs, "\n---\n")), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
+
+func probeDoc(name, version string) string {
+	return fmt.Sprintf("apiVersion: v1\nkind: Probe\nmetadata:\n  name: %s\nspec:\n  version: %q\n", name, version)
+}
+
+func proxyDoc(name, addr, target string, chain ...string) string {
+	doc := fmt.Sprintf("apiVersion: v1\nkind: AuthProxy\nmetadata:\n  name: %s\nspec:\n  special_prefix: /_\n  listeners:\n    - listen: %q\n      mode: plain\n  upstreams:\n    - target: %s\n  chain:\n", name, addr, target)
+	for _, mod := range chain {
+		kind, modName, _ := strings.Cut(mod, "/")
+		doc += fmt.Sprintf("    - moduleRef:\n        kind: %s\n        name: %s\n", kind, modName)
+	}
+	return doc
+}
+
+// newServer reloads a server from dir and shuts it down with the test.
+func newServer(t *testing.T, dir string) *server.Server {
+	t.Helper()
+	srv := server.New([]string{dir}, server.Options{})
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv
+}
+
+// blockingBackend holds every request until its path is unblocked, after
+// reporting the path on arrived.
+type blockingBackend struct {
+	*httptest.Server
+	mu       sync.Mutex
+	release  map[string]chan struct{}
+	released map[string]bool
+	arrived  chan string
+}
+
+func newBlockingBackend(t *testing.T) *blockingBackend {
+	t.Helper()
+	b := &blockingBackend{release: map[string]chan struct{}{}, released: map[string]bool{}, arrived: make(chan string, 8)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch := b.gate(r.URL.Path)
+		b.arrived <- r.URL.Path
+		<-ch
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *blockingBackend) gate(path string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch, ok := b.release[path]
+	if !ok {
+		ch = make(chan struct{})
+		b.release[path] = ch
+	}
+	return ch
+}
+
+// hold sends a request for path through addr and returns once the backend
+// holds it; the returned channel yields the status after the path is released.
+// The request is released at the latest when the test ends.
+func (b *blockingBackend) hold(t *testing.T, addr, path string) <-chan int {
+	t.Helper()
+	t.Cleanup(func() { b.unblock(path) })
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	select {
+	case <-b.arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request %s did not reach the backend", path)
+	}
+	return done
+}
+
+func (b *blockingBackend) unblock(path string) {
+	ch := b.gate(path)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.released[path] {
+		b.released[path] = true
+		close(ch)
+	}
+}
+
+// eventually polls cond for up to two seconds.
+func eventually(t *testing.T, cond func() bool, format string, args ...any) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadKeepsModulesOfDrainingGenerations(t *testing.T) {
+	probeEvents.reset()
+	backend := newBlockingBackend(t)
+	addr := freeAddr(t)
+	dir := t.TempDir()
+
+	writeConfig(t, dir, probeDoc("x", "1"), proxyDoc("p", addr, backend.URL, "Probe/x"))
+	srv := newServer(t, dir)
+	doneA := backend.hold(t, addr, "/a")
+
+	// generation B reuses x, generation C replaces it
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	doneB := backend.hold(t, addr, "/b")
+	writeConfig(t, dir, probeDoc("x", "2"), proxyDoc("p", addr, backend.URL, "Probe/x"))
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	backend.unblock("/a")
+	if code := <-doneA; code != http.StatusOK {
+		t.Fatalf("expected request of generation A to complete, got %d", code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := probeEvents.count("stop x/1"); n != 0 {
+		t.Fatalf("expected x to keep running while generation B drains, stopped %d times", n)
+	}
+
+	backend.unblock("/b")
+	if code := <-doneB; code != http.StatusOK {
+		t.Fatalf("expected request of generation B to complete, got %d", code)
+	}
+	eventually(t, func() bool { return probeEvents.count("stop x/1") == 1 }, "expected x to stop once generation B drained, events %v", probeEvents.list())
+	time.Sleep(50 * time.Millisecond)
+	if n := probeEvents.count("stop x/1"); n != 1 {
+		t.Fatalf("expected x to stop exactly once, stopped %d times", n)
+	}
+	if n := probeEvents.count("stop x/2"); n != 0 {
+		t.Fatalf("expected the active x to keep running, stopped %d times", n)
+	}
+}
+
+func TestRetireDuringSlowModuleStart(t *testing.T) {
+	probeEvents.reset()
+	backend := newBlockingBackend(t)
+	addr := freeAddr(t)
+	dir := t.TempDir()
+
+	writeConfig(t, dir, probeDoc("x", "1"), probeDoc("z", "1"), proxyDoc("p", addr, backend.URL, "Probe/x"))
+	srv := newServer(t, dir)
+	done := backend.hold(t, addr, "/a")
+	writeConfig(t, dir, probeDoc("x", "1"), proxyDoc("p", addr, backend.URL, "Probe/x"))
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	writeConfig(t, dir, probeDoc("x", "1"), probeDoc("y", "1")+"  start_delay: 3s\n", proxyDoc("p", addr, backend.URL, "Probe/x", "Probe/y"))
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- srv.Reload() }()
+	eventually(t, func() bool { return probeEvents.count("start y/1") == 1 }, "expected y to start")
+
+	backend.unblock("/a")
+	<-done
+	eventually(t, func() bool { return probeEvents.count("stop z/1") == 1 }, "expected drained generation to retire during the start of y")
+	select {
+	case <-reloaded:
+		t.Fatalf("expected reload to still start y")
+	default:
+	}
+	if err := <-reloaded; err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func newNamedBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReloadReusesUnchangedModules(t *testing.T) {
+	probeEvents.reset()
+	backend := newNamedBackend(t, "app")
+	addr := freeAddr(t)
+	dir := t.TempDir()
+
+	writeConfig(t, dir, probeDoc("x", "1"), probeDoc("y", "1"), proxyDoc("p", addr, backend.URL, "Probe/x", "Probe/y"))
+	srv := newServer(t, dir)
+	writeConfig(t, dir, probeDoc("x", "1"), probeDoc("y", "2"), proxyDoc("p", addr, backend.URL, "Probe/x", "Probe/y"))
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	eventually(t, func() bool { return probeEvents.count("stop y/1") == 1 }, "expected replaced y to stop, events %v", probeEvents.list())
+	if probeEvents.count("start x/1") != 1 || probeEvents.count("stop x/1") != 0 {
+		t.Fatalf("expected unchanged x to be reused without restart, events %v", probeEvents.list())
+	}
+	if probeEvents.count("start y/2") != 1 {
+		t.Fatalf("expected changed y to start anew, events %v", probeEvents.list())
+	}
+}
+
+func TestReloadDrainsInFlightRequests(t *testing.T) {
+	old := newBlockingBackend(t)
+	current := newNamedBackend(t, "current")
+	addr := freeAddr(t)
+	dir := t.TempDir()
+
+	writeConfig(t, dir, proxyDoc("p", addr, old.URL))
+	srv := newServer(t, dir)
+	done := old.hold(t, addr, "/slow")
+
+	writeConfig(t, dir, proxyDoc("p", addr, current.URL))
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	if code, body := get(t, "http://"+addr+"/"); code != http.StatusOK || body != "current" {
+		t.Fatalf("expected new requests on the new generation, got %d %q", code, body)
+	}
+	old.unblock("/slow")
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected in-flight request to complete on the old generation, got %d", code)
+	}
+}
+
+func TestReloadFailureKeepsActiveGeneration(t *testing.T) {
+	backend := newNamedBackend(t, "app")
+	addr := freeAddr(t)
+	dir := t.TempDir()
+
+	writeConfig(t, dir, proxyDoc("p", addr, backend.URL))
+	srv := newServer(t, dir)
+	writeConfig(t, dir, proxyDoc("p", addr, backend.URL, "Probe/missing"))
+	if err := srv.Reload(); err == nil {
+		t.Fatalf("expected reload with unresolved module to fail")
+	}
+	if code, body := get(t, "http://"+addr+"/"); code != http.StatusOK || body != "app" {
+		t.Fatalf("expected active generation to keep serving, got %d %q", code, body)
+	}
+}
+
+func TestReloadListenerFailureKeepsActiveGeneration(t *testing.T) {
+	app := newNamedBackend(t, "app")
+	other := newNamedBackend(t, "other")
+	addr := freeAddr(t)
+	dir := t.TempDir()
+	writeConfig(t, dir, proxyDoc("p", addr, app.URL))
+	srv := newServer(t, dir)
+
+	missingCert := strings.Replace(proxyDoc("p", addr, other.URL), "mode: plain",
+		"mode: tls\n      tls_crt_file: "+filepath.Join(dir, "missing.crt")+"\n      tls_key_file: "+filepath.Join(dir, "missing.key"), 1)
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer occupied.Close()
+	for name, doc := range map[string]string{
+		"missing certificate": missingCert,
+		"address in use":      proxyDoc("p", occupied.Addr().String(), other.URL),
+	} {
+		writeConfig(t, dir, doc)
+		if err := srv.Reload(); err == nil {
+			t.Fatalf("%s: expected reload to fail", name)
+		}
+		if code, body := get(t, "http://"+addr+"/"); code != http.StatusOK || body != "app" {
+			t.Fatalf("%s: expected active generation to keep serving, got %d %q", name, code, body)
+		}
+	}
+}
+
+func TestShutdownDrainsThenStopsModulesInReverseChainOrder(t *testing.T) {
+	probeEvents.reset()
+	backend := newBlockingBackend(t)
+	addr := freeAddr(t)
+	dir := t.TempDir()
+
+	writeConfig(t, dir, probeDoc("a", "1"), probeDoc("b", "1"), probeDoc("c", "1"), probeDoc("unused", "1"),
+		proxyDoc("p", addr, backend.URL, "Probe/a", "Probe/b", "Probe/c"))
+	srv := server.New([]string{dir}, server.Options{})
+	if err := srv.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	done := backend.hold(t, addr, "/slow")
+
+	shutdown := make(chan struct{})
+	go func() {
+		srv.Shutdown(context.Background())
+		close(shutdown)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if n := probeEvents.count("stop a/1"); n != 0 {
+		t.Fatalf("expected modules to run until in-flight requests drained")
+	}
+
+	backend.unblock("/slow")
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected in-flight request to complete, got %d", code)
+	}
+	<-shutdown
+	var stops []string
+	for _, e := range probeEvents.list() {
+		if strings.HasPrefix(e, "stop ") {
+			stops = append(stops, e)
+		}
+	}
+	if want := []string{"stop c/1", "stop b/1", "stop a/1", "stop unused/1"}; !slices.Equal(stops, want) {
+		t.Fatalf("got stop order %v, want %v", stops, want)
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+var _ manifest.KindHandler[Tracing] = TracingHandler{}
+
+type TracingV1 struct {
+	manifest.TypeMeta `yaml:",inline"`
+	Metadata          manifest.ObjectMeta `yaml:"metadata"`
+	Spec              Tracing             `yaml:"spec"`
+}
+
+type TracingHandler struct{}
+
+func (TracingHandler) Kind() string { return KIND_TRACING }
+
+func (TracingHandler) Unmarshal(apiVersion string, rawYAML []byte) (Tracing, error) {
+	switch apiVersion {
+	case "v1":
+		var obj TracingV1
+		if err := yaml.Unmarshal(rawYAML, &obj); err != nil {
+			return Tracing{}, err
+		}
+		obj.Spec.Metadata = obj.Metadata
+		if err := obj.Spec.Validate(); err != nil {
+			return Tracing{}, err
+		}
+		return obj.Spec, nil
+	default:
+		return Tracing{}, fmt.Errorf("unsupported apiVersion %q", apiVersion)
+	}
+}
+
+func init() {
+	if err := manifest.RegisterHandler(&TracingHandler{}); err != nil {
+		slog.Error("init TracingHandler", "error", err)
+	}
+}
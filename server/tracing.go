@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/tracing"
+)
+
+const KIND_TRACING string = "Tracing"
+
+// Tracing configures span export. Without a Tracing manifest trace context is
+// still propagated to upstreams but no spans are exported.
+type Tracing struct {
+	Metadata       manifest.ObjectMeta `yaml:"metadata"`
+	tracing.Config `yaml:",inline"`
+}
+
+// applyTracing replaces the process tracer when the tracing configuration of the
+// active generation changed. The previous tracer is flushed in the background.
+func (s *Server) applyTracing(cfg *Tracing) error {
+	var next *tracing.Config
+	if cfg != nil {
+		next = &cfg.Config
+	}
+	if reflect.DeepEqual(next, s.tracingCfg) {
+		return nil
+	}
+
+	var tracer *tracing.Tracer
+	if next != nil {
+		t, err := tracing.NewTracerFromConfig(*next)
+		if err != nil {
+			return err
+		}
+		tracer = t
+		slog.Info("Tracing enabled", "exporter", next.Exporter.Type)
+	} else {
+		slog.Info("Tracing disabled")
+	}
+	s.tracingCfg = next
+	if prev := tracing.SetTracer(tracer); prev != nil {
+		go shutdownTracer(context.Background(), prev)
+	}
+	return nil
+}
+
+func shutdownTracer(ctx context.Context, t *tracing.Tracer) {
+	ctx, cancel := context.WithTimeout(ctx, moduleStopTimeout)
+	defer cancel()
+	if err := t.Shutdown(ctx); err != nil {
+		slog.Error("Tracer shutdown failed", "error", err)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/axent-pl/axproxy/manifest"
+	"github.com/axent-pl/axproxy/module"
+	"github.com/axent-pl/axproxy/proxy"
+)
+
+// DocumentError ties a validation error to the manifest document that caused it.
+type DocumentError struct {
+	Document manifest.Document
+	Err      error
+}
+
+func (e DocumentError) Error() string {
+	return fmt.Sprintf("%s: kind %q name %q: %v", e.Document.Position(), e.Document.Kind, e.Document.Metadata.Name, e.Err)
+}
+
+func (e DocumentError) Unwrap() error {
+	return e.Err
+}
+
+// Validate decodes every document, resolves every proxy chain and checks special
+// route collisions, the chain requirements of the modules and listener
+// certificates. It returns one error per problem found.
+func Validate(docs []manifest.Document, opts Options) []error {
+	var errs []error
+	reg := module.NewRegistry()
+	moduleDocs := map[module.KindName]manifest.Document{}
+	proxyDocs := map[string]manifest.Document{}
+	var proxies []proxy.AuthProxy
+	var proxyDocList []manifest.Document
+	var adminDoc *manifest.Document
+	var tracingDoc *manifest.Document
+
+	for _, doc := range docs {
+		if !manifest.HasHandler(doc.Kind) {
+			errs = append(errs, DocumentError{Document: doc, Err: fmt.Errorf("no handler registered for kind %q", doc.Kind)})
+			continue
+		}
+		if doc.Metadata.Name == "" {
+			errs = append(errs, DocumentError{Document: doc, Err: fmt.Errorf("missing metadata.name")})
+			continue
+		}
+
+		mod, ok, err := manifest.DecodeDocument[module.Module](doc)
+		if err != nil {
+			errs = append(errs, DocumentError{Document: doc, Err: err})
+			continue
+		}
+		if ok {
+			kn := module.KindName{Kind: mod.Kind(), Name: mod.Name()}
+			if prev, exists := moduleDocs[kn]; exists {
+				errs = append(errs, DocumentError{Document: doc, Err: fmt.Errorf("duplicate module, first defined at %s", prev.Position())})
+				continue
+			}
+			moduleDocs[kn] = doc
+			reg.Register(mod)
+			continue
+		}
+
+		if _, ok, err := manifest.DecodeDocument[Admin](doc); err != nil || ok {
+			if err != nil {
+				errs = append(errs, DocumentError{Document: doc, Err: err})
+				continue
+			}
+			if adminDoc != nil {
+				errs = append(errs, DocumentError{Document: doc, Err: fmt.Errorf("duplicate %s manifest, first defined at %s", KIND_ADMIN, adminDoc.Position())})
+				continue
+			}
+			adminDoc = &doc
+			continue
+		}
+
+		if _, ok, err := manifest.DecodeDocument[Tracing](doc); err != nil || ok {
+			if err != nil {
+				errs = append(errs, DocumentError{Document: doc, Err: err})
+				continue
+			}
+			if tracingDoc != nil {
+				errs = append(errs, DocumentError{Document: doc, Err: fmt.Errorf("duplicate %s manifest, first defined at %s", KIND_TRACING, tracingDoc.Position())})
+				continue
+			}
+			tracingDoc = &doc
+			continue
+		}
+
+		p, ok, err := manifest.DecodeDocument[proxy.AuthProxy](doc)
+		if err != nil {
+			errs = append(errs, DocumentError{Document: doc, Err: err})
+			continue
+		}
+		if ok {
+			if prev, exists := proxyDocs[p.Metadata.Name]; exists {
+				errs = append(errs, DocumentError{Document: doc, Err: fmt.Errorf("duplicate proxy, first defined at %s", prev.Position())})
+				continue
+			}
+			proxyDocs[p.Metadata.Name] = doc
+			proxies = append(proxies, p)
+			proxyDocList = append(proxyDocList, doc)
+		}
+	}
+
+	for i := range proxies {
+		perrs := proxies[i].Validate(reg)
+		if len(perrs) == 0 {
+			if _, err := proxyListenerConfigs(&proxies[i], opts.DevCertificate); err != nil {
+				perrs = append(perrs, err)
+			}
+		}
+		for _, err := range perrs {
+			errs = append(errs, DocumentError{Document: proxyDocList[i], Err: err})
+		}
+	}
+	return errs
+}
+
+// PrintChain writes the resolved module order of the named proxy together with
+// the hooks each module participates in, followed by every upstream chain
+// override.
+func PrintChain(w io.Writer, docs []manifest.Document, proxyName string) error {
+	reg := module.NewRegistry()
+	mods, err := manifest.DecodeDocuments[module.Module](docs)
+	if err != nil {
+		return err
+	}
+	for _, mod := range mods {
+		reg.Register(mod)
+	}
+	proxies, err := manifest.DecodeDocuments[proxy.AuthProxy](docs)
+	if err != nil {
+		return err
+	}
+	for i := range proxies {
+		p := &proxies[i]
+		if p.Metadata.Name != proxyName {
+			continue
+		}
+		if errs := p.Validate(reg); len(errs) > 0 {
+			return errs[0]
+		}
+		var listeners []string
+		for _, l := range p.EffectiveListeners() {
+			listeners = append(listeners, l.Address+" "+l.Mode)
+		}
+		fmt.Fprintf(w, "proxy %s (listen %s)\n", p.Metadata.Name, strings.Join(listeners, ", "))
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "#\tKIND\tNAME\tHOOKS")
+		for idx, mod := range p.ChainModules() {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", idx+1, mod.Kind(), mod.Name(), strings.Join(module.Hooks(mod), ", "))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for i := range p.Upstreams {
+			u := &p.Upstreams[i]
+			if len(u.Chain) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\nupstream %s (target %s)\n", u.Label(), u.Target)
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "#\tKIND\tNAME\tHOOKS")
+			for idx, mod := range u.Modules() {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", idx+1, mod.Kind(), mod.Name(), strings.Join(module.Hooks(mod), ", "))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("proxy %q not found", proxyName)
+}
@@ -0,0 +1,151 @@
+package server_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/axent-pl/axproxy/manifest"
+	_ "github.com/axent-pl/axproxy/modules"
+	"github.com/axent-pl/axproxy/server"
+)
+
+func splitDocs(t *testing.T, docs ...string) []manifest.Document {
+	t.Helper()
+	out, err := manifest.SplitAll(strings.NewReader(strings.Join(docs, "\n---\n")))
+	if err != nil {
+		t.Fatalf("SplitAll error: %v", err)
+	}
+	return out
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	docs := splitDocs(t,
+		probeDoc("x", "1"),
+		probeDoc("x", "2"),
+		"apiVersion: v1\nkind: Unknown\nmetadata:\n  name: u\n",
+		"apiVersion: v1\nkind: Probe\nmetadata: {}\n",
+		proxyDoc("p", "127.0.0.1:0", "http://app.test", "Probe/x", "Probe/missing"),
+	)
+	errs := server.Validate(docs, server.Options{})
+	want := []string{
+		`document 2): kind "Probe" name "x": duplicate module, first defined at <input>:1 (document 1)`,
+		`document 3): kind "Unknown" name "u": no handler registered for kind "Unknown"`,
+		`document 4): kind "Probe" name "": missing metadata.name`,
+		`document 5): kind "AuthProxy" name "p": chain[1]: module not found, kind: Probe, name: missing`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		var docErr server.DocumentError
+		if !errors.As(err, &docErr) || !strings.HasSuffix(err.Error(), want[i]) {
+			t.Fatalf("error %d: got %q, want suffix %q", i, err, want[i])
+		}
+	}
+
+	if errs := server.Validate(splitDocs(t, probeDoc("x", "1"), proxyDoc("p", "127.0.0.1:0", "http://app.test", "Probe/x")), server.Options{}); len(errs) != 0 {
+		t.Fatalf("expected valid configuration, got %v", errs)
+	}
+}
+
+func TestValidateReportsChainRequirements(t *testing.T) {
+	docs := splitDocs(t,
+		"apiVersion: v1\nkind: AuthMTLS\nmetadata:\n  name: m\nspec:\n  mappings:\n    session.user: ${certificate.subject.dn}\n",
+		proxyDoc("p", "127.0.0.1:0", "http://app.test", "AuthMTLS/m"),
+	)
+	errs := server.Validate(docs, server.Options{})
+	want := []string{
+		`chain[0]: AuthMTLS/m: no listener of the proxy has client_auth`,
+		`chain[0]: AuthMTLS/m: mapping session.user requires a Session module earlier in the chain`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if !strings.HasSuffix(err.Error(), want[i]) {
+			t.Fatalf("error %d: got %q, want suffix %q", i, err, want[i])
+		}
+	}
+}
+
+func TestValidateReportsOIDCSettings(t *testing.T) {
+	oidcDoc := func(name, spec string) string {
+		return "apiVersion: v1\nkind: AuthOIDC\nmetadata:\n  name: " + name + "\nspec:\n  issuer: https://idp.test\n  client_id: app\n" + spec
+	}
+	docs := splitDocs(t,
+		oidcDoc("public", "  public_client: true\n  disable_pkce: true\n"),
+		oidcDoc("confidential", ""),
+		oidcDoc("valid", "  public_client: true\n"),
+		"apiVersion: v1\nkind: AuthOIDC\nmetadata:\n  name: manual\nspec:\n  client_id: app\n  client_secret: s\n  token_url: https://idp.test/token\n",
+	)
+	errs := server.Validate(docs, server.Options{})
+	want := []string{
+		`name "public": public_client requires pkce`,
+		`name "confidential": client_secret is required unless public_client is set`,
+		`name "manual": authorize_url, token_url and jwks_url are required without issuer`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if !strings.HasSuffix(err.Error(), want[i]) {
+			t.Fatalf("error %d: got %q, want suffix %q", i, err, want[i])
+		}
+	}
+}
+
+func TestPrintChain(t *testing.T) {
+	docs := splitDocs(t,
+		probeDoc("x", "1"),
+		"apiVersion: v1\nkind: Session\nmetadata:\n  name: s\nspec: {}\n",
+		`apiVersion: v1
+kind: AuthProxy
+metadata:
+  name: p
+spec:
+  special_prefix: /_
+  listeners:
+    - listen: 127.0.0.1:8080
+      mode: plain
+  upstreams:
+    - name: api
+      target: http://api.test
+      chain:
+        - moduleRef: {kind: Probe, name: x}
+  chain:
+    - moduleRef: {kind: Session, name: s}
+    - moduleRef: {kind: Probe, name: x}
+`,
+	)
+	var out strings.Builder
+	if err := server.PrintChain(&out, docs, "p"); err != nil {
+		t.Fatalf("PrintChain error: %v", err)
+	}
+	var got [][]string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		got = append(got, strings.Fields(line))
+	}
+	want := [][]string{
+		{"proxy", "p", "(listen", "127.0.0.1:8080", "plain)"},
+		{"#", "KIND", "NAME", "HOOKS"},
+		{"1", "Session", "s", "Middleware,", "ProxyMiddleware"},
+		{"2", "Probe", "x"},
+		nil,
+		{"upstream", "api", "(target", "http://api.test)"},
+		{"#", "KIND", "NAME", "HOOKS"},
+		{"1", "Probe", "x"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	for i := range want {
+		if strings.Join(got[i], " ") != strings.Join(want[i], " ") {
+			t.Fatalf("line %d: got %q, want %q\n%s", i+1, got[i], want[i], out.String())
+		}
+	}
+
+	if err := server.PrintChain(&out, docs, "other"); err == nil {
+		t.Fatalf("expected unknown proxy to fail")
+	}
+}
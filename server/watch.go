@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/axent-pl/axproxy/manifest"
+)
+
+// Watch reloads the configuration on SIGHUP and whenever a configuration file is
+// added, removed or modified. It blocks until ctx is cancelled.
+func (s *Server) Watch(ctx context.Context, interval time.Duration) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last := s.configStamp()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			last = s.configStamp()
+			s.reload("signal")
+		case <-tick:
+			stamp := s.configStamp()
+			if stamp == last {
+				continue
+			}
+			last = stamp
+			s.reload("file change")
+		}
+	}
+}
+
+func (s *Server) reload(trigger string) {
+	slog.Info("Configuration reload", "trigger", trigger)
+	if err := s.Reload(); err != nil {
+		slog.Error("Configuration reload failed", "trigger", trigger, "error", err)
+	}
+}
+
+func (s *Server) configStamp() string {
+	files, err := manifest.ExpandPaths(s.configPaths)
+	if err != nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d;", file, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return sb.String()
+}
@@ -0,0 +1,18 @@
+package state
+
+// ClientKey holds the Client the request originates from.
+const ClientKey = "proxy.client"
+
+// Client describes the originating client of a request. When the connection
+// comes from a trusted proxy, IP, Scheme and Host are derived from the
+// forwarding headers; otherwise they are those of the connection itself.
+type Client struct {
+	IP     string
+	Scheme string
+	Host   string
+
+	// Peer is the IP address of the connection and PeerTrusted reports whether
+	// it is one of the trusted proxies.
+	Peer        string
+	PeerTrusted bool
+}
@@ -0,0 +1,5 @@
+package state
+
+// ClientCertificateKey holds the fields of the verified client certificate, as
+// exposed to mapper expressions under certificate.*.
+const ClientCertificateKey = "auth.client_certificate"
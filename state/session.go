@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"maps"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +15,8 @@ type Session struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	ExpiresAt *time.Time
+
+	invalidated atomic.Bool
 }
 
 func NewSession(id string, maxAgeSeconds int) *Session {
@@ -52,12 +55,31 @@ func (s *Session) SetValue(key string, val any) {
 	s.values[key] = val
 }
 
+func (s *Session) DeleteValue(key string) {
+	s.valuesMU.Lock()
+	defer s.valuesMU.Unlock()
+	delete(s.values, key)
+}
+
 func (s *Session) SetValues(values map[string]any) {
 	s.valuesMU.Lock()
 	defer s.valuesMU.Unlock()
 	maps.Copy(s.values, values)
 }
 
+// Invalidate drops the values of the session and marks it for removal, e.g.
+// on logout. The session store deletes it instead of saving it again.
+func (s *Session) Invalidate() {
+	s.valuesMU.Lock()
+	defer s.valuesMU.Unlock()
+	clear(s.values)
+	s.invalidated.Store(true)
+}
+
+func (s *Session) Invalidated() bool {
+	return s != nil && s.invalidated.Load()
+}
+
 func (s *Session) IsExpired() bool {
 	if s == nil || s.ExpiresAt == nil {
 		return false
@@ -0,0 +1,11 @@
+package state
+
+// UpstreamTargetKey holds the UpstreamTarget the request was proxied to.
+const UpstreamTargetKey = "proxy.upstream_target"
+
+// UpstreamTarget describes the upstream target picked for a request.
+type UpstreamTarget struct {
+	Origin   string
+	Name     string
+	Metadata map[string]string
+}
@@ -0,0 +1,294 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ExporterOTLPHTTP = "otlphttp"
+	ExporterFile     = "file"
+
+	defaultOTLPTimeout = 10 * time.Second
+)
+
+// Config configures the process tracer.
+type Config struct {
+	ServiceName string         `yaml:"service_name"`
+	SampleRatio *float64       `yaml:"sample_ratio"`
+	Exporter    ExporterConfig `yaml:"exporter"`
+}
+
+// ExporterConfig selects the span exporter. Endpoint, Headers and Timeout apply
+// to otlphttp, Path applies to file.
+type ExporterConfig struct {
+	Type     string            `yaml:"type"`
+	Endpoint string            `yaml:"endpoint"`
+	Headers  map[string]string `yaml:"headers"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Path     string            `yaml:"path"`
+}
+
+func (c Config) serviceName() string {
+	if c.ServiceName != "" {
+		return c.ServiceName
+	}
+	return "axproxy"
+}
+
+func (c Config) sampleRatio() float64 {
+	if c.SampleRatio != nil {
+		return *c.SampleRatio
+	}
+	return 1
+}
+
+// Validate checks the configuration without opening the exporter.
+func (c Config) Validate() error {
+	if r := c.sampleRatio(); r < 0 || r > 1 {
+		return fmt.Errorf("sample_ratio must be between 0 and 1, got %v", r)
+	}
+	switch c.Exporter.Type {
+	case ExporterOTLPHTTP:
+		if c.Exporter.Endpoint == "" {
+			return fmt.Errorf("otlphttp exporter endpoint is empty")
+		}
+	case ExporterFile:
+		if c.Exporter.Path == "" {
+			return fmt.Errorf("file exporter path is empty")
+		}
+	default:
+		return fmt.Errorf("unsupported exporter type %q", c.Exporter.Type)
+	}
+	return nil
+}
+
+// NewTracerFromConfig builds the exporter described by cfg and starts a tracer.
+func NewTracerFromConfig(cfg Config) (*Tracer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var exp Exporter
+	switch cfg.Exporter.Type {
+	case ExporterOTLPHTTP:
+		exp = NewOTLPHTTPExporter(cfg.serviceName(), cfg.Exporter.Endpoint, cfg.Exporter.Headers, cfg.Exporter.Timeout)
+	case ExporterFile:
+		fe, err := NewFileExporter(cfg.serviceName(), cfg.Exporter.Path)
+		if err != nil {
+			return nil, err
+		}
+		exp = fe
+	}
+	return NewTracer(exp, cfg.sampleRatio()), nil
+}
+
+// OTLPHTTPExporter posts spans as OTLP/HTTP JSON to a collector traces endpoint,
+// e.g. http://collector:4318/v1/traces.
+type OTLPHTTPExporter struct {
+	serviceName string
+	endpoint    string
+	headers     map[string]string
+	client      *http.Client
+}
+
+func NewOTLPHTTPExporter(serviceName, endpoint string, headers map[string]string, timeout time.Duration) *OTLPHTTPExporter {
+	if timeout <= 0 {
+		timeout = defaultOTLPTimeout
+	}
+	return &OTLPHTTPExporter{
+		serviceName: serviceName,
+		endpoint:    endpoint,
+		headers:     headers,
+		client:      &http.Client{Timeout: timeout},
+	}
+}
+
+func (e *OTLPHTTPExporter) Export(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(encodeOTLP(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export: status %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPHTTPExporter) Shutdown(context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// FileExporter appends every batch as one line of OTLP JSON to a file.
+type FileExporter struct {
+	serviceName string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileExporter(serviceName, path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open trace file: %w", err)
+	}
+	return &FileExporter{serviceName: serviceName, f: f}, nil
+}
+
+func (e *FileExporter) Export(_ context.Context, spans []SpanData) error {
+	line, err := json.Marshal(encodeOTLP(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.f.Write(append(line, '\n'))
+	return err
+}
+
+func (e *FileExporter) Shutdown(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// OTLP/JSON wire types, see opentelemetry-proto trace/v1.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+func encodeOTLP(serviceName string, spans []SpanData) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.SpanContext.TraceID.String(),
+			SpanID:            s.SpanContext.SpanID.String(),
+			TraceState:        s.SpanContext.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+			Status:            otlpStatus{Code: otlpStatusUnset},
+		}
+		if s.ParentSpanID.IsValid() {
+			span.ParentSpanID = s.ParentSpanID.String()
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		out = append(out, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttributes(map[string]any{"service.name": serviceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/axent-pl/axproxy"}, Spans: out}},
+	}}}
+}
+
+func encodeAttributes(attrs map[string]any) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	out := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		var v otlpValue
+		switch val := attrs[k].(type) {
+		case string:
+			v.StringValue = &val
+		case bool:
+			v.BoolValue = &val
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+
+	flagSampled byte = 0x01
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext is the part of a span propagated across process boundaries as
+// defined by W3C Trace Context.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// Traceparent formats the span context as a version 00 traceparent value.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// ParseTraceparent parses a traceparent header value. Future versions are
+// accepted as long as the version 00 fields can be read.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	value = strings.TrimSpace(value)
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || !isLowerHex(version) {
+		return sc, false
+	}
+	if version == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 {
+		return sc, false
+	}
+	if !isLowerHex(traceID) || !isLowerHex(spanID) || !isLowerHex(flags) {
+		return sc, false
+	}
+	_, _ = hex.Decode(sc.TraceID[:], []byte(traceID))
+	_, _ = hex.Decode(sc.SpanID[:], []byte(spanID))
+	var f [1]byte
+	_, _ = hex.Decode(f[:], []byte(flags))
+	sc.Flags = f[0]
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+// Extract reads the span context of the caller from the request headers.
+func Extract(h http.Header) (SpanContext, bool) {
+	sc, ok := ParseTraceparent(h.Get(TraceparentHeader))
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc.TraceState = strings.Join(h.Values(TracestateHeader), ",")
+	return sc, true
+}
+
+// Inject writes the span context to the request headers, replacing any trace
+// context the client sent.
+func Inject(sc SpanContext, h http.Header) {
+	if !sc.IsValid() {
+		return
+	}
+	h.Set(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Set(TracestateHeader, sc.TraceState)
+	} else {
+		h.Del(TracestateHeader)
+	}
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+// InjectContext writes the span context carried by ctx to the headers.
+func InjectContext(ctx context.Context, h http.Header) {
+	Inject(SpanContextFromContext(ctx), h)
+}
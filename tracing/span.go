@@ -0,0 +1,146 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// SpanData is the immutable snapshot of an ended span handed to exporters.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]any
+	Error        string
+}
+
+// Span is a timed operation within a trace. A nil *Span is valid and ignores
+// every call.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+type spanCtxKey struct{}
+type remoteCtxKey struct{}
+
+// ContextWithRemoteSpanContext returns a context carrying a span context received
+// from a caller. Spans started from it become its children.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteCtxKey{}, sc)
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanCtxKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the span context of the current span, falling
+// back to a remote span context.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteCtxKey{}).(SpanContext)
+	return sc
+}
+
+// Start begins a span as a child of the span in ctx, or as the root of a new
+// trace. The span is exported on End when the trace is sampled.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	tracer := current()
+	parent := SpanContextFromContext(ctx)
+
+	sc := SpanContext{SpanID: newSpanID()}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+		sc.TraceState = parent.TraceState
+	} else {
+		sc.TraceID = newTraceID()
+		if tracer.sample(sc.TraceID) {
+			sc.Flags |= flagSampled
+		}
+	}
+
+	span := &Span{
+		tracer: tracer,
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			SpanContext:  sc,
+			ParentSpanID: parent.SpanID,
+			Start:        time.Now(),
+			Attributes:   map[string]any{},
+		},
+	}
+	return context.WithValue(ctx, spanCtxKey{}, span), span
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.SpanContext
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Attributes[key] = value
+	}
+}
+
+// RecordError marks the span as failed. Nil errors are ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Error = err.Error()
+	}
+}
+
+// End completes the span. Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled() {
+		s.tracer.enqueue(data)
+	}
+}
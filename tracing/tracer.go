@@ -0,0 +1,163 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize      = 2048
+	batchSize      = 512
+	exportInterval = time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+// Exporter ships ended spans to a backend.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer batches sampled spans and hands them to its exporter in the background.
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan SpanData
+	flush  chan chan struct{}
+	done   chan struct{}
+}
+
+var active atomic.Pointer[Tracer]
+
+// NewTracer starts a tracer that samples new traces with the given ratio and
+// exports through exp.
+func NewTracer(exp Exporter, sampleRatio float64) *Tracer {
+	t := &Tracer{
+		exporter:    exp,
+		sampleRatio: sampleRatio,
+		queue:       make(chan SpanData, queueSize),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// SetTracer installs t as the tracer used by Start and returns the previously
+// installed one. A nil tracer disables exporting; trace context is still
+// propagated.
+func SetTracer(t *Tracer) *Tracer {
+	return active.Swap(t)
+}
+
+func current() *Tracer {
+	return active.Load()
+}
+
+func (t *Tracer) sample(id TraceID) bool {
+	if t == nil || t.sampleRatio <= 0 {
+		return false
+	}
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	return binary.BigEndian.Uint64(id[8:]) < uint64(t.sampleRatio*math.MaxUint64)
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	if t == nil {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- data:
+	default:
+		slog.Warn("Trace span dropped, export queue full", "span_name", data.Name)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []SpanData
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			slog.Error("Trace export failed", "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case ack := <-t.flush:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			export()
+			close(ack)
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+// ForceFlush exports every queued span.
+func (t *Tracer) ForceFlush(ctx context.Context) {
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-t.done:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-ack:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown exports the queued spans and releases the exporter. Spans ended
+// afterwards are discarded.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+	return t.exporter.Shutdown(ctx)
+}
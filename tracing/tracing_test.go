@@ -0,0 +1,145 @@
+package tracing_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/axent-pl/axproxy/tracing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatalf("expected traceparent to parse")
+	}
+	if got := sc.TraceID.String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("unexpected trace id %s", got)
+	}
+	if got := sc.SpanID.String(); got != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected span id %s", got)
+	}
+	if !sc.Sampled() {
+		t.Fatalf("expected sampled flag")
+	}
+	if got := sc.Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("unexpected round trip %s", got)
+	}
+}
+
+func TestParseTraceparentInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := tracing.ParseTraceparent(value); ok {
+			t.Fatalf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestStartContinuesRemoteTrace(t *testing.T) {
+	h := http.Header{}
+	h.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.Set(tracing.TracestateHeader, "vendor=value")
+	remote, ok := tracing.Extract(h)
+	if !ok {
+		t.Fatalf("expected trace context to be extracted")
+	}
+
+	ctx := tracing.ContextWithRemoteSpanContext(context.Background(), remote)
+	ctx, span := tracing.Start(ctx, "server", tracing.SpanKindServer)
+	defer span.End()
+
+	sc := span.SpanContext()
+	if sc.TraceID != remote.TraceID {
+		t.Fatalf("expected trace id to be kept")
+	}
+	if sc.SpanID == remote.SpanID {
+		t.Fatalf("expected a new span id")
+	}
+
+	out := http.Header{}
+	tracing.InjectContext(ctx, out)
+	injected, ok := tracing.Extract(out)
+	if !ok {
+		t.Fatalf("expected trace context to be injected")
+	}
+	if injected.SpanID != sc.SpanID || injected.TraceState != "vendor=value" {
+		t.Fatalf("unexpected injected context %+v", injected)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	tracer, err := tracing.NewTracerFromConfig(tracing.Config{
+		ServiceName: "test",
+		Exporter:    tracing.ExporterConfig{Type: tracing.ExporterFile, Path: path},
+	})
+	if err != nil {
+		t.Fatalf("NewTracerFromConfig error: %v", err)
+	}
+	prev := tracing.SetTracer(tracer)
+	defer tracing.SetTracer(prev)
+
+	ctx, parent := tracing.Start(context.Background(), "parent", tracing.SpanKindServer)
+	_, child := tracing.Start(ctx, "child", tracing.SpanKindInternal)
+	child.SetAttribute("lookup", "sAMAccountName")
+	child.End()
+	parent.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open error: %v", err)
+	}
+	defer f.Close()
+
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+	}
+	spans := map[string]span{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans["child"].ParentSpanID != spans["parent"].SpanID {
+		t.Fatalf("expected child to reference parent span")
+	}
+	if spans["child"].TraceID != spans["parent"].TraceID {
+		t.Fatalf("expected spans to share the trace id")
+	}
+}
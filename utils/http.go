@@ -6,14 +6,47 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/axent-pl/axproxy/state"
 )
 
+// RequestScheme returns the scheme used by the originating client: the one the
+// proxy derived from trusted forwarding headers, otherwise that of the
+// connection.
 func RequestScheme(r *http.Request) string {
-	scheme := "http"
-	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
-		scheme = "https"
+	if c, ok := requestClient(r); ok && c.Scheme != "" {
+		return c.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RequestHost returns the host requested by the originating client, see
+// RequestScheme.
+func RequestHost(r *http.Request) string {
+	if c, ok := requestClient(r); ok && c.Host != "" {
+		return c.Host
 	}
-	return scheme
+	return r.Host
+}
+
+func requestClient(r *http.Request) (state.Client, bool) {
+	st := state.GetState(r.Context())
+	if st == nil {
+		return state.Client{}, false
+	}
+	v, _ := st.Get(state.ClientKey)
+	c, ok := v.(state.Client)
+	return c, ok
+}
+
+// IsGRPC reports whether the request is a gRPC call. gRPC-Web, which carries
+// its status in the response body, is not.
+func IsGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
 }
 
 func RandomURLSafe(nBytes int) (string, error) {
@@ -2,6 +2,7 @@ package mapper
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -9,12 +10,14 @@ import (
 	"strings"
 
 	"github.com/axent-pl/axproxy/state"
+	"github.com/axent-pl/axproxy/utils"
 )
 
 // BuildSourceMap builds a mapper-compatible source map from env, session, request and response.
 // Supported paths:
 //   - session.<KEY>
-//   - request.host|path|method|headers.<Header>[idx]
+//   - request.host|path|method|protocol|remote_addr|client_ip|headers.<Header>[idx]
+//   - request.grpc.service|method|metadata.<key>[idx] (gRPC calls only)
 //   - response.status|host|path|method|headers.<Header>[idx]
 func BuildSourceMap(sess *state.Session, req *http.Request, resp *http.Response) map[string]any {
 	src := map[string]any{}
@@ -85,16 +88,63 @@ func envToAnyMap() map[string]any {
 
 func requestToMap(r *http.Request) map[string]any {
 	out := map[string]any{
-		"host":    r.Host,
-		"method":  r.Method,
-		"headers": headersToAnyMap(r.Header),
+		"host":        r.Host,
+		"method":      r.Method,
+		"protocol":    r.Proto,
+		"headers":     headersToAnyMap(r.Header),
+		"remote_addr": r.RemoteAddr,
+		"client_ip":   clientIP(r),
 	}
 	if r.URL != nil {
 		out["path"] = r.URL.Path
 	}
+	if utils.IsGRPC(r) {
+		out["grpc"] = grpcToMap(r)
+	}
 	return out
 }
 
+// grpcToMap splits the path of a gRPC call into service and method and
+// exposes its metadata keyed by lower-case name, without the reserved
+// content-type, te and grpc- entries.
+func grpcToMap(r *http.Request) map[string]any {
+	service, method := "", ""
+	if r.URL != nil {
+		if i := strings.LastIndex(r.URL.Path, "/"); i > 0 {
+			service, method = r.URL.Path[1:i], r.URL.Path[i+1:]
+		}
+	}
+	md := map[string]any{}
+	for k, vs := range headersToAnyMap(r.Header) {
+		k = strings.ToLower(k)
+		if k == "content-type" || k == "te" || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		md[k] = vs
+	}
+	return map[string]any{
+		"service":  service,
+		"method":   method,
+		"metadata": md,
+	}
+}
+
+// clientIP returns the originating client address resolved by the proxy,
+// falling back to the address of the connection.
+func clientIP(r *http.Request) string {
+	if st := state.GetState(r.Context()); st != nil {
+		if v, ok := st.Get(state.ClientKey); ok {
+			if c, ok := v.(state.Client); ok {
+				return c.IP
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 func responseToMap(resp *http.Response) map[string]any {
 	out := map[string]any{
 		"status":  resp.StatusCode,
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadClientTLSFiles sets the root CAs of cfg to the system pool extended with
+// the certificates of caFile and adds the client certificate of certFile and
+// keyFile. Empty names are skipped; the client certificate needs both.
+func LoadClientTLSFiles(cfg *tls.Config, caFile, certFile, keyFile string) error {
+	if caFile != "" {
+		caData, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read ca file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("append ca file: no certs found")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return fmt.Errorf("client cert and key files must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("load client cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}